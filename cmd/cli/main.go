@@ -24,9 +24,7 @@ func main() {
 		Port:                  Port,
 		MemTableSizeThreshold: 30, // bytes
 		SSTableBlockSize:      20, // bytes
-		SparseWALBufferSize:   2,  // records
-		BloomFilterSize:       100,
-		BloomFilterHashCount:  3,
+		FilterFPRate:          0.01,
 		RootDataDir:           "./data",
 	}
 
@@ -1,13 +1,133 @@
 package config
 
+import (
+	"time"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/filter"
+)
+
+// WALSyncMode controls when WAL writes are fsynced to disk
+type WALSyncMode int
+
+const (
+	// WALSyncOS leaves flushing of the page cache to the operating system
+	WALSyncOS WALSyncMode = iota
+	// WALSyncAlways fsyncs before a write is acknowledged, concurrent writers share one fsync
+	WALSyncAlways
+	// WALSyncInterval fsyncs in the background every WALSyncInterval
+	WALSyncInterval
+)
+
+// WALRecoveryMode controls how corrupted WAL records are handled when the memtable is recovered
+type WALRecoveryMode int
+
+const (
+	// WALRecoveryTolerateCorruptedTail drops a torn write at the end of the newest segment, other corruption aborts
+	WALRecoveryTolerateCorruptedTail WALRecoveryMode = iota
+	// WALRecoveryAbsoluteConsistency aborts on any corrupted record
+	WALRecoveryAbsoluteConsistency
+	// WALRecoveryPointInTime stops at the first corrupted record and drops everything after it
+	WALRecoveryPointInTime
+	// WALRecoverySkipCorrupted skips corrupted records and keeps every valid record
+	WALRecoverySkipCorrupted
+)
+
+// Compression is the codec of the data blocks of new SSTables
+type Compression int
+
+const (
+	// CompressionNone stores data blocks uncompressed
+	CompressionNone Compression = iota
+	// CompressionFlate compresses with DEFLATE, the best ratio
+	CompressionFlate
+	// CompressionLZ compresses with the pure-Go LZ codec of pkg/lz, faster than DEFLATE for a lower ratio
+	CompressionLZ
+)
+
+// CompactionStyle selects which SSTables a compaction merges and where its output goes
+type CompactionStyle int
+
+const (
+	// CompactionFull merges every SSTable into a single one once CompactionThreshold sorted runs exist, the SSTables
+	// split at MaxOutputFileSize by the previous full compaction are a single run
+	CompactionFull CompactionStyle = iota
+	// CompactionLeveled keeps flushed SSTables in L0 and moves their data down levels L1..Ln of non-overlapping
+	// SSTables, each level LevelSizeMultiplier times larger than the previous one; L0 is compacted once it has
+	// CompactionThreshold SSTables
+	CompactionLeveled
+	// CompactionSizeTiered merges sorted runs of similar size once there are CompactionThreshold runs,
+	// trading read amplification and space for a lower write amplification
+	CompactionSizeTiered
+	// CompactionTimeWindow groups SSTables by the TimeWindow of their newest write and only merges SSTables of the
+	// same window: the current window once it has CompactionThreshold sorted runs, older windows into one sorted run.
+	// Windows older than Retention are dropped whole
+	CompactionTimeWindow
+)
+
+// CompactionDecision is what a CompactionFilter does with a record
+type CompactionDecision int
+
+const (
+	// CompactionKeep writes the record unchanged
+	CompactionKeep CompactionDecision = iota
+	// CompactionRemove deletes the record: it is left out, or replaced by a tombstone when an SSTable outside the
+	// compaction may hold an older version of the key
+	CompactionRemove
+	// CompactionChangeValue writes the record with the value returned by the filter, an empty value removes it
+	CompactionChangeValue
+)
+
+// CompactionFilterContext describes the compaction calling a CompactionFilter
+type CompactionFilterContext struct {
+	Level  int  // level of the SSTables the compaction writes
+	Full   bool // every SSTable of the store is an input, no older version of the key is left elsewhere
+	Manual bool // run by Compact or CompactRange rather than after a flush
+}
+
+/*
+CompactionFilter is called by compactions for every record they write, the newest version of a live key,
+and decides to keep, remove or rewrite it, e.g. to purge keys or to migrate values lazily.
+Tombstones and SSTables moved to another level without being rewritten are not filtered.
+It is called from the compaction workers, concurrently when there are several. A nil filter keeps every record.
+*/
+type CompactionFilter func(ctx CompactionFilterContext, key kv.Key, value kv.Value) (CompactionDecision, kv.Value)
+
 type Config struct {
-	Host                  string
-	Port                  string
-	MemTableSizeThreshold int
-	SSTableBlockSize      uint64
-	RootDataDir           string
-	SparseWALBufferSize   uint64
-	BloomFilterSize       uint64
-	BloomFilterHashCount  int
-	CompactionThreshold int
+	Host                   string
+	Port                   string
+	MemTableSizeThreshold  int
+	SSTableBlockSize       uint64
+	SSTableRestartInterval int // records between the restart points of a data block, 0 for 16
+	BlockCompression       Compression
+	IndexPartitionSize     uint64 // bytes of the index partitions of an SSTable, 0 for 4KB
+	IndexCachePartitions   int    // index partitions kept in memory per SSTable, 0 for 8
+	VerifyChecksums        bool   // verify the checksum of the data blocks read by scans and compactions, point reads always do
+	RootDataDir            string
+	BloomFilterSize        uint64              // bits of the bloom filter of every SSTable, used when FilterFPRate is 0
+	BloomFilterHashCount   int                 // hash functions of the bloom filter of every SSTable, used when FilterFPRate is 0
+	BloomFilterBlocked     bool                // use cache-line-blocked bloom filters, faster lookups for a slightly higher false-positive rate
+	FilterPolicy           filter.FilterPolicy // filter of new SSTables, nil for a bloom filter configured by the BloomFilter fields
+	FilterFPRate           float64             // target false-positive rate, the filter of each SSTable is sized from its key count
+	FilterMemoryBudget     uint64              // bytes of Bloom filters of all SSTables split between levels to minimize false positives, 0 for FilterFPRate everywhere
+	CompactionThreshold    int                 // SSTables that trigger a compaction after a flush, see CompactionStyle, 0 for manual compactions only
+	CompactionStyle        CompactionStyle
+	CompactionFilter       CompactionFilter
+	MaxLevels              int           // levels of leveled compaction, L0 included, 0 for 7
+	LevelBaseSize          uint64        // bytes of keys and values of L1 above which it is compacted into L2, 0 for 10MB
+	LevelSizeMultiplier    int           // size ratio of two consecutive levels from L1 on, 0 for 10
+	TargetFileSize         uint64        // bytes of keys and values of the SSTables written by leveled compactions, 0 for 2MB
+	MaxOutputFileSize      uint64        // bytes of keys and values above which other compactions split their output below level 0, 0 for a single SSTable
+	CompactionWorkers      int           // background goroutines running compactions of disjoint SSTables in parallel, 0 for 1
+	TombstoneRatio         float64       // share of tombstones in the records of an SSTable from which it is compacted, 0 disables
+	SeekCompactionReads    uint64        // point reads of an SSTable finding nothing after which it is compacted, at least one per 16KiB of it, 0 disables
+	SizeRatio              int           // percent a sorted run may be larger than the runs before it to join a size-tiered merge, 0 for 1
+	MinMergeWidth          int           // sorted runs merged at least by a size-tiered compaction picked by size ratio, 0 for 2
+	MaxSpaceAmplification  int           // percent of the size of the oldest run the newer runs may take before all runs are merged, 0 for 200
+	TimeWindow             time.Duration // length of the windows of time-window compaction, 0 for 1 hour
+	Retention              time.Duration // age after which a window of time-window compaction is deleted, 0 keeps every window
+	WALArchive             bool          // move released WAL segments to <WALDir>/archive instead of deleting them
+	WALSyncMode            WALSyncMode
+	WALSyncInterval        time.Duration // fsync period when WALSyncMode is WALSyncInterval
+	WALRecoveryMode        WALRecoveryMode
 }
@@ -1,8 +1,9 @@
 package constant
 
 const (
-	GET  = "GET"
-	SET  = "SET"
-	DEL  = "DEL"
-	QUIT = "QUIT"
+	GET     = "GET"
+	SET     = "SET"
+	DEL     = "DEL"
+	COMPACT = "COMPACT"
+	QUIT    = "QUIT"
 )
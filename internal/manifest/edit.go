@@ -0,0 +1,118 @@
+package manifest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// enc is the binary encoding used for writing and reading version edits
+var (
+	enc = binary.BigEndian
+)
+
+// Tags identifying the fields of an encoded version edit
+const (
+	tagAddTable     byte = 1
+	tagRemoveTable  byte = 2
+	tagLastSequence byte = 3
+	tagNextFile     byte = 4
+)
+
+// ErrCorruptedEdit is returned when a version edit cannot be decoded
+var ErrCorruptedEdit = errors.New("corrupted manifest edit")
+
+// TableMeta describes a live SSTable
+type TableMeta struct {
+	ID    uint64 // id of the SSTable on disk
+	Level int    // level of the SSTable, flushed tables are level 0
+	Seq   uint64 // sequence number of the newest record in the table, a higher Seq is newer data
+}
+
+// VersionEdit is one atomic change to the set of live SSTables
+type VersionEdit struct {
+	AddedTables   []TableMeta
+	RemovedTables []uint64
+	LastSequence  uint64 // highest sequence number durable in SSTables, 0 leaves it unchanged
+	NextFile      uint64 // next table id to allocate, set by Manifest.Apply, 0 leaves it unchanged
+}
+
+/*
+encode serializes the edit as a list of tagged fields:
+  - tagAddTable: <id><level><seq>
+  - tagRemoveTable: <id>
+  - tagLastSequence: <seq>
+  - tagNextFile: <id>
+*/
+func (e *VersionEdit) encode() []byte {
+	data := make([]byte, 0, 21*len(e.AddedTables)+9*len(e.RemovedTables)+18)
+
+	for _, table := range e.AddedTables {
+		data = append(data, tagAddTable)
+		data = enc.AppendUint64(data, table.ID)
+		data = enc.AppendUint32(data, uint32(table.Level))
+		data = enc.AppendUint64(data, table.Seq)
+	}
+
+	for _, id := range e.RemovedTables {
+		data = append(data, tagRemoveTable)
+		data = enc.AppendUint64(data, id)
+	}
+
+	if e.LastSequence > 0 {
+		data = append(data, tagLastSequence)
+		data = enc.AppendUint64(data, e.LastSequence)
+	}
+
+	if e.NextFile > 0 {
+		data = append(data, tagNextFile)
+		data = enc.AppendUint64(data, e.NextFile)
+	}
+
+	return data
+}
+
+// decodeEdit parses an edit written by encode
+func decodeEdit(data []byte) (*VersionEdit, error) {
+	edit := &VersionEdit{}
+
+	for len(data) > 0 {
+		tag := data[0]
+		data = data[1:]
+
+		switch tag {
+		case tagAddTable:
+			if len(data) < 20 {
+				return nil, fmt.Errorf("%w: short table", ErrCorruptedEdit)
+			}
+			edit.AddedTables = append(edit.AddedTables, TableMeta{
+				ID:    enc.Uint64(data[0:]),
+				Level: int(enc.Uint32(data[8:])),
+				Seq:   enc.Uint64(data[12:]),
+			})
+			data = data[20:]
+		case tagRemoveTable:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("%w: short table id", ErrCorruptedEdit)
+			}
+			edit.RemovedTables = append(edit.RemovedTables, enc.Uint64(data))
+			data = data[8:]
+		case tagLastSequence:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("%w: short sequence", ErrCorruptedEdit)
+			}
+			edit.LastSequence = enc.Uint64(data)
+			data = data[8:]
+		case tagNextFile:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("%w: short file number", ErrCorruptedEdit)
+			}
+			edit.NextFile = enc.Uint64(data)
+			data = data[8:]
+		default:
+			return nil, fmt.Errorf("%w: unknown tag %d", ErrCorruptedEdit, tag)
+		}
+	}
+
+	return edit, nil
+}
@@ -0,0 +1,412 @@
+package manifest
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	currentFile    = "CURRENT"
+	manifestPrefix = "MANIFEST-"
+
+	// headerSize is the size of the record header: <checksum><payloadLen>
+	headerSize = 8
+
+	// maxManifestSize is the size after which the manifest is rewritten as a single snapshot edit
+	maxManifestSize = 4 << 20
+)
+
+/*
+Manifest is the log of version edits that defines which SSTables are live
+File name pattern: <dir>/MANIFEST-<number>, <dir>/CURRENT holds the name of the active manifest
+
+Each edit is appended as one record with format: <checksum><payloadLen><payload> and fsynced,
+so an edit is either fully applied or, when the process dies while writing it, ignored on the next open.
+An edit that fails to be written or fsynced is cut from the file; when that fails too, the next edit starts a new
+manifest first, so no edit is ever appended after a torn one.
+A new manifest is started from a snapshot of the live tables on every open and when the active one
+grows too large; CURRENT is switched to it with an atomic rename.
+
+Table ids are allocated by NewFileNumber from a counter that every edit records, so that two tables written at
+the same time, or before and after a restart, never share an id.
+*/
+type Manifest struct {
+	lock     sync.Mutex
+	dir      string
+	number   uint64
+	file     manifestFile
+	size     int64 // size of the records of the active manifest that were written and fsynced
+	torn     bool  // the active manifest may end with a torn edit, it is rolled over before the next edit
+	tables   map[uint64]TableMeta
+	lastSeq  uint64
+	nextFile uint64 // next table id to allocate, above the id of every table recorded or found on disk
+	created  bool   // no manifest existed before Open
+}
+
+// manifestFile is the part of *os.File the manifest is written through
+type manifestFile interface {
+	Write(data []byte) (int, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// Open replays the manifest in dir, or creates an empty one, and starts a new manifest file from a snapshot
+func Open(dir string) (*Manifest, error) {
+	m := &Manifest{
+		dir:      dir,
+		tables:   make(map[uint64]TableMeta),
+		nextFile: 1,
+	}
+
+	name, err := os.ReadFile(filepath.Join(dir, currentFile))
+	switch {
+	case os.IsNotExist(err):
+		m.created = true
+	case err != nil:
+		return nil, err
+	default:
+		m.number, err = parseManifestName(strings.TrimSpace(string(name)))
+		if err != nil {
+			return nil, err
+		}
+		if err := m.replay(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.rollover(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Created reports whether Open found no manifest and started an empty one
+func (m *Manifest) Created() bool {
+	return m.created
+}
+
+/*
+Apply durably appends the edit to the manifest and applies it to the live table set.
+The edit records the next table id to allocate, so the ids handed out before it are not reused after a restart.
+*/
+func (m *Manifest) Apply(edit *VersionEdit) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.torn {
+		if err := m.rollover(); err != nil {
+			return err
+		}
+	}
+
+	edit.NextFile = m.nextFile
+	if err := m.writeRecord(edit.encode()); err != nil {
+		return err
+	}
+	m.apply(edit)
+
+	// The edit is durable, a manifest that cannot be rolled over keeps growing until the next attempt
+	if m.size > maxManifestSize {
+		if err := m.rollover(); err != nil {
+			log.Printf("manifest: roll over %s: %v", manifestName(m.number), err)
+		}
+	}
+
+	return nil
+}
+
+// Tables returns the live tables sorted by level, then newest first
+func (m *Manifest) Tables() []TableMeta {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tables := make([]TableMeta, 0, len(m.tables))
+	for _, table := range m.tables {
+		tables = append(tables, table)
+	}
+
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Level != tables[j].Level {
+			return tables[i].Level < tables[j].Level
+		}
+		if tables[i].Seq != tables[j].Seq {
+			return tables[i].Seq > tables[j].Seq
+		}
+		return tables[i].ID > tables[j].ID
+	})
+
+	return tables
+}
+
+// Contains reports whether the table with the given id is live
+func (m *Manifest) Contains(id uint64) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.tables[id]
+	return ok
+}
+
+// LastSequence returns the highest sequence number recorded as durable in SSTables
+func (m *Manifest) LastSequence() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.lastSeq
+}
+
+// NewFileNumber allocates a new table id, it is recorded by the next edit that is applied
+func (m *Manifest) NewFileNumber() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	number := m.nextFile
+	m.nextFile++
+
+	return number
+}
+
+// MarkFileNumberUsed makes sure that NewFileNumber never allocates the id of a table found on disk
+func (m *Manifest) MarkFileNumberUsed(number uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nextFile = max(m.nextFile, number+1)
+}
+
+// Close closes the active manifest file
+func (m *Manifest) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.file == nil {
+		return nil
+	}
+
+	err := m.file.Close()
+	m.file = nil
+
+	return err
+}
+
+func (m *Manifest) apply(edit *VersionEdit) {
+	for _, id := range edit.RemovedTables {
+		delete(m.tables, id)
+	}
+	for _, table := range edit.AddedTables {
+		m.tables[table.ID] = table
+		m.nextFile = max(m.nextFile, table.ID+1)
+	}
+	m.lastSeq = max(m.lastSeq, edit.LastSequence)
+	m.nextFile = max(m.nextFile, edit.NextFile)
+}
+
+/*
+replay applies every edit of the active manifest.
+A truncated or corrupted record at the end is an edit that was being written when the process died
+and is ignored; a corrupted record followed by valid ones means the manifest cannot be trusted.
+*/
+func (m *Manifest) replay() error {
+	data, err := os.ReadFile(m.path(m.number))
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(data); {
+		payload, n, ok := readRecord(data[offset:])
+		if !ok {
+			if offset+n < len(data) {
+				return fmt.Errorf("%w: at offset %d of %s", ErrCorruptedEdit, offset, manifestName(m.number))
+			}
+			break
+		}
+		offset += n
+
+		edit, err := decodeEdit(payload)
+		if err != nil {
+			return err
+		}
+		m.apply(edit)
+	}
+
+	return nil
+}
+
+/*
+rollover writes the live table set into a new manifest file, points CURRENT to it and removes the old one.
+The active manifest is kept when the new one cannot be written.
+*/
+func (m *Manifest) rollover() error {
+	oldNumber := m.number
+	newNumber := oldNumber + 1
+
+	// Writes are appended, so that they follow a torn edit that was cut from the file
+	file, err := os.OpenFile(m.path(newNumber), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	snapshot := &VersionEdit{LastSequence: m.lastSeq, NextFile: m.nextFile}
+	for _, table := range m.tables {
+		snapshot.AddedTables = append(snapshot.AddedTables, table)
+	}
+
+	data := encodeRecord(snapshot.encode())
+	if _, err := file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = m.setCurrent(newNumber)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if m.file != nil {
+		m.file.Close()
+	}
+	m.file = file
+	m.number = newNumber
+	m.size = int64(len(data))
+	m.torn = false
+
+	if oldNumber > 0 {
+		if err := os.Remove(m.path(oldNumber)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setCurrent atomically points CURRENT to the manifest with the given number
+func (m *Manifest) setCurrent(number uint64) error {
+	tmpPath := filepath.Join(m.dir, currentFile+".tmp")
+	if err := writeFileSync(tmpPath, []byte(manifestName(number)+"\n")); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(m.dir, currentFile)); err != nil {
+		return err
+	}
+
+	return syncDir(m.dir)
+}
+
+/*
+writeRecord appends <checksum><payloadLen><payload> to the active manifest and fsyncs it.
+On failure the record is cut from the file, or the manifest is marked torn when that fails too.
+*/
+func (m *Manifest) writeRecord(payload []byte) error {
+	data := encodeRecord(payload)
+
+	_, err := m.file.Write(data)
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		if truncateErr := m.truncate(); truncateErr != nil {
+			m.torn = true
+			return fmt.Errorf("%w, cannot remove the torn edit: %v", err, truncateErr)
+		}
+		return err
+	}
+	m.size += int64(len(data))
+
+	return nil
+}
+
+// truncate cuts the active manifest back to its last fsynced record
+func (m *Manifest) truncate() error {
+	if err := m.file.Truncate(m.size); err != nil {
+		return err
+	}
+
+	return m.file.Sync()
+}
+
+func encodeRecord(payload []byte) []byte {
+	data := make([]byte, headerSize+len(payload))
+	enc.PutUint32(data[0:], crc32.ChecksumIEEE(payload))
+	enc.PutUint32(data[4:], uint32(len(payload)))
+	copy(data[headerSize:], payload)
+
+	return data
+}
+
+// readRecord returns the payload of the record at the start of data and the number of bytes it occupies
+func readRecord(data []byte) ([]byte, int, bool) {
+	if len(data) < headerSize {
+		return nil, len(data), false
+	}
+
+	checksum := enc.Uint32(data[0:])
+	payloadLen := int(enc.Uint32(data[4:]))
+	if payloadLen > len(data)-headerSize {
+		return nil, len(data), false
+	}
+
+	payload := data[headerSize : headerSize+payloadLen]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, headerSize + payloadLen, false
+	}
+
+	return payload, headerSize + payloadLen, true
+}
+
+func (m *Manifest) path(number uint64) string {
+	return filepath.Join(m.dir, manifestName(number))
+}
+
+func manifestName(number uint64) string {
+	return fmt.Sprintf("%s%06d", manifestPrefix, number)
+}
+
+func parseManifestName(name string) (uint64, error) {
+	if !strings.HasPrefix(name, manifestPrefix) {
+		return 0, fmt.Errorf("invalid manifest name %q in %s", name, currentFile)
+	}
+
+	return strconv.ParseUint(strings.TrimPrefix(name, manifestPrefix), 10, 64)
+}
+
+// writeFileSync writes data to path and fsyncs it before returning
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// syncDir fsyncs a directory so that file creations, renames and removals in it are durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
@@ -0,0 +1,247 @@
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"new manifest is empty":               testNewManifest,
+		"edits survive reopen":                testEditsSurviveReopen,
+		"tables are ordered by level and seq": testTablesOrder,
+		"torn edit is ignored":                testTornEditIgnored,
+		"corruption before valid edits fails": testCorruptionInTheMiddle,
+		"reopen rolls over to a new manifest": testRolloverOnOpen,
+		"file numbers are never reused":       testFileNumbers,
+		"failed write is cut from the file":   testFailedWriteTruncated,
+		"failed cut rolls over the manifest":  testFailedTruncateRollsOver,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "manifest-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+func testNewManifest(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	defer m.Close()
+
+	require.True(t, m.Created())
+	require.Empty(t, m.Tables())
+	require.Zero(t, m.LastSequence())
+}
+
+func testEditsSurviveReopen(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	require.NoError(t, m.Apply(&VersionEdit{
+		AddedTables:  []TableMeta{{ID: 1, Seq: 10}, {ID: 2, Seq: 20}},
+		LastSequence: 20,
+	}))
+	require.NoError(t, m.Apply(&VersionEdit{
+		AddedTables:   []TableMeta{{ID: 3, Level: 1, Seq: 20}},
+		RemovedTables: []uint64{1, 2},
+	}))
+	require.NoError(t, m.Close())
+
+	m = openManifest(t, dir)
+	defer m.Close()
+
+	require.False(t, m.Created())
+	require.Equal(t, []TableMeta{{ID: 3, Level: 1, Seq: 20}}, m.Tables())
+	require.Equal(t, uint64(20), m.LastSequence())
+	require.True(t, m.Contains(3))
+	require.False(t, m.Contains(1))
+}
+
+func testTablesOrder(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	defer m.Close()
+
+	require.NoError(t, m.Apply(&VersionEdit{
+		AddedTables: []TableMeta{{ID: 1, Level: 1, Seq: 5}, {ID: 2, Seq: 7}, {ID: 3, Seq: 9}},
+	}))
+
+	// Level 0 first, newest first within a level
+	require.Equal(t, []TableMeta{{ID: 3, Seq: 9}, {ID: 2, Seq: 7}, {ID: 1, Level: 1, Seq: 5}}, m.Tables())
+}
+
+func testTornEditIgnored(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 1, Seq: 1}}}))
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 2, Seq: 2}}}))
+	path := m.path(m.number)
+	require.NoError(t, m.Close())
+
+	// The process died while the second edit was being written
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-4))
+
+	m = openManifest(t, dir)
+	defer m.Close()
+	require.Equal(t, []TableMeta{{ID: 1, Seq: 1}}, m.Tables())
+}
+
+func testCorruptionInTheMiddle(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 1, Seq: 1}}}))
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 2, Seq: 2}}}))
+	path := m.path(m.number)
+	require.NoError(t, m.Close())
+
+	// Flip a byte of the snapshot edit at the start of the manifest
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[0] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	_, err = Open(dir)
+	require.ErrorIs(t, err, ErrCorruptedEdit)
+}
+
+func testRolloverOnOpen(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 1, Seq: 1}}}))
+	oldPath := m.path(m.number)
+	require.NoError(t, m.Close())
+
+	m = openManifest(t, dir)
+	defer m.Close()
+
+	_, err := os.Stat(oldPath)
+	require.True(t, os.IsNotExist(err))
+
+	current, err := os.ReadFile(filepath.Join(dir, currentFile))
+	require.NoError(t, err)
+	require.Equal(t, manifestName(m.number)+"\n", string(current))
+	require.Equal(t, []TableMeta{{ID: 1, Seq: 1}}, m.Tables())
+}
+
+func testFileNumbers(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	require.Equal(t, uint64(1), m.NewFileNumber())
+	require.Equal(t, uint64(2), m.NewFileNumber())
+
+	// Table 1 is still being written when table 2 is recorded, the edit records both ids as used
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 2, Seq: 1}}}))
+	require.NoError(t, m.Close())
+
+	m = openManifest(t, dir)
+	require.Equal(t, uint64(3), m.NewFileNumber())
+
+	// An id found on disk is skipped
+	m.MarkFileNumberUsed(10)
+	require.Equal(t, uint64(11), m.NewFileNumber())
+	require.NoError(t, m.Close())
+
+	// A manifest written before the counter existed continues above its highest table id
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	m = openManifest(t, dir)
+	require.NoError(t, m.writeRecord((&VersionEdit{AddedTables: []TableMeta{{ID: 42, Seq: 1}}}).encode()))
+	require.NoError(t, m.Close())
+
+	m = openManifest(t, dir)
+	defer m.Close()
+	require.Equal(t, uint64(43), m.NewFileNumber())
+}
+
+func testFailedWriteTruncated(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 1, Seq: 1}}}))
+
+	// Half of the edit reaches the file, then the disk is full
+	file := m.file
+	m.file = &failingFile{manifestFile: file, failWrites: 1}
+	require.ErrorIs(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 2, Seq: 2}}}), errDiskFull)
+	require.False(t, m.Contains(2))
+	// The write went through but the fsync failed
+	m.file = &failingFile{manifestFile: file, failSyncs: 1}
+	require.ErrorIs(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 3, Seq: 3}}}), errDiskFull)
+	require.False(t, m.Contains(3))
+	require.False(t, m.torn)
+
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 4, Seq: 4}}}))
+	require.NoError(t, m.Close())
+
+	m = openManifest(t, dir)
+	defer m.Close()
+	require.Equal(t, []TableMeta{{ID: 4, Seq: 4}, {ID: 1, Seq: 1}}, m.Tables())
+}
+
+func testFailedTruncateRollsOver(t *testing.T, dir string) {
+	m := openManifest(t, dir)
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 1, Seq: 1}}}))
+	tornPath := m.path(m.number)
+
+	m.file = &failingFile{manifestFile: m.file, failWrites: 1, failTruncates: 1}
+	require.ErrorIs(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 2, Seq: 2}}}), errDiskFull)
+	require.True(t, m.torn)
+
+	// The next edit goes to a new manifest, the torn one is removed
+	require.NoError(t, m.Apply(&VersionEdit{AddedTables: []TableMeta{{ID: 3, Seq: 3}}}))
+	require.NotEqual(t, tornPath, m.path(m.number))
+	_, err := os.Stat(tornPath)
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, m.Close())
+
+	m = openManifest(t, dir)
+	defer m.Close()
+	require.Equal(t, []TableMeta{{ID: 3, Seq: 3}, {ID: 1, Seq: 1}}, m.Tables())
+}
+
+var errDiskFull = errors.New("disk full")
+
+// failingFile fails the given number of writes, after writing half of the data, of fsyncs and of truncates
+type failingFile struct {
+	manifestFile
+	failWrites    int
+	failSyncs     int
+	failTruncates int
+}
+
+func (f *failingFile) Write(data []byte) (int, error) {
+	if f.failWrites > 0 {
+		f.failWrites--
+		n, _ := f.manifestFile.Write(data[:len(data)/2])
+		return n, errDiskFull
+	}
+
+	return f.manifestFile.Write(data)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSyncs > 0 {
+		f.failSyncs--
+		return errDiskFull
+	}
+
+	return f.manifestFile.Sync()
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.failTruncates > 0 {
+		f.failTruncates--
+		return errDiskFull
+	}
+
+	return f.manifestFile.Truncate(size)
+}
+
+func openManifest(t *testing.T, dir string) *Manifest {
+	t.Helper()
+
+	m, err := Open(dir)
+	require.NoError(t, err)
+
+	return m
+}
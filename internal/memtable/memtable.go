@@ -63,20 +63,30 @@ func (m *MemTable) GetAll() []kv.Record {
 	return records
 }
 
-func LoadFromWAL(wal *wal.WAL) (*MemTable, error) {
-	memTable := NewMemTable()
+// Overlaps reports whether the memtable holds a key in [start, end), an empty end has no upper bound
+func (m *MemTable) Overlaps(start, end kv.Key) bool {
+	for _, record := range m.sortedData.GetAll() {
+		if record.Key >= start {
+			return end == "" || record.Key < end
+		}
+	}
 
-	lastTimestamp, _ := wal.ReadLastItemFromMetaLog()
+	return false
+}
+
+// LoadFromWAL rebuilds the memtable from the WAL segments that have not been flushed yet.
+// The returned recovery reports the highest sequence number and how many records were recovered and dropped.
+func LoadFromWAL(wal *wal.WAL) (*MemTable, *wal.Recovery, error) {
+	memTable := NewMemTable()
 
-	// Read commit log
-	records, err := wal.ReadCommitLogAfterTimestamp(lastTimestamp)
+	recovery, err := wal.Replay()
 	if err != nil {
-		return memTable, fmt.Errorf("error reading commit log after timestamp %d: %w", lastTimestamp, err)
+		return memTable, nil, fmt.Errorf("error replaying WAL: %w", err)
 	}
 
-	if len(records) > 0 {
-		memTable.sortedData = algorithm.BuildSkipList(records)
+	if len(recovery.Records) > 0 {
+		memTable.sortedData = algorithm.BuildSkipList(recovery.Records)
 	}
 
-	return memTable, nil
+	return memTable, recovery, nil
 }
@@ -64,6 +64,8 @@ func (s *Server) handleConnection(conn net.Conn) {
 			s.handleSet(conn, parts)
 		case constant.DEL:
 			s.handleDelete(conn, parts)
+		case constant.COMPACT:
+			s.handleCompact(conn, parts)
 		default:
 			fmt.Fprintf(conn, "Unknown command: %s", cmd)
 		}
@@ -78,7 +80,17 @@ func (s *Server) handleGet(conn net.Conn, parts []string) {
 		fmt.Fprintf(conn, "ERROR: %s command requires exactly 1 argument", constant.GET)
 		return
 	}
-	val, exists := s.store.Get(kv.Key(parts[1]))
+	var val kv.Value
+	var exists bool
+	if reader, ok := s.store.(store.Reader); ok {
+		var err error
+		if val, exists, err = reader.Lookup(kv.Key(parts[1])); err != nil {
+			fmt.Fprintf(conn, "ERROR: %v", err)
+			return
+		}
+	} else {
+		val, exists = s.store.Get(kv.Key(parts[1]))
+	}
 	if !exists {
 		fmt.Fprintf(conn, "(nil)")
 		return
@@ -108,3 +120,32 @@ func (s *Server) handleDelete(conn net.Conn, parts []string) {
 	s.store.Delete(kv.Key(parts[1]))
 	fmt.Fprintf(conn, "OK")
 }
+
+// handleCompact handles the COMPACT command: COMPACT compacts every key, COMPACT <start> <end> the keys in [start, end)
+func (s *Server) handleCompact(conn net.Conn, parts []string) {
+	if len(parts) != 1 && len(parts) != 3 {
+		fmt.Fprintf(conn, "ERROR: %s command requires 0 or 2 arguments", constant.COMPACT)
+		return
+	}
+
+	compacter, ok := s.store.(store.Compacter)
+	if !ok {
+		fmt.Fprintf(conn, "ERROR: %s is not supported by the store", constant.COMPACT)
+		return
+	}
+
+	var start, end kv.Key
+	if len(parts) == 3 {
+		start, end = kv.Key(parts[1]), kv.Key(parts[2])
+		if start >= end {
+			fmt.Fprintf(conn, "ERROR: %s range start %q is not before its end %q", constant.COMPACT, start, end)
+			return
+		}
+	}
+	if err := compacter.CompactRange(start, end); err != nil {
+		fmt.Fprintf(conn, "ERROR: %v", err)
+		return
+	}
+
+	fmt.Fprintf(conn, "OK")
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/store"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// compactingStore is a memory store that records the ranges it is asked to compact
+type compactingStore struct {
+	*memory.MemoryStore
+	ranges [][2]kv.Key
+	err    error
+}
+
+func (s *compactingStore) CompactRange(start, end kv.Key) error {
+	s.ranges = append(s.ranges, [2]kv.Key{start, end})
+	return s.err
+}
+
+func TestHandleCompact(t *testing.T) {
+	failure := errors.New("lsmtree: compact range: disk full")
+
+	for scenario, tc := range map[string]struct {
+		store      store.Store
+		command    string
+		wantReply  string
+		wantRanges [][2]kv.Key
+	}{
+		"no argument compacts every key": {
+			store:      &compactingStore{MemoryStore: memory.NewStore()},
+			command:    "COMPACT",
+			wantReply:  "OK",
+			wantRanges: [][2]kv.Key{{"", ""}},
+		},
+		"two arguments compact the range": {
+			store:      &compactingStore{MemoryStore: memory.NewStore()},
+			command:    "compact a m",
+			wantReply:  "OK",
+			wantRanges: [][2]kv.Key{{"a", "m"}},
+		},
+		"one argument is rejected": {
+			store:     &compactingStore{MemoryStore: memory.NewStore()},
+			command:   "COMPACT a",
+			wantReply: "ERROR: COMPACT command requires 0 or 2 arguments",
+		},
+		"three arguments are rejected": {
+			store:     &compactingStore{MemoryStore: memory.NewStore()},
+			command:   "COMPACT a m z",
+			wantReply: "ERROR: COMPACT command requires 0 or 2 arguments",
+		},
+		"inverted range is rejected": {
+			store:     &compactingStore{MemoryStore: memory.NewStore()},
+			command:   "COMPACT m a",
+			wantReply: `ERROR: COMPACT range start "m" is not before its end "a"`,
+		},
+		"empty range is rejected": {
+			store:     &compactingStore{MemoryStore: memory.NewStore()},
+			command:   "COMPACT m m",
+			wantReply: `ERROR: COMPACT range start "m" is not before its end "m"`,
+		},
+		"compaction error is reported": {
+			store:      &compactingStore{MemoryStore: memory.NewStore(), err: failure},
+			command:    "COMPACT a m",
+			wantReply:  fmt.Sprintf("ERROR: %v", failure),
+			wantRanges: [][2]kv.Key{{"a", "m"}},
+		},
+		"store without compaction": {
+			store:     memory.NewStore(),
+			command:   "COMPACT",
+			wantReply: "ERROR: COMPACT is not supported by the store",
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			require.Equal(t, tc.wantReply, sendCommand(t, NewServer(tc.store, ""), tc.command))
+
+			if compacter, ok := tc.store.(*compactingStore); ok {
+				require.Equal(t, tc.wantRanges, compacter.ranges)
+			}
+		})
+	}
+}
+
+// sendCommand sends the command to a connection handled by the server and returns the reply line
+func sendCommand(t *testing.T, server *Server, command string) string {
+	t.Helper()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handleConnection(conn)
+
+	_, err := fmt.Fprintln(client, command)
+	require.NoError(t, err)
+
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	require.NoError(t, err)
+
+	return reply[:len(reply)-1]
+}
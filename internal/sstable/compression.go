@@ -0,0 +1,79 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/lz"
+)
+
+// Codecs of a data block, recorded in the last byte of the block
+const (
+	codecNone  byte = 0
+	codecFlate byte = 1
+	codecLZ    byte = 2
+)
+
+/*
+compressBlock compresses a data block with the configured codec and appends the codec byte.
+The block is kept uncompressed when compression saves less than an eighth of its size,
+so reads of blocks that do not compress well do not pay for decompression.
+*/
+func compressBlock(raw []byte, compression config.Compression) ([]byte, error) {
+	var compressed []byte
+	codec := codecNone
+
+	switch compression {
+	case config.CompressionFlate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		compressed, codec = buf.Bytes(), codecFlate
+	case config.CompressionLZ:
+		compressed, codec = lz.Encode(nil, raw), codecLZ
+	}
+
+	if codec == codecNone || len(compressed) > len(raw)-len(raw)/8 {
+		return append(raw, codecNone), nil
+	}
+
+	return append(compressed, codec), nil
+}
+
+// decompressBlock returns the raw data block of a block written by compressBlock
+func decompressBlock(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: block without codec", errInvalidTable)
+	}
+	codec, payload := data[len(data)-1], data[:len(data)-1]
+
+	switch codec {
+	case codecNone:
+		return payload, nil
+	case codecFlate:
+		raw, err := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: deflate: %v", errInvalidTable, err)
+		}
+		return raw, nil
+	case codecLZ:
+		raw, err := lz.Decode(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidTable, err)
+		}
+		return raw, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown block codec %d", errInvalidTable, codec)
+	}
+}
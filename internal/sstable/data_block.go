@@ -0,0 +1,225 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+)
+
+// defaultRestartInterval is the number of records between two restart points when the config does not set one
+const defaultRestartInterval = 16
+
+/*
+blockBuilder encodes sorted records into a data block of a table file.
+Each record has the format: <shared><unshared><valueLen><key suffix><value>
+  - shared: uvarint, bytes of the key shared with the key of the previous record, 0 at a restart point
+  - unshared, valueLen: uvarint lengths of the key suffix and of the value
+  - an empty value is a tombstone
+
+The block ends with a trailer: <restart>...<restart><numRestarts>
+  - restart: uint32, offset of every restartInterval-th record, the first one is 0
+  - numRestarts: uint32
+
+A lookup binary-searches the full keys at the restart points and decodes at most restartInterval records.
+*/
+type blockBuilder struct {
+	data            []byte
+	restarts        []uint32
+	restartInterval int
+	lastKey         kv.Key
+	entries         int
+}
+
+func (b *blockBuilder) add(record kv.Record) {
+	restart := b.entries == 0 || (b.restartInterval > 0 && b.entries%b.restartInterval == 0)
+	shared := 0
+	if restart {
+		b.restarts = append(b.restarts, uint32(len(b.data)))
+	} else {
+		shared = sharedPrefixLen(b.lastKey, record.Key)
+	}
+
+	b.data = binary.AppendUvarint(b.data, uint64(shared))
+	b.data = binary.AppendUvarint(b.data, uint64(len(record.Key)-shared))
+	b.data = binary.AppendUvarint(b.data, uint64(len(record.Value)))
+	b.data = append(b.data, record.Key[shared:]...)
+	b.data = append(b.data, record.Value...)
+
+	b.lastKey = record.Key
+	b.entries++
+}
+
+// size returns the size of the block once finished
+func (b *blockBuilder) size() int {
+	return len(b.data) + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.entries == 0
+}
+
+// finish returns the encoded block and resets the builder for the next block
+func (b *blockBuilder) finish() []byte {
+	data := b.data
+	for _, restart := range b.restarts {
+		data = enc.AppendUint32(data, restart)
+	}
+	data = enc.AppendUint32(data, uint32(len(b.restarts)))
+
+	b.data = nil
+	b.restarts = nil
+	b.lastKey = ""
+	b.entries = 0
+
+	return data
+}
+
+func sharedPrefixLen(a, b kv.Key) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return n
+}
+
+// blockReader reads the records of a data block
+type blockReader struct {
+	data     []byte   // the records, without the trailer
+	restarts []uint32 // offsets of the restart points
+}
+
+// newBlockReader parses the trailer of a data block
+func newBlockReader(data []byte) (*blockReader, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: short block trailer", errInvalidTable)
+	}
+	numRestarts := uint64(enc.Uint32(data[len(data)-4:]))
+	if numRestarts == 0 || 4*(numRestarts+1) > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: block with %d restart points", errInvalidTable, numRestarts)
+	}
+
+	end := len(data) - 4*int(numRestarts+1)
+	r := &blockReader{
+		data:     data[:end],
+		restarts: make([]uint32, numRestarts),
+	}
+	for i := range r.restarts {
+		r.restarts[i] = enc.Uint32(data[end+4*i:])
+		if int(r.restarts[i]) >= end || (i > 0 && r.restarts[i] <= r.restarts[i-1]) {
+			return nil, fmt.Errorf("%w: restart point %d out of order", errInvalidTable, r.restarts[i])
+		}
+	}
+
+	return r, nil
+}
+
+/*
+get binary-searches the restart points for the last one whose key is <= key, then decodes the records
+from there until it finds the key or a greater key.
+*/
+func (r *blockReader) get(key kv.Key) (kv.Value, bool, error) {
+	var searchErr error
+	i := sort.Search(len(r.restarts), func(i int) bool {
+		it := r.iter(r.restarts[i])
+		if !it.next() {
+			searchErr = it.err
+			return true
+		}
+		return string(it.key) > string(key)
+	})
+	if searchErr != nil {
+		return nil, false, searchErr
+	}
+	if i == 0 {
+		return nil, false, nil
+	}
+
+	it := r.iter(r.restarts[i-1])
+	for it.next() {
+		switch cmp := bytes.Compare(it.key, []byte(key)); {
+		case cmp == 0:
+			return bytes.Clone(it.value), true, nil
+		case cmp > 0:
+			return nil, false, nil
+		}
+	}
+
+	return nil, false, it.err
+}
+
+// all returns every record of the block
+func (r *blockReader) all() ([]kv.Record, error) {
+	var records []kv.Record
+	it := r.iter(0)
+	for it.next() {
+		records = append(records, kv.Record{Key: kv.Key(it.key), Value: bytes.Clone(it.value)})
+	}
+
+	return records, it.err
+}
+
+// iter returns an iterator over the records from offset, which must be a restart point
+func (r *blockReader) iter(offset uint32) *blockIter {
+	return &blockIter{data: r.data[offset:]}
+}
+
+/*
+blockIter decodes the records of a block one by one.
+key and value point into the block and into a buffer reused by next, they must be copied to be kept.
+*/
+type blockIter struct {
+	data  []byte
+	key   []byte
+	value []byte
+	err   error
+}
+
+// next decodes the next record, it returns false at the end of the block or on a corrupted record
+func (it *blockIter) next() bool {
+	if len(it.data) == 0 || it.err != nil {
+		return false
+	}
+
+	n, err := it.decode()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.data = it.data[n:]
+
+	return true
+}
+
+func (it *blockIter) decode() (int, error) {
+	var header [3]uint64
+	n := 0
+	for i := range header {
+		v, m := binary.Uvarint(it.data[n:])
+		if m <= 0 {
+			return 0, fmt.Errorf("%w: bad record length", errInvalidTable)
+		}
+		header[i] = v
+		n += m
+	}
+	shared, unshared, valueLen := header[0], header[1], header[2]
+
+	if shared > uint64(len(it.key)) {
+		return 0, fmt.Errorf("%w: record shares %d bytes of a %d-byte key", errInvalidTable, shared, len(it.key))
+	}
+	if unshared > uint64(len(it.data)-n) || valueLen > uint64(len(it.data)-n)-unshared {
+		return 0, fmt.Errorf("%w: short record", errInvalidTable)
+	}
+
+	it.key = append(it.key[:shared], it.data[n:n+int(unshared)]...)
+	n += int(unshared)
+	it.value = it.data[n : n+int(valueLen)]
+	n += int(valueLen)
+
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataBlock(t *testing.T) {
+	records := make([]kv.Record, 50)
+	for i := range records {
+		records[i] = kv.Record{Key: kv.Key(fmt.Sprintf("k%03d", 2*i)), Value: kv.Value(fmt.Sprintf("v%d", i))}
+	}
+	records[7].Value = kv.Value{} // a tombstone
+
+	for _, restartInterval := range []int{1, 4, 16, 100} {
+		t.Run(fmt.Sprintf("restart interval %d", restartInterval), func(t *testing.T) {
+			builder := blockBuilder{restartInterval: restartInterval}
+			for _, record := range records {
+				builder.add(record)
+			}
+			size := builder.size()
+			data := builder.finish()
+			require.Len(t, data, size)
+			require.True(t, builder.empty())
+
+			block, err := newBlockReader(data)
+			require.NoError(t, err)
+			require.Len(t, block.restarts, (len(records)+restartInterval-1)/restartInterval)
+
+			for _, record := range records {
+				value, found, err := block.get(record.Key)
+				require.NoError(t, err)
+				require.True(t, found)
+				require.Equal(t, record.Value, value)
+			}
+
+			// Keys before, between and after the records of the block
+			for _, key := range []kv.Key{"a", "k001", "k051", "k097", "z"} {
+				_, found, err := block.get(key)
+				require.NoError(t, err)
+				require.False(t, found)
+			}
+
+			all, err := block.all()
+			require.NoError(t, err)
+			require.Equal(t, records, all)
+		})
+	}
+
+	t.Run("corrupted trailer", func(t *testing.T) {
+		builder := blockBuilder{restartInterval: 4}
+		for _, record := range records {
+			builder.add(record)
+		}
+		data := builder.finish()
+
+		tooMany := append([]byte(nil), data...)
+		enc.PutUint32(tooMany[len(tooMany)-4:], uint32(len(data)))
+		_, err := newBlockReader(tooMany)
+		require.ErrorIs(t, err, errInvalidTable)
+
+		_, err = newBlockReader(data[:2])
+		require.ErrorIs(t, err, errInvalidTable)
+
+		// A record sharing more bytes than the previous key has
+		badShared := append([]byte(nil), data...)
+		badShared[0] = 5
+		block, err := newBlockReader(badShared)
+		require.NoError(t, err)
+		_, err = block.all()
+		require.ErrorIs(t, err, errInvalidTable)
+	})
+
+	t.Run("shared prefixes are stored once", func(t *testing.T) {
+		prefixed := blockBuilder{restartInterval: 16}
+		var keyBytes int
+		for i := 0; i < 100; i++ {
+			record := kv.Record{Key: kv.Key(fmt.Sprintf("tenant/acme/entity/%05d", i)), Value: kv.Value("v")}
+			prefixed.add(record)
+			keyBytes += len(record.Key)
+		}
+
+		require.Less(t, prefixed.size(), keyBytes/2)
+	})
+}
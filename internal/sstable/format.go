@@ -0,0 +1,289 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+const (
+	// tableMagic ends every table file, it reads "lsmsstab"
+	tableMagic uint64 = 0x6c736d7373746162
+
+	// formatVersion is the version of the table file layout, a table file with another version is refused.
+	// Tables of the legacy directory format have no version, see legacy.go
+	formatVersion uint32 = 1
+
+	// checksumSize is the size of the checksum following a block, it is not counted in the block handle
+	checksumSize = 4
+
+	// footerSize is the size of the footer: three block handles, the format version and the magic number
+	footerSize = 3*blockHandleSize + 4 + 8
+
+	blockHandleSize = 16
+)
+
+// Tags identifying the fields of the properties block
+const (
+	propDataBlocks   byte = 1
+	propDataSize     byte = 2
+	propKeySize      byte = 3
+	propValueSize    byte = 4
+	propFilterPolicy byte = 5
+	propEntries      byte = 6
+	propFilterFPRate byte = 7 // float64 bits, absent or 0 when the filter was not sized by a rate
+	propSmallestKey  byte = 8
+	propLargestKey   byte = 9
+	propTombstones   byte = 10
+	propRawDataSize  byte = 11
+	propWriteTime    byte = 12 // unix nanoseconds
+)
+
+var (
+	errInvalidTable       = errors.New("invalid sstable file")
+	errUnsupportedVersion = errors.New("unsupported sstable format version")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+/*
+CorruptionError reports a block of a table file whose content does not match its checksum,
+or a table file that cannot be opened: Err then tells why and the block is unknown.
+*/
+type CorruptionError struct {
+	Path   string
+	Offset uint64
+	Size   uint64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("sstable: cannot open %s: %v", e.Path, e.Err)
+	}
+
+	return fmt.Sprintf("sstable: checksum mismatch in block of %d bytes at offset %d of %s", e.Size, e.Offset, e.Path)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// blockHandle locates a block inside the table file
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func (h blockHandle) append(data []byte) []byte {
+	data = enc.AppendUint64(data, h.offset)
+	return enc.AppendUint64(data, h.size)
+}
+
+func decodeBlockHandle(data []byte) blockHandle {
+	return blockHandle{offset: enc.Uint64(data[0:]), size: enc.Uint64(data[8:])}
+}
+
+/*
+footer is the fixed-size end of a table file: <filter><index><properties><version><magic>
+  - filter, index, properties: block handles as <offset><size>
+  - version: uint32, the format version the table was written with
+  - magic: uint64, tableMagic
+*/
+type footer struct {
+	filter     blockHandle
+	index      blockHandle
+	properties blockHandle
+	version    uint32
+}
+
+func (f *footer) encode() []byte {
+	data := make([]byte, 0, footerSize)
+	data = f.filter.append(data)
+	data = f.index.append(data)
+	data = f.properties.append(data)
+	data = enc.AppendUint32(data, f.version)
+	return enc.AppendUint64(data, tableMagic)
+}
+
+func decodeFooter(data []byte) (*footer, error) {
+	if len(data) != footerSize || enc.Uint64(data[footerSize-8:]) != tableMagic {
+		return nil, fmt.Errorf("%w: bad magic number", errInvalidTable)
+	}
+
+	f := &footer{
+		filter:     decodeBlockHandle(data[0:]),
+		index:      decodeBlockHandle(data[blockHandleSize:]),
+		properties: decodeBlockHandle(data[2*blockHandleSize:]),
+		version:    enc.Uint32(data[3*blockHandleSize:]),
+	}
+	if f.version != formatVersion {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedVersion, f.version)
+	}
+
+	return f, nil
+}
+
+// indexEntry points to one data block, or to an index partition, every key of the block is <= lastKey
+type indexEntry struct {
+	lastKey string
+	handle  blockHandle
+}
+
+// encodeIndex serializes the index block as a list of <offset><size><keyLen><lastKey>, keyLen is a uint32
+func encodeIndex(entries []indexEntry) []byte {
+	var data []byte
+	for _, entry := range entries {
+		data = encodeIndexEntry(data, entry)
+	}
+
+	return data
+}
+
+func encodeIndexEntry(data []byte, entry indexEntry) []byte {
+	data = entry.handle.append(data)
+	data = enc.AppendUint32(data, uint32(len(entry.lastKey)))
+	return append(data, entry.lastKey...)
+}
+
+func decodeIndex(data []byte) ([]indexEntry, error) {
+	var entries []indexEntry
+
+	for len(data) > 0 {
+		if len(data) < blockHandleSize+4 {
+			return nil, fmt.Errorf("%w: short index entry", errInvalidTable)
+		}
+		handle := decodeBlockHandle(data)
+		keyLen := int(enc.Uint32(data[blockHandleSize:]))
+		data = data[blockHandleSize+4:]
+
+		if len(data) < keyLen {
+			return nil, fmt.Errorf("%w: short index key", errInvalidTable)
+		}
+		entries = append(entries, indexEntry{lastKey: string(data[:keyLen]), handle: handle})
+		data = data[keyLen:]
+	}
+
+	return entries, nil
+}
+
+// properties describe the content of a table
+type properties struct {
+	dataBlocks uint64 // number of data blocks
+	dataSize   uint64 // total size of the data blocks
+	rawSize    uint64 // total size of the data blocks before compression
+	keySize    uint64 // total size of the keys
+	valueSize  uint64 // total size of the values
+	entries    uint64 // number of records, tombstones included
+	tombstones uint64 // number of records with an empty value
+
+	// smallestKey and largestKey bound the keys of the table
+	smallestKey string
+	largestKey  string
+
+	filterPolicy string  // name of the FilterPolicy that built the filter block
+	filterFPRate float64 // target false-positive rate the filter was built with
+
+	writeTime uint64 // unix nanoseconds of the newest write of the table
+}
+
+// encode serializes the properties as a list of tagged fields <tag><len><value>, len is a uint32
+func (p *properties) encode() []byte {
+	var data []byte
+	for _, field := range []struct {
+		tag   byte
+		value uint64
+	}{
+		{propDataBlocks, p.dataBlocks},
+		{propDataSize, p.dataSize},
+		{propKeySize, p.keySize},
+		{propValueSize, p.valueSize},
+		{propEntries, p.entries},
+		{propFilterFPRate, math.Float64bits(p.filterFPRate)},
+		{propTombstones, p.tombstones},
+		{propRawDataSize, p.rawSize},
+		{propWriteTime, p.writeTime},
+	} {
+		data = appendProperty(data, field.tag, enc.AppendUint64(nil, field.value))
+	}
+	data = appendProperty(data, propFilterPolicy, []byte(p.filterPolicy))
+	data = appendProperty(data, propSmallestKey, []byte(p.smallestKey))
+	data = appendProperty(data, propLargestKey, []byte(p.largestKey))
+
+	return data
+}
+
+func appendProperty(data []byte, tag byte, value []byte) []byte {
+	data = append(data, tag)
+	data = enc.AppendUint32(data, uint32(len(value)))
+	return append(data, value...)
+}
+
+// decodeProperties parses a properties block, fields with an unknown tag are skipped
+func decodeProperties(data []byte) (*properties, error) {
+	p := &properties{}
+
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, fmt.Errorf("%w: short property", errInvalidTable)
+		}
+		tag := data[0]
+		valueLen := int(enc.Uint32(data[1:]))
+		data = data[5:]
+
+		if len(data) < valueLen {
+			return nil, fmt.Errorf("%w: short property value", errInvalidTable)
+		}
+		value := data[:valueLen]
+		data = data[valueLen:]
+
+		var field *uint64
+		var fpRateBits uint64
+		switch tag {
+		case propDataBlocks:
+			field = &p.dataBlocks
+		case propDataSize:
+			field = &p.dataSize
+		case propKeySize:
+			field = &p.keySize
+		case propValueSize:
+			field = &p.valueSize
+		case propEntries:
+			field = &p.entries
+		case propFilterFPRate:
+			field = &fpRateBits
+		case propTombstones:
+			field = &p.tombstones
+		case propRawDataSize:
+			field = &p.rawSize
+		case propWriteTime:
+			field = &p.writeTime
+		case propFilterPolicy:
+			p.filterPolicy = string(value)
+			continue
+		case propSmallestKey:
+			p.smallestKey = string(value)
+			continue
+		case propLargestKey:
+			p.largestKey = string(value)
+			continue
+		default:
+			continue
+		}
+
+		if valueLen != 8 {
+			return nil, fmt.Errorf("%w: property %d has %d bytes", errInvalidTable, tag, valueLen)
+		}
+		*field = enc.Uint64(value)
+		if tag == propFilterFPRate {
+			p.filterFPRate = math.Float64frombits(fpRateBits)
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,178 @@
+package sstable
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// defaultIndexPartitionSize is the size of an index partition when the config does not set one
+	defaultIndexPartitionSize = 4096
+
+	// defaultIndexCachePartitions is the number of index partitions cached per table when the config does not set one
+	defaultIndexCachePartitions = 8
+)
+
+/*
+The index is split in two levels:
+  - index partitions: index blocks of about IndexPartitionSize bytes, each locating consecutive data blocks
+  - the top-level index: the block located by the footer, one entry per partition holding its last key
+
+Only the top-level index stays in memory, it has one entry per IndexPartitionSize bytes of index instead of one
+per data block. Partitions are read on demand and the most recently used ones are kept in a partitionCache.
+*/
+
+// partitionCache keeps the most recently used index partitions of a table
+type partitionCache struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // of *cachedPartition, most recently used first
+	items    map[uint64]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+type cachedPartition struct {
+	offset  uint64
+	entries []indexEntry
+}
+
+func newPartitionCache(capacity int) *partitionCache {
+	if capacity <= 0 {
+		capacity = defaultIndexCachePartitions
+	}
+
+	return &partitionCache{capacity: capacity, lru: list.New(), items: make(map[uint64]*list.Element)}
+}
+
+func (c *partitionCache) get(offset uint64) ([]indexEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[offset]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+
+	return elem.Value.(*cachedPartition).entries, true
+}
+
+func (c *partitionCache) add(offset uint64, entries []indexEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[offset]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.items[offset] = c.lru.PushFront(&cachedPartition{offset: offset, entries: entries})
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedPartition).offset)
+	}
+}
+
+// IndexStats describes the index of a table
+type IndexStats struct {
+	TopLevelEntries int    // entries of the index kept in memory
+	Partitions      int    // index partitions, 0 for a legacy table
+	CachedEntries   int    // entries of the cached partitions
+	CacheHits       uint64 // partition reads served by the cache
+	CacheMisses     uint64 // partition reads from the table file
+}
+
+// IndexStats returns the size of the index of the table in memory and the use of its partition cache
+func (s *SSTable) IndexStats() IndexStats {
+	stats := IndexStats{TopLevelEntries: len(s.index), Partitions: len(s.index)}
+	s.partitions.mu.Lock()
+	defer s.partitions.mu.Unlock()
+	for elem := s.partitions.lru.Front(); elem != nil; elem = elem.Next() {
+		stats.CachedEntries += len(elem.Value.(*cachedPartition).entries)
+	}
+	stats.CacheHits = s.partitions.hits
+	stats.CacheMisses = s.partitions.misses
+
+	return stats
+}
+
+// partition returns the entries of the index partition located by handle, from the cache or the table file
+func (s *SSTable) partition(handle blockHandle) ([]indexEntry, error) {
+	if entries, ok := s.partitions.get(handle.offset); ok {
+		return entries, nil
+	}
+
+	data, err := readBlock(s.file, handle, true)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodeIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("index partition at offset %d: %w", handle.offset, err)
+	}
+	s.partitions.add(handle.offset, entries)
+
+	return entries, nil
+}
+
+/*
+forEachBlock calls fn with the index entry of every data block from the first one that may hold keys >= start,
+in key order, until fn returns false or an error
+*/
+func (s *SSTable) forEachBlock(start string, fn func(entry indexEntry) (bool, error)) error {
+	first := sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].lastKey >= start
+	})
+
+	for _, top := range s.index[first:] {
+		entries, err := s.partition(top.handle)
+		if err != nil {
+			return err
+		}
+
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].lastKey >= start
+		})
+		for _, entry := range entries[i:] {
+			if more, err := fn(entry); !more || err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+encodePartitionedIndex splits the index entries in partitions of about partitionSize bytes and calls writePartition
+for each of them, it returns the top-level index holding the last key and the handle of every partition
+*/
+func encodePartitionedIndex(entries []indexEntry, partitionSize uint64,
+	writePartition func(data []byte) (blockHandle, error)) ([]indexEntry, error) {
+	if partitionSize == 0 {
+		partitionSize = defaultIndexPartitionSize
+	}
+
+	var top []indexEntry
+	var data []byte
+	for i, entry := range entries {
+		data = encodeIndexEntry(data, entry)
+
+		if uint64(len(data)) >= partitionSize || i == len(entries)-1 {
+			handle, err := writePartition(data)
+			if err != nil {
+				return nil, err
+			}
+			top = append(top, indexEntry{lastKey: entry.lastKey, handle: handle})
+			data = nil
+		}
+	}
+
+	return top, nil
+}
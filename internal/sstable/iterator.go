@@ -0,0 +1,94 @@
+package sstable
+
+import (
+	"fmt"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+)
+
+/*
+Iterator reads the records of an SSTable in key order, tombstones included, holding a single data block in memory.
+Data blocks are read with the checksum verification of Records, and the iteration stops at the first block that
+cannot be read: Err then reports why.
+
+	it := table.NewIterator()
+	for it.Next() {
+		record := it.Record()
+	}
+	if err := it.Err(); err != nil {
+*/
+type Iterator struct {
+	table   *SSTable
+	handles []blockHandle // data blocks left to read
+	records []kv.Record   // records of the current data block
+	pos     int
+	err     error
+}
+
+// NewIterator returns an iterator positioned before the first record of the table
+func (s *SSTable) NewIterator() *Iterator {
+	it := &Iterator{table: s, pos: -1}
+
+	if s.openErr != nil {
+		it.err = fmt.Errorf("sstable.Iterator: SSTable %d: %w", s.id, s.openErr)
+		return it
+	}
+	if s.legacy != nil {
+		// Legacy tables are only left when their migration failed, they are read whole
+		it.records, it.err = s.legacy.records()
+		if it.err != nil {
+			it.err = fmt.Errorf("sstable.Iterator: SSTable %d: %w", s.id, it.err)
+		}
+		return it
+	}
+	if s.file == nil {
+		return it
+	}
+
+	it.err = s.forEachBlock("", func(entry indexEntry) (bool, error) {
+		it.handles = append(it.handles, entry.handle)
+		return true, nil
+	})
+	if it.err != nil {
+		it.err = fmt.Errorf("sstable.Iterator: SSTable %d: %w", s.id, it.err)
+	}
+
+	return it
+}
+
+// Next moves to the next record, it returns false at the end of the table or on error
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.pos++
+	for it.pos >= len(it.records) {
+		if len(it.handles) == 0 {
+			it.records = nil
+			return false
+		}
+
+		records, err := it.table.readRecords(it.handles[0])
+		if err != nil {
+			it.err = fmt.Errorf("sstable.Iterator: SSTable %d: %w", it.table.id, err)
+			it.records = nil
+			return false
+		}
+		it.handles = it.handles[1:]
+		it.records = records
+		it.pos = 0
+	}
+
+	return true
+}
+
+// Record returns the current record, valid after Next returned true
+func (it *Iterator) Record() kv.Record {
+	return it.records[it.pos]
+}
+
+// Err returns the error that stopped the iteration, nil at the end of the table
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,267 @@
+package sstable
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+)
+
+/*
+legacyTable reads an SSTable written before the single-file format, it is never written to
+Folder name pattern: data/sstables/<id>/<offset>.sst, one file per Block
+
+Sparse Index: Store base offset of each block, each key:offset represents the start of a block
+  - Folder name pattern: indexes/<id>.index
+  - File format: <key>:<offset>
+  - key: the first key of the block
+  - offset: the base offset of the block
+*/
+type legacyTable struct {
+	sparseEntries []sparseEntry // always sorted by key
+	blocks        []Block       // sorted descending by baseOffset
+}
+
+type sparseEntry struct {
+	key    kv.Key
+	offset uint64
+}
+
+// legacyTableExists reports whether the SSTable with the given id is stored in the legacy directory format
+func legacyTableExists(id uint64, dirConfig *config.DirectoryConfig) bool {
+	info, err := os.Stat(legacyTableDir(id, dirConfig))
+	return err == nil && info.IsDir()
+}
+
+func legacyTableDir(id uint64, dirConfig *config.DirectoryConfig) string {
+	return path.Join(dirConfig.SSTableDir, fmt.Sprintf("%d", id))
+}
+
+func legacyIndexPath(id uint64, dirConfig *config.DirectoryConfig) string {
+	return path.Join(dirConfig.SparseIndexDir, fmt.Sprintf("%d.index", id))
+}
+
+// openLegacyTable recovers the sparse index and the blocks of a legacy SSTable
+func openLegacyTable(id uint64, dirConfig *config.DirectoryConfig) *legacyTable {
+	t := &legacyTable{}
+	t.recoverSparseIndex(legacyIndexPath(id, dirConfig))
+	t.recoverBlocks(id, dirConfig)
+
+	return t
+}
+
+/*
+get looks up the key in sparse index that closest and <= the key, get the base offset of the block
+and reads that single block: the block starting at the first key <= the key is the only one that may hold it.
+*/
+func (t *legacyTable) get(key kv.Key) (kv.Value, bool) {
+	startOffset, ok := t.findSparseOffset(key)
+	if !ok {
+		return kv.Value(""), false
+	}
+
+	// blocks are sorted descending by baseOffset
+	i := sort.Search(len(t.blocks), func(i int) bool {
+		return t.blocks[i].baseOffset <= startOffset
+	})
+	if i == len(t.blocks) || t.blocks[i].baseOffset != startOffset {
+		return kv.Value(""), false
+	}
+
+	return t.blocks[i].Get(key)
+}
+
+// findSparseOffset binary-searches sparseEntries for the largest entry with key <= target.
+func (t *legacyTable) findSparseOffset(key kv.Key) (uint64, bool) {
+	n := len(t.sparseEntries)
+	if n == 0 {
+		return 0, false
+	}
+
+	// sort.Search returns the smallest i where sparseEntries[i].key > key,
+	// so the largest entry with key <= target is at i-1.
+	i := sort.Search(n, func(i int) bool {
+		return t.sparseEntries[i].key > key
+	})
+	if i == 0 {
+		return 0, false
+	}
+
+	return t.sparseEntries[i-1].offset, true
+}
+
+// records returns every record of the table in key order, it fails on the first block that cannot be read
+func (t *legacyTable) records() ([]kv.Record, error) {
+	var records []kv.Record
+	for i := len(t.blocks) - 1; i >= 0; i-- {
+		recs, err := t.blocks[i].GetAll()
+		if err != nil {
+			return nil, fmt.Errorf("block at offset %d: %w", t.blocks[i].baseOffset, err)
+		}
+		records = append(records, recs...)
+	}
+
+	return records, nil
+}
+
+// getAll returns every record of the table in key order, the blocks that cannot be read are logged and skipped
+func (t *legacyTable) getAll() []kv.Record {
+	var records []kv.Record
+	for i := len(t.blocks) - 1; i >= 0; i-- {
+		recs, err := t.blocks[i].GetAll()
+		if err != nil {
+			log.Printf("sstable.GetAll: error reading block at offset %d: %v", t.blocks[i].baseOffset, err)
+			continue
+		}
+		records = append(records, recs...)
+	}
+
+	return records
+}
+
+func (t *legacyTable) close() {
+	for _, block := range t.blocks {
+		block.Close()
+	}
+}
+
+/*
+recoverBlocks reads the SSTable directory and recovers all blocks in memory.
+NewBlock is called to open the block by id of sstable and offset of block.
+Blocks are sorted descending by baseOffset so that get works correctly.
+*/
+func (t *legacyTable) recoverBlocks(id uint64, dirConfig *config.DirectoryConfig) {
+	files, err := os.ReadDir(legacyTableDir(id, dirConfig))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+		off, _ := strconv.ParseUint(offStr, 10, 64)
+		block, err := NewBlock(id, off, dirConfig)
+		if err != nil {
+			log.Println("Error creating block: ", err)
+			continue
+		}
+
+		t.blocks = append(t.blocks, *block)
+	}
+
+	sort.Slice(t.blocks, func(i, j int) bool {
+		return t.blocks[i].baseOffset > t.blocks[j].baseOffset
+	})
+}
+
+// recoverSparseIndex reads the sparse index file and recovers the sorted sparseEntries slice in memory.
+func (t *legacyTable) recoverSparseIndex(filePath string) {
+	sparseLogFile, err := os.Open(filePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error opening sparse index file: ", err)
+		}
+		return
+	}
+	defer sparseLogFile.Close()
+	scanner := bufio.NewScanner(sparseLogFile)
+
+	// Use a map first so duplicate keys in the WAL keep the latest offset, matching prior behavior.
+	index := make(map[kv.Key]uint64)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		// The key may contain colons, the offset cannot
+		sep := strings.LastIndex(line, ":")
+		if sep < 0 {
+			log.Println("Invalid sparse index line: ", line)
+			continue
+		}
+
+		key := kv.Key(line[:sep])
+		offset, err := strconv.Atoi(line[sep+1:])
+
+		if err != nil {
+			log.Println("Error parsing offset: ", err)
+			continue
+		}
+
+		index[key] = uint64(offset)
+	}
+
+	t.sparseEntries = make([]sparseEntry, 0, len(index))
+	for key, offset := range index {
+		t.sparseEntries = append(t.sparseEntries, sparseEntry{key: key, offset: offset})
+	}
+	sort.Slice(t.sparseEntries, func(i, j int) bool {
+		return t.sparseEntries[i].key < t.sparseEntries[j].key
+	})
+}
+
+/*
+migrateLegacy rewrites a legacy table in the single-file format under the same id, then removes
+its block directory and its text sparse index.
+The records are read from every block file, so blocks the sparse index cannot reach are migrated too.
+The new file is written under a temporary name and renamed once durable: a crash leaves either the legacy
+table, which is migrated again on the next open, or the new file next to legacy files that are then removed.
+*/
+func (s *SSTable) migrateLegacy() error {
+	legacy := openLegacyTable(s.id, s.dirConfig)
+	records, err := legacy.records()
+	legacy.close()
+	if err != nil {
+		return err
+	}
+
+	if len(records) > 0 {
+		if info, err := os.Stat(legacyTableDir(s.id, s.dirConfig)); err == nil {
+			s.WriteTime = info.ModTime()
+		}
+
+		tmpPath := s.path() + ".migrate"
+		file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := s.writeRecords(file, records); err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := file.Close(); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := os.Rename(tmpPath, s.path()); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := syncDir(s.dirConfig.SSTableDir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(legacyTableDir(s.id, s.dirConfig)); err != nil {
+		return err
+	}
+	if err := os.Remove(legacyIndexPath(s.id, s.dirConfig)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Printf("sstable: migrated legacy SSTable %d, %d records", s.id, len(records))
+	return nil
+}
@@ -1,417 +1,673 @@
 package sstable
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/memtable"
-	"github.com/richardktran/lsm-tree-go-my-way/pkg/bloomfilter"
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/filter"
 )
 
+// TableFileExt is the extension of SSTable files
+const TableFileExt = ".sst"
+
 /*
-SSTable is a sorted string table
-Folder name pattern: data/sstables/<id>/**
+SSTable is a sorted string table stored in a single immutable file
+File name pattern: data/sstables/<id>.sst
   - id: the id representing the SSTable
 
-Sparse Index: Store base offset of each block, each key:offset represents the start of a block
-  - Folder name pattern: indexes/<id>.index
-  - File format: <key>:<offset>
-  - key: the key of the record
-  - offset: the offset of the record in the SSTable file
-
-Each SSTable is composed of multiple blocks
-Folder name pattern: data/sstables/<id>/<offset>.sst
-  - offset: the offset of the block in the SSTable file
-  - File format: <keyLen><key><valueLen><value>
-  - keyLen: the length of the key
-  - key: the key of the record
-  - valueLen: the length of the value
-  - value: the value of the record
+File format: <data block>...<data block><filter block><index block><properties block><footer>
+  - data block: sorted records, see blockBuilder
+  - filter block: the filter of the keys of the table, built by the FilterPolicy named in the properties, loaded on first use
+  - index partitions: the last key, offset and size of every data block, see encodeIndex and index.go
+  - index block: the last key, offset and size of every index partition
+  - properties block: statistics about the table, see properties
+  - footer: fixed size, locates the other blocks and holds the format version and a magic number
+
+Every block but the footer is followed by the CRC32C of its content. The index, filter and properties blocks
+and the data blocks of point reads are always verified, the data blocks read by Records and Scan when
+config.VerifyChecksums is set. A mismatch is reported as a *CorruptionError.
+
+The file is opened once and blocks are read with ReadAt, so a table costs a single file handle.
+Tables written in the legacy directory format are rewritten in this format when they are opened,
+they are read through legacyTable only when that fails.
 */
-type sparseEntry struct {
-	key    kv.Key
-	offset uint64
-}
-
 type SSTable struct {
-	id               uint64
-	sparseEntries    []sparseEntry // always sorted by key
-	sparseIndexLock  sync.Mutex
-	blocks           []Block
-	config           config.Config
-	dirConfig        *config.DirectoryConfig
-	sparseLogFile    *os.File
-	sparseLogChannel chan sparseEntry // write-ahead log for SparseIndex
-	sparseIndexWg    sync.WaitGroup   // tracks the persistSparseIndex goroutine
-	CreatedAt        int64
-	flushWg          sync.WaitGroup
-	BloomFilter      *bloomfilter.BloomFilter
+	id           uint64
+	config       config.Config
+	dirConfig    *config.DirectoryConfig
+	file         *os.File     // nil until the table is flushed, and for a legacy table
+	openErr      error        // why the table file on disk could not be opened, reads fail with it
+	index        []indexEntry // the index block: one entry per index partition
+	partitions   *partitionCache
+	props        properties
+	legacy       *legacyTable // set when the table is stored in the legacy directory format
+	flushWg      sync.WaitGroup
+	filter       filter.Filter // nil until loaded by MightContain
+	filterHandle blockHandle
+	filterOnce   sync.Once
+	Level        int    // level of the SSTable as recorded in the manifest
+	Seq          uint64 // sequence number of the newest record, orders SSTables of the same level
+
+	// wastedReads counts the point reads that read a data block without finding the key, see WastedReads
+	wastedReads atomic.Uint64
+
+	// FilterFPRate is the target false-positive rate of the filter built by Flush, 0 for config.FilterFPRate
+	FilterFPRate float64
+
+	// WriteTime is the time of the newest write of the table. It is recorded in the table file by Flush,
+	// which uses the current time when it is zero. Migrated legacy tables take the modification time of their directory.
+	WriteTime time.Time
 }
 
 /*
-NewSSTable creates a new SSTable instance, initializes the sparse index and recovers the blocks
+NewSSTable opens the SSTable with the given id, or returns an empty SSTable ready to be flushed
+when no table with this id is on disk.
+A table file that cannot be opened is logged, and every read of the returned SSTable fails with the
+*CorruptionError, see OpenSSTable to fail right away.
 */
 func NewSSTable(id uint64, config *config.Config, dirConfig *config.DirectoryConfig) *SSTable {
-	s := &SSTable{
-		id:               id,
-		sparseEntries:    make([]sparseEntry, 0),
-		blocks:           make([]Block, 0),
-		config:           *config,
-		sparseLogChannel: make(chan sparseEntry, config.SparseWALBufferSize),
-		dirConfig:        dirConfig,
-		CreatedAt:        time.Now().UnixNano(),
-	}
+	s := newSSTable(id, config, dirConfig)
 
-	sparseIndexFolderPath := path.Join(dirConfig.SparseIndexDir)
-
-	if _, err := os.Stat(sparseIndexFolderPath); os.IsNotExist(err) {
-		os.MkdirAll(dirConfig.SparseIndexDir, 0755)
+	if err := s.openExisting(); err != nil && !os.IsNotExist(err) {
+		log.Printf("sstable: open SSTable %d: %v", id, err)
+		s.openErr = err
 	}
 
-	indexFilePath := path.Join(dirConfig.SparseIndexDir, fmt.Sprintf("%d.index", id))
+	return s
+}
 
-	s.recoverSparseIndex(indexFilePath)
-	s.recoverBlocks()
+// OpenSSTable opens the SSTable with the given id, it fails when the table is not on disk or cannot be read
+func OpenSSTable(id uint64, config *config.Config, dirConfig *config.DirectoryConfig) (*SSTable, error) {
+	s := newSSTable(id, config, dirConfig)
 
-	sparseLogFile, err := os.OpenFile(indexFilePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
-		return s
+	if err := s.openExisting(); err != nil {
+		return nil, fmt.Errorf("sstable.OpenSSTable: SSTable %d: %w", id, err)
 	}
 
-	s.sparseLogFile = sparseLogFile
+	return s, nil
+}
 
-	// Start a goroutine to consume the record from the sparseLogChannel and write to the sparse index WAL.
-	// sparseIndexWg tracks this goroutine so Close() can wait for all writes to land before closing the file.
-	s.sparseIndexWg.Add(1)
-	go func() {
-		defer s.sparseIndexWg.Done()
-		s.persistSparseIndex()
-	}()
+func newSSTable(id uint64, config *config.Config, dirConfig *config.DirectoryConfig) *SSTable {
+	return &SSTable{
+		id:         id,
+		config:     *config,
+		dirConfig:  dirConfig,
+		partitions: newPartitionCache(config.IndexCachePartitions),
+	}
+}
 
-	// Build the bloom filter
-	s.BloomFilter = bloomfilter.NewBloomFilter(config.BloomFilterSize, config.BloomFilterHashCount)
-	for _, block := range s.blocks {
-		records, _ := block.GetAll()
-		for _, record := range records {
-			s.BloomFilter.Add(string(record.Key))
+// openExisting opens the table file, a table of the legacy directory format is migrated first
+func (s *SSTable) openExisting() error {
+	if legacyTableExists(s.id, s.dirConfig) {
+		if err := s.migrateLegacy(); err != nil {
+			log.Printf("sstable: SSTable %d stays in the legacy format: %v", s.id, err)
+			s.legacy = openLegacyTable(s.id, s.dirConfig)
+			return nil
 		}
 	}
 
-	return s
+	return s.open()
 }
 
 /*
-Get look up the key in sparse index that closest and <= the key, get the base offset of the block
-From the block, find the key and return the value.
-If the key is not found, find the next block until the key is found.
-If the key is not found in any block, return false
+open reads the footer, the index and the properties of the table file, the filter is read on first use.
+A file that exists but cannot be loaded is reported as a *CorruptionError.
 */
-func (s *SSTable) Get(key kv.Key) (kv.Value, bool) {
-	startOffset, ok := s.findSparseOffset(key)
-	if !ok {
-		return kv.Value(""), false
+func (s *SSTable) open() error {
+	file, err := os.Open(s.path())
+	if err != nil {
+		return err
 	}
 
-	for _, block := range s.blocks {
-		if block.baseOffset < startOffset {
-			break
-		}
+	if err := s.load(file); err != nil {
+		file.Close()
 
-		value, found := block.Get(key)
-		if found {
-			return value, true
+		var corruption *CorruptionError
+		if errors.As(err, &corruption) {
+			return err
 		}
+		return &CorruptionError{Path: s.path(), Err: err}
 	}
+	s.file = file
 
-	return kv.Value(""), false
+	return nil
 }
 
-// findSparseOffset binary-searches sparseEntries for the largest entry with key <= target.
-func (s *SSTable) findSparseOffset(key kv.Key) (uint64, bool) {
-	n := len(s.sparseEntries)
-	if n == 0 {
-		return 0, false
+func (s *SSTable) load(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < footerSize {
+		return fmt.Errorf("%w: file too short", errInvalidTable)
 	}
 
-	// sort.Search returns the smallest i where sparseEntries[i].key > key,
-	// so the largest entry with key <= target is at i-1.
-	i := sort.Search(n, func(i int) bool {
-		return s.sparseEntries[i].key > key
-	})
-	if i == 0 {
-		return 0, false
+	footerData := make([]byte, footerSize)
+	if _, err := file.ReadAt(footerData, info.Size()-footerSize); err != nil {
+		return err
+	}
+	f, err := decodeFooter(footerData)
+	if err != nil {
+		return err
+	}
+
+	indexData, err := readBlock(file, f.index, true)
+	if err != nil {
+		return err
+	}
+	index, err := decodeIndex(indexData)
+	if err != nil {
+		return err
 	}
 
-	return s.sparseEntries[i-1].offset, true
+	propsData, err := readBlock(file, f.properties, true)
+	if err != nil {
+		return err
+	}
+	props, err := decodeProperties(propsData)
+	if err != nil {
+		return err
+	}
+
+	s.index = index
+	s.filterHandle = f.filter
+	s.props = *props
+	s.WriteTime = time.Unix(0, int64(props.writeTime))
+
+	return nil
 }
 
-// addSparseEntry appends a sparse index entry (keys are inserted in sorted order during flush)
-// and queues it for persistence.
-func (s *SSTable) addSparseEntry(key kv.Key, offset uint64) {
-	entry := sparseEntry{key: key, offset: offset}
-	s.sparseIndexLock.Lock()
-	s.sparseEntries = append(s.sparseEntries, entry)
-	s.sparseIndexLock.Unlock()
-	s.sparseLogChannel <- entry
+// readBlock reads the block located by handle from the table file, with verify the checksum following it is checked
+func readBlock(file *os.File, handle blockHandle, verify bool) ([]byte, error) {
+	size := handle.size
+	if verify {
+		size += checksumSize
+	}
+
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, int64(handle.offset)); err != nil {
+		return nil, fmt.Errorf("read block at offset %d: %w", handle.offset, err)
+	}
+	if !verify {
+		return data, nil
+	}
+
+	data, sum := data[:handle.size], enc.Uint32(data[handle.size:])
+	if checksum(data) != sum {
+		return nil, &CorruptionError{Path: file.Name(), Offset: handle.offset, Size: handle.size}
+	}
+
+	return data, nil
+}
+
+// readDataBlock reads the data block located by handle, decompresses it and parses its restart points
+func (s *SSTable) readDataBlock(handle blockHandle, verify bool) (*blockReader, error) {
+	data, err := readBlock(s.file, handle, verify)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = decompressBlock(data); err != nil {
+		return nil, fmt.Errorf("block at offset %d: %w", handle.offset, err)
+	}
+
+	block, err := newBlockReader(data)
+	if err != nil {
+		return nil, fmt.Errorf("block at offset %d: %w", handle.offset, err)
+	}
+
+	return block, nil
 }
 
 /*
-Flush get all records from the memtable, add to a block until the block is full.
-When the block is full, write the block to disk and create a new block.
-Each block is added to the SSTable.
-The base offset of each block is stored in the sparse index.
-Write the record to the sparseLogChannel to persist the sparse index to disk (will be consumed by persistSparseIndex)
+Get finds the only data block that may hold the key: the first block whose last key is >= the key,
+reading the index partition that locates it when it is not cached.
+The block is read from the file and its restart points are binary-searched for the key.
+An empty value is a tombstone and is returned as found.
+It fails when the index partition or the data block cannot be read, see CorruptionError: the key may be in the table.
 */
-func (s *SSTable) Flush(memtable memtable.MemTable) {
-	s.flushWg.Add(1)
-	defer s.flushWg.Done()
+func (s *SSTable) Get(key kv.Key) (kv.Value, bool, error) {
+	if s.openErr != nil {
+		return kv.Value(""), false, fmt.Errorf("sstable.Get: SSTable %d: %w", s.id, s.openErr)
+	}
+	if s.legacy != nil {
+		value, found := s.legacy.get(key)
+		return value, found, nil
+	}
+	if !s.InKeyRange(key) {
+		return kv.Value(""), false, nil
+	}
 
-	var baseOffset uint64 = 0
-	block, err := NewBlock(s.id, baseOffset, s.dirConfig)
+	var handle *blockHandle
+	err := s.forEachBlock(string(key), func(entry indexEntry) (bool, error) {
+		handle = &entry.handle
+		return false, nil
+	})
+	if err != nil {
+		return kv.Value(""), false, fmt.Errorf("sstable.Get: SSTable %d: %w", s.id, err)
+	}
+	if handle == nil {
+		return kv.Value(""), false, nil
+	}
 
+	block, err := s.readDataBlock(*handle, true)
 	if err != nil {
-		log.Println("Error creating new block: ", err)
-		return
+		return kv.Value(""), false, fmt.Errorf("sstable.Get: SSTable %d: %w", s.id, err)
 	}
-	for index, record := range memtable.GetAll() {
-		if block.IsMax(s.config.SSTableBlockSize) {
-			s.blocks = append(s.blocks, *block)
-			block.Close()
-			block, err = NewBlock(s.id, baseOffset, s.dirConfig)
-			if err != nil {
-				log.Println("Error creating new block: ", err)
-				return
-			}
 
-			s.addSparseEntry(record.Key, baseOffset)
-		}
+	value, found, err := block.get(key)
+	if err != nil {
+		return kv.Value(""), false, fmt.Errorf("sstable.Get: SSTable %d: %w", s.id, err)
+	}
+	if !found {
+		s.wastedReads.Add(1)
+	}
 
-		if index == 0 {
-			s.addSparseEntry(record.Key, baseOffset)
-		}
+	return value, found, nil
+}
 
-		blockLen, _, err := block.Add(record)
-		if err != nil {
-			log.Println("Error adding record to block: ", err)
-			return
-		}
+/*
+Flush writes all records of the memtable to the table file.
+*/
+func (s *SSTable) Flush(memtable memtable.MemTable) error {
+	return s.FlushRecords(memtable.GetAll())
+}
 
-		baseOffset += uint64(blockLen)
+// FlushRecords writes a pre-sorted slice of records to the table file and opens it for reads
+func (s *SSTable) FlushRecords(records []kv.Record) error {
+	if len(records) == 0 {
+		return nil
 	}
 
-	s.blocks = append(s.blocks, *block)
+	w, err := s.NewWriter()
+	if err != nil {
+		return fmt.Errorf("sstable.FlushRecords: %w", err)
+	}
+	for _, record := range records {
+		if err := w.Add(record); err != nil {
+			w.Abort()
+			return fmt.Errorf("sstable.FlushRecords: %w", err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		return fmt.Errorf("sstable.FlushRecords: %w", err)
+	}
 
-	// sort blocks by base offset
-	s.SortBlocks()
+	return nil
 }
 
-func (s *SSTable) SortBlocks() {
-	sort.Slice(s.blocks, func(i, j int) bool {
-		return s.blocks[i].baseOffset > s.blocks[j].baseOffset
-	})
+// writeRecords writes the records to file in the current format with the configured block and filter settings
+func (s *SSTable) writeRecords(file *os.File, records []kv.Record) (*tableWriter, error) {
+	writer := s.newWriter(file)
+	for _, record := range records {
+		if err := writer.add(record); err != nil {
+			return nil, fmt.Errorf("add record: %w", err)
+		}
+	}
+	if err := writer.finish(); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
 }
 
-func (s *SSTable) FlushWait() {
-	s.flushWg.Wait()
+/*
+MightContain reports whether the key may be in the table, a false result means the key is not in the table.
+The filter is read from the table file on first use, so opening a table does not read it.
+Legacy tables have their filter rebuilt from their keys.
+*/
+func (s *SSTable) MightContain(key kv.Key) bool {
+	s.filterOnce.Do(s.loadFilter)
+
+	if s.filter == nil {
+		return true
+	}
+
+	return s.filter.MightContain(string(key))
 }
 
-// Close closes the sparseLogChannel and the sparse index WAL
-func (s *SSTable) Close() error {
-	s.flushWg.Wait()
-	close(s.sparseLogChannel)
-	s.sparseIndexWg.Wait()
-	return s.sparseLogFile.Close()
+// filterPolicy returns the policy of the filters of new tables, a BloomPolicy built from the BloomFilter fields by default
+func (s *SSTable) filterPolicy() filter.FilterPolicy {
+	if s.config.FilterPolicy != nil {
+		return s.config.FilterPolicy
+	}
+
+	return filter.BloomPolicy{
+		Size:      s.config.BloomFilterSize,
+		HashCount: s.config.BloomFilterHashCount,
+		Blocked:   s.config.BloomFilterBlocked,
+	}
 }
 
-// GetAll returns every record stored across all blocks of this SSTable
-func (s *SSTable) GetAll() []kv.Record {
-	var records []kv.Record
-	for _, b := range s.blocks {
-		// Open a fresh handle regardless of whether the stored one is still open.
-		freshBlock, err := NewBlock(s.id, b.baseOffset, s.dirConfig)
-		if err != nil {
-			log.Printf("sstable.GetAll: error opening block at offset %d: %v", b.baseOffset, err)
-			continue
+func (s *SSTable) loadFilter() {
+	if s.legacy != nil {
+		records := s.GetAll()
+		keys := make([]string, len(records))
+		for i, record := range records {
+			keys[i] = string(record.Key)
 		}
-		recs, readErr := freshBlock.GetAll()
-		_ = freshBlock.Close()
-		if readErr != nil {
-			log.Printf("sstable.GetAll: error reading block at offset %d: %v", b.baseOffset, readErr)
-			continue
+
+		f, err := s.filterPolicy().NewFilter(keys, s.config.FilterFPRate, uint32(s.id))
+		if err != nil {
+			log.Printf("sstable: SSTable %d: rebuild filter: %v", s.id, err)
+			return
 		}
-		records = append(records, recs...)
+		s.filter = f
+		return
 	}
-	return records
-}
 
-// FlushRecords writes a pre-sorted slice of records directly to this SSTable
-func (s *SSTable) FlushRecords(records []kv.Record) {
-	s.flushWg.Add(1)
-	defer s.flushWg.Done()
+	if s.file == nil {
+		return
+	}
 
-	if len(records) == 0 {
+	data, err := readBlock(s.file, s.filterHandle, true)
+	if err != nil {
+		log.Printf("sstable: SSTable %d: load filter: %v", s.id, err)
 		return
 	}
 
-	var baseOffset uint64
-	block, err := NewBlock(s.id, baseOffset, s.dirConfig)
+	f, err := filter.Decode(s.props.filterPolicy, data)
 	if err != nil {
-		log.Println("FlushRecords: error creating block:", err)
+		log.Printf("sstable: SSTable %d: load filter: %v", s.id, err)
 		return
 	}
+	s.filter = f
+}
 
-	for index, record := range records {
-		if block.IsMax(s.config.SSTableBlockSize) {
-			s.blocks = append(s.blocks, *block)
-			block.Close()
-			block, err = NewBlock(s.id, baseOffset, s.dirConfig)
-			if err != nil {
-				log.Println("FlushRecords: error creating block:", err)
-				return
-			}
+// NumEntries returns the number of records of the table, tombstones included, 0 for a legacy table
+func (s *SSTable) NumEntries() uint64 {
+	return s.props.entries
+}
 
-			s.addSparseEntry(record.Key, baseOffset)
-		}
+// NumTombstones returns the number of deleted keys recorded in the table, 0 for a legacy table
+func (s *SSTable) NumTombstones() uint64 {
+	return s.props.tombstones
+}
+
+// WastedReads returns the number of point reads since the table was opened that read a data block without finding
+// the key, a false positive of the filter when the reader checked MightContain first
+func (s *SSTable) WastedReads() uint64 {
+	return s.wastedReads.Load()
+}
 
-		if index == 0 {
-			s.addSparseEntry(record.Key, baseOffset)
+// ResetWastedReads sets the count of WastedReads back to 0
+func (s *SSTable) ResetWastedReads() {
+	s.wastedReads.Store(0)
+}
+
+// Size returns the total size of the keys and values of the table, 0 for a legacy table
+func (s *SSTable) Size() uint64 {
+	return s.props.keySize + s.props.valueSize
+}
+
+// KeyRange returns the smallest and largest key of the table, both are empty for a table with unknown bounds
+func (s *SSTable) KeyRange() (smallest, largest kv.Key) {
+	return kv.Key(s.props.smallestKey), kv.Key(s.props.largestKey)
+}
+
+// InKeyRange reports whether the key is between the smallest and the largest key of the table
+func (s *SSTable) InKeyRange(key kv.Key) bool {
+	return s.Overlaps(key, key+"\x00")
+}
+
+/*
+Overlaps reports whether the table may hold keys in [start, end), an empty end has no upper bound.
+Legacy tables and tables that could not be opened have unknown bounds and always overlap.
+*/
+func (s *SSTable) Overlaps(start, end kv.Key) bool {
+	if s.legacy != nil || s.openErr != nil {
+		return true
+	}
+	if len(s.index) == 0 {
+		return false
+	}
+
+	smallest, largest := s.KeyRange()
+
+	return start <= largest && (end == "" || end > smallest)
+}
+
+/*
+Scan returns the records of the table with a key in [start, end) in key order, tombstones included.
+An empty end has no upper bound. It stops at the first block that cannot be read.
+*/
+func (s *SSTable) Scan(start, end kv.Key) ([]kv.Record, error) {
+	if s.openErr != nil {
+		return nil, fmt.Errorf("sstable.Scan: SSTable %d: %w", s.id, s.openErr)
+	}
+	if !s.Overlaps(start, end) {
+		return nil, nil
+	}
+
+	inRange := func(key kv.Key) bool {
+		return key >= start && (end == "" || key < end)
+	}
+
+	if s.legacy != nil {
+		all, err := s.legacy.records()
+		if err != nil {
+			return nil, fmt.Errorf("sstable.Scan: SSTable %d: %w", s.id, err)
 		}
+		var records []kv.Record
+		for _, record := range all {
+			if inRange(record.Key) {
+				records = append(records, record)
+			}
+		}
+		return records, nil
+	}
 
-		blockLen, _, err := block.Add(record)
+	var records []kv.Record
+	err := s.forEachBlock(string(start), func(entry indexEntry) (bool, error) {
+		recs, err := s.readRecords(entry.handle)
 		if err != nil {
-			log.Println("FlushRecords: error adding record:", err)
-			return
+			return false, err
 		}
-		baseOffset += uint64(blockLen)
+		for _, record := range recs {
+			if end != "" && record.Key >= end {
+				return false, nil
+			}
+			if inRange(record.Key) {
+				records = append(records, record)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return records, fmt.Errorf("sstable.Scan: SSTable %d: %w", s.id, err)
 	}
 
-	s.blocks = append(s.blocks, *block)
-	s.SortBlocks()
+	return records, nil
 }
 
-// DeleteFromDisk removes all on-disk artefacts belonging to this SSTable:
-// the block directory and the sparse-index file
-func (s *SSTable) DeleteFromDisk() error {
-	blockDir := path.Join(s.dirConfig.SSTableDir, fmt.Sprintf("%d", s.id))
-	if err := os.RemoveAll(blockDir); err != nil {
-		return fmt.Errorf("sstable.DeleteFromDisk: remove blocks: %w", err)
+// readRecords returns every record of a data block, the checksum is verified when config.VerifyChecksums is set
+func (s *SSTable) readRecords(handle blockHandle) ([]kv.Record, error) {
+	block, err := s.readDataBlock(handle, s.config.VerifyChecksums)
+	if err != nil {
+		return nil, err
 	}
 
-	indexFilePath := path.Join(s.dirConfig.SparseIndexDir, fmt.Sprintf("%d.index", s.id))
-	if err := os.Remove(indexFilePath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("sstable.DeleteFromDisk: remove index: %w", err)
+	records, err := block.all()
+	if err != nil {
+		return nil, fmt.Errorf("block at offset %d: %w", handle.offset, err)
 	}
 
-	return nil
+	return records, nil
 }
 
-// CloseAndDelete is a convenience wrapper that closes the SSTable and then
-// removes all its on-disk files.
-func (s *SSTable) CloseAndDelete() error {
-	if err := s.Close(); err != nil {
-		return err
-	}
-	return s.DeleteFromDisk()
+/*
+FilterStats returns the size in bytes of the filter of the table and the target false-positive rate it was built with.
+The rate is 0 for filters of fixed size.
+*/
+func (s *SSTable) FilterStats() (size uint64, fpRate float64) {
+	return s.filterHandle.size, s.props.filterFPRate
+}
+
+func (s *SSTable) FlushWait() {
+	s.flushWg.Wait()
+}
+
+// ID returns the id of the SSTable
+func (s *SSTable) ID() uint64 {
+	return s.id
 }
 
 /*
-recoverBlocks reads the SSTable directory and recovers all blocks in memory.
-NewBlock is called to create or open the block by id of sstable and offset of block.
-Blocks are sorted descending by baseOffset (same invariant as after Flush) so that
-SSTable.Get() works correctly.
+Sync makes a flushed SSTable durable: it waits for the flush, then fsyncs the table file
+and the directory holding it.
+Only after Sync returns may the SSTable be recorded in the manifest.
 */
-func (s *SSTable) recoverBlocks() {
-	blocks := make([]Block, 0)
+func (s *SSTable) Sync() error {
+	s.flushWg.Wait()
+
+	if s.file != nil {
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("sstable.Sync: %w", err)
+		}
+	}
+
+	if err := syncDir(s.dirConfig.SSTableDir); err != nil {
+		return fmt.Errorf("sstable.Sync: %w", err)
+	}
 
-	blockDir := path.Join(s.dirConfig.SSTableDir, fmt.Sprintf("%d", s.id))
-	files, err := os.ReadDir(blockDir)
+	return nil
+}
+
+// syncDir fsyncs a directory so that the files created in it are durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
 	if err != nil {
-		s.blocks = blocks
-		return
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// Close closes the table file
+func (s *SSTable) Close() error {
+	s.flushWg.Wait()
+
+	if s.legacy != nil {
+		s.legacy.close()
+		return nil
 	}
 
-	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 64)
-		block, err := NewBlock(s.id, off, s.dirConfig)
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+// GetAll returns every record of this SSTable in key order, the blocks that cannot be read are logged and skipped
+func (s *SSTable) GetAll() []kv.Record {
+	if s.openErr != nil {
+		log.Printf("sstable.GetAll: SSTable %d: %v", s.id, s.openErr)
+		return nil
+	}
+	if s.legacy != nil {
+		return s.legacy.getAll()
+	}
+
+	var records []kv.Record
+	err := s.forEachBlock("", func(entry indexEntry) (bool, error) {
+		recs, err := s.readRecords(entry.handle)
 		if err != nil {
-			log.Println("Error creating block: ", err)
-			continue
+			log.Printf("sstable.GetAll: SSTable %d: %v", s.id, err)
+			return true, nil
 		}
-
-		blocks = append(blocks, *block)
+		records = append(records, recs...)
+		return true, nil
+	})
+	if err != nil {
+		log.Printf("sstable.GetAll: SSTable %d: %v", s.id, err)
 	}
 
-	s.blocks = blocks
-	s.SortBlocks()
+	return records
 }
 
 /*
-persistSparseIndex receives entries from the sparseLogChannel and writes them to the sparse index WAL
-Whenever a new entry is added to the sparseLogChannel, it is written to the sparse index WAL
+Records returns every record of this SSTable in key order.
+Unlike GetAll it fails on the first block that cannot be read, so a compaction never drops
+the records of a corrupted block.
 */
-func (s *SSTable) persistSparseIndex() {
-	for entry := range s.sparseLogChannel {
-		line := fmt.Sprintf("%s:%d\n", entry.key, entry.offset)
-		_, err := s.sparseLogFile.WriteString(line)
+func (s *SSTable) Records() ([]kv.Record, error) {
+	if s.openErr != nil {
+		return nil, fmt.Errorf("sstable.Records: SSTable %d: %w", s.id, s.openErr)
+	}
+	if s.legacy != nil {
+		records, err := s.legacy.records()
 		if err != nil {
-			log.Println("Error writing to sparse index WAL: ", err)
+			return nil, fmt.Errorf("sstable.Records: SSTable %d: %w", s.id, err)
 		}
+		return records, nil
 	}
-}
 
-// recoverSparseIndex reads the sparse index file and recovers the sorted sparseEntries slice in memory.
-func (s *SSTable) recoverSparseIndex(filePath string) {
-	sparseLogFile, err := os.Open(filePath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Println("Error opening sparse index file: ", err)
+	var records []kv.Record
+	err := s.forEachBlock("", func(entry indexEntry) (bool, error) {
+		recs, err := s.readRecords(entry.handle)
+		if err != nil {
+			return false, err
 		}
-		return
+		records = append(records, recs...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sstable.Records: SSTable %d: %w", s.id, err)
 	}
-	defer sparseLogFile.Close()
-	scanner := bufio.NewScanner(sparseLogFile)
 
-	// Use a map first so duplicate keys in the WAL keep the latest offset, matching prior behavior.
-	index := make(map[kv.Key]uint64)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
+	return records, nil
+}
 
-		parts := strings.Split(line, ":")
-		if len(parts) != 2 {
-			log.Println("Invalid sparse index line: ", line)
-			continue
-		}
+// DeleteFromDisk removes all on-disk artefacts belonging to this SSTable
+func (s *SSTable) DeleteFromDisk() error {
+	return DeleteFiles(s.id, s.dirConfig)
+}
 
-		key := kv.Key(parts[0])
-		offset, err := strconv.Atoi(parts[1])
+// DeleteFiles removes the table file of the SSTable with the given id, or its legacy block directory and sparse-index file
+func DeleteFiles(id uint64, dirConfig *config.DirectoryConfig) error {
+	if err := os.Remove(tablePath(id, dirConfig)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("sstable.DeleteFromDisk: remove table: %w", err)
+	}
 
-		if err != nil {
-			log.Println("Error parsing offset: ", err)
-			continue
-		}
+	if err := os.RemoveAll(legacyTableDir(id, dirConfig)); err != nil {
+		return fmt.Errorf("sstable.DeleteFromDisk: remove blocks: %w", err)
+	}
 
-		index[key] = uint64(offset)
+	if err := os.Remove(legacyIndexPath(id, dirConfig)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("sstable.DeleteFromDisk: remove index: %w", err)
 	}
 
-	s.sparseEntries = make([]sparseEntry, 0, len(index))
-	for key, offset := range index {
-		s.sparseEntries = append(s.sparseEntries, sparseEntry{key: key, offset: offset})
+	return nil
+}
+
+// CloseAndDelete is a convenience wrapper that closes the SSTable and then
+// removes all its on-disk files.
+func (s *SSTable) CloseAndDelete() error {
+	if err := s.Close(); err != nil {
+		return err
 	}
-	sort.Slice(s.sparseEntries, func(i, j int) bool {
-		return s.sparseEntries[i].key < s.sparseEntries[j].key
-	})
+	return s.DeleteFromDisk()
+}
+
+func (s *SSTable) path() string {
+	return tablePath(s.id, s.dirConfig)
+}
+
+// tablePath returns the path of the table file of the SSTable with the given id
+func tablePath(id uint64, dirConfig *config.DirectoryConfig) string {
+	return path.Join(dirConfig.SSTableDir, fmt.Sprintf("%d%s", id, TableFileExt))
 }
@@ -1,177 +1,666 @@
 package sstable
 
 import (
-	"bufio"
+	"fmt"
+	"math/rand"
 	"os"
 	"path"
 	"strconv"
-	"strings"
 	"testing"
 	"time"
 
 	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/memtable"
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/bloomfilter"
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/filter"
 	"github.com/stretchr/testify/require"
 )
 
 func TestSSTable(t *testing.T) {
-	d, err := os.MkdirTemp("", "sstable-test")
+	for scenario, fn := range map[string]func(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig){
+		"close an empty SSTable":                testCloseSSTable,
+		"flush writes a single table file":      testFlushFromMemTableToSSTable,
+		"reopen recovers index and filter":      testRecoverStateOfSSTable,
+		"find a deleted key":                    testFindADeletedKey,
+		"unsupported format version is refused": testUnsupportedFormatVersion,
+		"legacy directory tables are migrated":  testReadLegacyTable,
+		"legacy table kept when unreadable":     testLegacyTableMigrationFails,
+		"corrupted filter lets keys through":    testCorruptedFilter,
+		"filter is sized from the key count":    testFilterSizedFromKeyCount,
+		"filter policies coexist":               testFilterPoliciesCoexist,
+		"key range is recorded":                 testKeyRange,
+		"blocks are compressed":                 testBlockCompression,
+		"corrupted blocks are detected":         testCorruptedBlocks,
+		"index is partitioned":                  testPartitionedIndex,
+		"write time is recorded":                testWriteTime,
+		"iterator reads every block":            testIterator,
+		"wasted reads are counted":              testWastedReads,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			d, err := os.MkdirTemp("", "sstable-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(d)
+
+			dirConfig := &config.DirectoryConfig{
+				SSTableDir:     d + "/sstable",
+				WALDir:         d + "/wal",
+				SparseIndexDir: d + "/indexes",
+			}
+			cfg := &config.Config{
+				SSTableBlockSize:     20, // block size is 20 bytes (2 records)
+				BloomFilterSize:      100,
+				BloomFilterHashCount: 3,
+			}
+
+			fn(t, cfg, dirConfig)
+		})
+	}
+}
+
+func testCloseSSTable(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+
+	require.NoError(t, sstable.Close())
+}
+
+func testFlushFromMemTableToSSTable(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
+
+	require.NoError(t, sstable.Flush(*newMemTable(4)))
+	require.NoError(t, sstable.Sync())
+
+	blocks := dataBlocks(t, sstable)
+	require.Equal(t, 2, len(blocks)) // 4 records => 2 blocks
+	require.Equal(t, []string{"k2", "k4"}, []string{blocks[0].lastKey, blocks[1].lastKey})
+	require.Equal(t, uint64(2), sstable.props.dataBlocks)
+
+	// One file per table, nothing else
+	entries, err := os.ReadDir(dirConfig.SSTableDir)
 	require.NoError(t, err)
-	defer os.RemoveAll(d)
+	require.Len(t, entries, 1)
+	require.Equal(t, "1.sst", entries[0].Name())
+	require.False(t, entries[0].IsDir())
 
-	dirConfig := &config.DirectoryConfig{
-		SSTableDir:     d + "/sstable",
-		WALDir:         d + "/wal",
-		SparseIndexDir: d + "/indexes",
-	}
-	cfg := &config.Config{
-		SparseWALBufferSize: 2,
-		SSTableBlockSize:    40, // block size is 40 bytes (2 records)
-	}
+	requireRecords(t, sstable, 4)
+}
 
-	sstableId := uint64(1)
+func testRecoverStateOfSSTable(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	require.NoError(t, sstable.Flush(*newMemTable(4)))
+	require.NoError(t, sstable.Close())
 
-	memtable := memtable.NewMemTable()
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
+
+	require.Equal(t, 2, len(dataBlocks(t, sstable)))
+	require.Equal(t, uint64(2), sstable.props.dataBlocks)
+	require.Nil(t, sstable.filter) // the filter is not read until it is needed
 	for i := 1; i <= 4; i++ {
-		key := kv.Key("k" + strconv.Itoa(i))
-		value := kv.Value("v" + strconv.Itoa(i))
-		memtable.Set(key, value)
+		require.True(t, sstable.MightContain(kv.Key("k"+strconv.Itoa(i))))
 	}
+	require.NotNil(t, sstable.filter)
+	require.False(t, sstable.MightContain(kv.Key("absent")))
+	requireRecords(t, sstable, 4)
+
+	_, found := getKey(t, sstable, kv.Key("k5"))
+	require.False(t, found)
+	_, found = getKey(t, sstable, kv.Key("k0"))
+	require.False(t, found)
+	require.Len(t, sstable.GetAll(), 4)
+}
 
-	testCloseSSTable(t, cfg, dirConfig)
+func testFindADeletedKey(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	memtable := newMemTable(4)
 
-	sstable := NewSSTable(sstableId, cfg, dirConfig)
-	testFlushFromMemTableToSSTable(t, memtable, sstable, cfg, dirConfig)
+	key := kv.Key("k2")
+	value := kv.Value("")
+	memtable.Delete(key)
 
-	sstable.Close()
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
 
-	sstable = NewSSTable(sstableId, cfg, dirConfig)
-	testRecoverStateOfSSTable(t, sstable, cfg, dirConfig)
+	require.NoError(t, sstable.Flush(*memtable))
 
-	testFindADeletedKey(t, d)
+	sstable.FlushWait()
 
-	sstable.Close()
+	// read k2 from sstable
+	v, found := getKey(t, sstable, key)
+	require.True(t, found) // Found the tombstone record
+	require.Equal(t, value, v)
 }
 
-func testCloseSSTable(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
-	t.Helper()
-
+func testUnsupportedFormatVersion(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
 	sstable := NewSSTable(uint64(1), cfg, dirConfig)
-
+	require.NoError(t, sstable.Flush(*newMemTable(4)))
 	require.NoError(t, sstable.Close())
-}
 
-func testFlushFromMemTableToSSTable(t *testing.T, memtable *memtable.MemTable, sstable *SSTable, cfg *config.Config, dirConfig *config.DirectoryConfig) {
-	t.Helper()
+	filePath := path.Join(dirConfig.SSTableDir, "1.sst")
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
 
-	sstable.Flush(*memtable)
+	f, err := decodeFooter(data[len(data)-footerSize:])
+	require.NoError(t, err)
+	// A bit flip in the version is refused rather than read as another layout
+	for _, version := range []uint32{formatVersion ^ 1, formatVersion ^ 1<<31} {
+		f.version = version
+		copy(data[len(data)-footerSize:], f.encode())
+		_, err = decodeFooter(data[len(data)-footerSize:])
+		require.ErrorIs(t, err, errUnsupportedVersion)
+	}
 
-	time.Sleep(2 * time.Second)
+	require.NoError(t, os.WriteFile(filePath, data, 0644))
+	_, err = OpenSSTable(uint64(1), cfg, dirConfig)
+	require.ErrorIs(t, err, errUnsupportedVersion)
 
-	require.Equal(t, 2, len(sstable.blocks)) // 4 records => 2 blocks
+	// The table is never read as empty
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
 
-	checkSSTableFiles(t, sstable.id, cfg, dirConfig)
-	checkSparseIndex(t, sstable, map[string]uint64{"k1": 0, "k3": 40})
+	var corruption *CorruptionError
+	_, _, err = sstable.Get(kv.Key("k1"))
+	require.ErrorAs(t, err, &corruption)
+	_, err = sstable.Scan("", "")
+	require.ErrorAs(t, err, &corruption)
+	_, err = sstable.Records()
+	require.ErrorAs(t, err, &corruption)
+	it := sstable.NewIterator()
+	require.False(t, it.Next())
+	require.ErrorAs(t, it.Err(), &corruption)
+	require.True(t, sstable.Overlaps("k1", "k2"))
 }
 
-func testRecoverStateOfSSTable(t *testing.T, sstable *SSTable, cfg *config.Config, dirConfig *config.DirectoryConfig) {
-	sstableId := sstable.id
+func testCorruptedFilter(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	require.NoError(t, sstable.Flush(*newMemTable(4)))
+	require.NoError(t, sstable.Close())
 
-	// Sleep to make sure blocks and index are recovered
-	time.Sleep(2 * time.Second)
+	// The filter block no longer matches its checksum
+	filePath := path.Join(dirConfig.SSTableDir, "1.sst")
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	f, err := decodeFooter(data[len(data)-footerSize:])
+	require.NoError(t, err)
+	for i := f.filter.offset; i < f.filter.offset+f.filter.size; i++ {
+		data[i] = 0
+	}
+	require.NoError(t, os.WriteFile(filePath, data, 0644))
 
-	require.Equal(t, 2, len(sstable.blocks)) // 4 records => 2 blocks
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
 
-	checkSSTableFiles(t, sstableId, cfg, dirConfig)
-	checkSparseIndex(t, sstable, map[string]uint64{"k1": 0, "k3": 40})
+	require.True(t, sstable.MightContain(kv.Key("absent"))) // no filter, every key may be present
+	for i := 1; i <= 4; i++ {
+		require.True(t, sstable.MightContain(kv.Key("k"+strconv.Itoa(i))))
+	}
+	requireRecords(t, sstable, 4)
 }
 
-func testFindADeletedKey(t *testing.T, rootDir string) {
-	dirConfig := &config.DirectoryConfig{
-		SSTableDir:     rootDir + "/sstable",
-		WALDir:         rootDir + "/wal",
-		SparseIndexDir: rootDir + "/indexes",
+func testFilterSizedFromKeyCount(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	cfg.FilterFPRate = 0.01
+
+	small := NewSSTable(uint64(1), cfg, dirConfig)
+	defer small.Close()
+	require.NoError(t, small.Flush(*newMemTable(10)))
+
+	large := NewSSTable(uint64(2), cfg, dirConfig)
+	defer large.Close()
+	require.NoError(t, large.Flush(*newMemTable(1000)))
+
+	// About 9.6 bits per key for a 1% false-positive rate
+	require.InDelta(t, 96, small.filter.(*bloomfilter.BloomFilter).Size(), 1)
+	require.InDelta(t, 9586, large.filter.(*bloomfilter.BloomFilter).Size(), 1)
+	require.Equal(t, 7, large.filter.(*bloomfilter.BloomFilter).HashCount())
+
+	// A per-table rate overrides the configured one and is recorded with the entry count
+	tuned := NewSSTable(uint64(4), cfg, dirConfig)
+	tuned.FilterFPRate = 0.1
+	require.NoError(t, tuned.Flush(*newMemTable(1000)))
+	require.NoError(t, tuned.Close())
+	tuned = NewSSTable(uint64(4), cfg, dirConfig)
+	defer tuned.Close()
+	size, fpRate := tuned.FilterStats()
+	require.Equal(t, 0.1, fpRate)
+	require.Less(t, size, uint64(9586/8))
+	require.Equal(t, uint64(1000), tuned.NumEntries())
+
+	cfg.BloomFilterBlocked = true
+	blocked := NewSSTable(uint64(3), cfg, dirConfig)
+	defer blocked.Close()
+	require.NoError(t, blocked.Flush(*newMemTable(1000)))
+	require.Zero(t, blocked.filter.(*bloomfilter.BloomFilter).Size()%512)
+	requireRecords(t, blocked, 1000)
+	for i := 1; i <= 1000; i++ {
+		require.True(t, blocked.MightContain(kv.Key("k"+strconv.Itoa(i))))
 	}
-	cfg := &config.Config{
-		SparseWALBufferSize: 2,
-		SSTableBlockSize:    40, // block size is 40 bytes (2 records)
+}
+
+func testFilterPoliciesCoexist(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	cfg.FilterFPRate = 0.01
+	policies := []filter.FilterPolicy{nil, filter.CuckooPolicy{}, filter.XorPolicy{}}
+
+	for i, policy := range policies {
+		cfg.FilterPolicy = policy
+		sstable := NewSSTable(uint64(i+1), cfg, dirConfig)
+		require.NoError(t, sstable.Flush(*newMemTable(100)))
+		require.NoError(t, sstable.Close())
 	}
 
-	sstableId := uint64(1)
+	// Each table is read with the policy it was written with, whatever policy is configured now
+	cfg.FilterPolicy = filter.XorPolicy{}
+	for i, name := range []string{"bloom", "cuckoo", "xor"} {
+		sstable := NewSSTable(uint64(i+1), cfg, dirConfig)
+		require.Equal(t, name, sstable.props.filterPolicy)
+		for j := 1; j <= 100; j++ {
+			require.True(t, sstable.MightContain(kv.Key("k"+strconv.Itoa(j))))
+		}
+		require.False(t, sstable.MightContain(kv.Key("absent")))
+		requireRecords(t, sstable, 100)
+		require.NoError(t, sstable.Close())
+	}
+}
 
-	memtable := memtable.NewMemTable()
-	for i := 1; i <= 4; i++ {
-		key := kv.Key("k" + strconv.Itoa(i))
-		value := kv.Value("v" + strconv.Itoa(i))
-		memtable.Set(key, value)
+func testReadLegacyTable(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	// The legacy format: one file per block in data/sstables/<id>/ and a text sparse index
+	require.NoError(t, os.MkdirAll(dirConfig.SparseIndexDir, 0755))
+	var index string
+	for blockOffset := uint64(0); blockOffset < 80; blockOffset += 40 {
+		block, err := NewBlock(7, blockOffset, dirConfig)
+		require.NoError(t, err)
+		first := int(blockOffset/20) + 1
+		for i := first; i < first+2; i++ {
+			_, _, err := block.Add(kv.Record{Key: kv.Key("k" + strconv.Itoa(i)), Value: kv.Value("v" + strconv.Itoa(i))})
+			require.NoError(t, err)
+		}
+		require.NoError(t, block.Close())
+		index += fmt.Sprintf("k%d:%d\n", first, blockOffset)
 	}
 
-	key := kv.Key("k2")
-	value := kv.Value("")
-	memtable.Delete(key)
+	// A key with a colon in the sparse index
+	block, err := NewBlock(7, 80, dirConfig)
+	require.NoError(t, err)
+	_, _, err = block.Add(kv.Record{Key: kv.Key("user:1"), Value: kv.Value("alice")})
+	require.NoError(t, err)
+	require.NoError(t, block.Close())
+	index += "user:1:80\n"
+	require.NoError(t, os.WriteFile(path.Join(dirConfig.SparseIndexDir, "7.index"), []byte(index), 0644))
+
+	// The table is migrated to the single-file format when it is opened
+	sstable := NewSSTable(uint64(7), cfg, dirConfig)
+	require.Nil(t, sstable.legacy)
+	requireRecords(t, sstable, 4)
+	value, found := getKey(t, sstable, kv.Key("user:1"))
+	require.True(t, found)
+	require.Equal(t, kv.Value("alice"), value)
+	require.True(t, sstable.MightContain(kv.Key("k3")))
+	require.Len(t, sstable.GetAll(), 5)
+
+	entries, err := os.ReadDir(dirConfig.SSTableDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "7"+TableFileExt, entries[0].Name())
+	_, err = os.Stat(path.Join(dirConfig.SparseIndexDir, "7.index"))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, sstable.Close())
+
+	// Opening it again reads the migrated file
+	sstable = NewSSTable(uint64(7), cfg, dirConfig)
+	require.Nil(t, sstable.legacy)
+	requireRecords(t, sstable, 4)
+	require.NoError(t, sstable.CloseAndDelete())
+
+	entries, err = os.ReadDir(dirConfig.SSTableDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func testLegacyTableMigrationFails(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	require.NoError(t, os.MkdirAll(dirConfig.SparseIndexDir, 0755))
+	block, err := NewBlock(7, 0, dirConfig)
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		_, _, err := block.Add(kv.Record{Key: kv.Key("k" + strconv.Itoa(i)), Value: kv.Value("v" + strconv.Itoa(i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, block.Close())
+	require.NoError(t, os.WriteFile(path.Join(dirConfig.SparseIndexDir, "7.index"), []byte("k1:0\n"), 0644))
+
+	// A second block file cut in the middle of a record
+	require.NoError(t, os.WriteFile(path.Join(legacyTableDir(7, dirConfig), "40.sst"), []byte{1, 0, 0}, 0644))
+
+	// The table stays in the legacy format and its readable blocks are still served
+	sstable := NewSSTable(uint64(7), cfg, dirConfig)
+	require.NotNil(t, sstable.legacy)
+	requireRecords(t, sstable, 2)
+	_, err = os.Stat(sstable.path())
+	require.True(t, os.IsNotExist(err))
+
+	// Reading the whole table fails instead of skipping the unreadable block
+	_, err = sstable.Records()
+	require.Error(t, err)
+	_, err = sstable.Scan("", "")
+	require.Error(t, err)
+	it := sstable.NewIterator()
+	require.False(t, it.Next())
+	require.Error(t, it.Err())
+	require.NoError(t, sstable.CloseAndDelete())
+}
 
-	sstable := NewSSTable(sstableId, cfg, dirConfig)
+func testKeyRange(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	memTable := newMemTable(9)
+	memTable.Delete(kv.Key("k4"))
+	memTable.Delete(kv.Key("k7"))
+
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	require.NoError(t, sstable.Flush(*memTable))
+	require.NoError(t, sstable.Close())
+
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
 	defer sstable.Close()
 
-	sstable.Flush(*memtable)
+	smallest, largest := sstable.KeyRange()
+	require.Equal(t, kv.Key("k1"), smallest)
+	require.Equal(t, kv.Key("k9"), largest)
+	require.Equal(t, uint64(9), sstable.NumEntries())
+	require.Equal(t, uint64(2), sstable.NumTombstones())
 
-	sstable.FlushWait()
+	require.True(t, sstable.InKeyRange(kv.Key("k1")))
+	require.True(t, sstable.InKeyRange(kv.Key("k5")))
+	require.False(t, sstable.InKeyRange(kv.Key("k0")))
+	require.False(t, sstable.InKeyRange(kv.Key("l")))
 
-	// read k2 from sstable
-	v, found := sstable.Get(key)
-	require.True(t, found) // Found the tombstone record
-	require.Equal(t, value, v)
+	require.True(t, sstable.Overlaps(kv.Key("a"), kv.Key("k11")))
+	require.True(t, sstable.Overlaps(kv.Key("k9"), kv.Key("")))
+	require.False(t, sstable.Overlaps(kv.Key("a"), kv.Key("k1")))
+	require.False(t, sstable.Overlaps(kv.Key("k91"), kv.Key("")))
+
+	records, err := sstable.Scan(kv.Key("k3"), kv.Key("k6"))
+	require.NoError(t, err)
+	require.Equal(t, []kv.Record{
+		{Key: "k3", Value: kv.Value("v3")},
+		{Key: "k4", Value: kv.Value{}},
+		{Key: "k5", Value: kv.Value("v5")},
+	}, records)
+	records, err = sstable.Scan(kv.Key(""), kv.Key(""))
+	require.NoError(t, err)
+	require.Len(t, records, 9)
+	records, err = sstable.Scan(kv.Key("x"), kv.Key(""))
+	require.NoError(t, err)
+	require.Empty(t, records)
 }
 
-func checkSSTableFiles(t *testing.T, sstableId uint64, cfg *config.Config, dirConfig *config.DirectoryConfig) {
-	for i := 0; i < 2; i++ {
-		filePath := path.Join(dirConfig.SSTableDir, strconv.Itoa(int(sstableId)), strconv.Itoa(i*int(cfg.SSTableBlockSize))+".sst")
-		_, err := os.Stat(filePath)
-		require.NoError(t, err)
+func testBlockCompression(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	cfg.SSTableBlockSize = 4096
+
+	jsonRecords := make([]kv.Record, 500)
+	for i := range jsonRecords {
+		jsonRecords[i] = kv.Record{
+			Key:   kv.Key(fmt.Sprintf("user/%05d", i)),
+			Value: kv.Value(fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":true}`, i, i, i)),
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	randomRecords := make([]kv.Record, 100)
+	for i := range randomRecords {
+		value := make([]byte, 100)
+		rnd.Read(value)
+		randomRecords[i] = kv.Record{Key: kv.Key(fmt.Sprintf("random/%05d", i)), Value: value}
 	}
 
-	indexFilePath := path.Join(dirConfig.SparseIndexDir, strconv.Itoa(int(sstableId))+".index")
-	_, err := os.Stat(indexFilePath)
+	id := uint64(0)
+	for _, c := range []struct {
+		compression config.Compression
+		records     []kv.Record
+		minRatio    float64
+	}{
+		{config.CompressionNone, jsonRecords, 1},
+		{config.CompressionFlate, jsonRecords, 4},
+		{config.CompressionLZ, jsonRecords, 2},
+		{config.CompressionLZ, randomRecords, 1}, // stored uncompressed, LZ does not pay off
+	} {
+		id++
+		cfg.BlockCompression = c.compression
+		sstable := NewSSTable(id, cfg, dirConfig)
+		require.NoError(t, sstable.FlushRecords(c.records))
+		require.NoError(t, sstable.Close())
+
+		// Blocks record their codec, so changing the setting does not affect reads
+		cfg.BlockCompression = config.CompressionFlate
+		sstable = NewSSTable(id, cfg, dirConfig)
+		defer sstable.Close()
+
+		ratio := float64(sstable.props.rawSize) / float64(sstable.props.dataSize-sstable.props.dataBlocks)
+		require.GreaterOrEqual(t, ratio, c.minRatio, "compression %d", c.compression)
+		if c.minRatio == 1 {
+			require.Equal(t, sstable.props.rawSize+sstable.props.dataBlocks, sstable.props.dataSize)
+		}
+
+		require.Equal(t, c.records, sstable.GetAll())
+		for _, record := range c.records {
+			value, found := getKey(t, sstable, record.Key)
+			require.True(t, found)
+			require.Equal(t, record.Value, value)
+		}
+	}
+
+	_, err := decompressBlock([]byte{1, 2, 9})
+	require.ErrorIs(t, err, errInvalidTable)
+	_, err = decompressBlock([]byte{1, 2, codecLZ})
+	require.ErrorIs(t, err, errInvalidTable)
+}
+
+func testCorruptedBlocks(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	require.NoError(t, sstable.Flush(*newMemTable(4)))
+	require.NoError(t, sstable.Close())
+
+	filePath := path.Join(dirConfig.SSTableDir, "1.sst")
+	original, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	f, err := decodeFooter(original[len(original)-footerSize:])
+	require.NoError(t, err)
+
+	corrupt := func(offset uint64) {
+		data := append([]byte(nil), original...)
+		data[offset] ^= 0x01
+		require.NoError(t, os.WriteFile(filePath, data, 0644))
+	}
+	var corruption *CorruptionError
+
+	// A data block: point reads always verify, scans and Records when VerifyChecksums is set
+	corrupt(0)
+	cfg.VerifyChecksums = true
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
+	_, _, err = sstable.Get(kv.Key("k1"))
+	require.ErrorAs(t, err, &corruption)
+	value, found := getKey(t, sstable, kv.Key("k3")) // in another block
+	require.True(t, found)
+	require.Equal(t, kv.Value("v3"), value)
+	_, err = sstable.Records()
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, filePath, corruption.Path)
+	require.Equal(t, uint64(0), corruption.Offset)
+	_, err = sstable.Scan(kv.Key(""), kv.Key(""))
+	require.ErrorAs(t, err, &corruption)
+	require.NoError(t, sstable.Close())
+
+	// The index, filter and properties blocks are always verified
+	for _, handle := range []blockHandle{f.index, f.properties} {
+		corrupt(handle.offset)
+		err := (&SSTable{id: 1, dirConfig: dirConfig}).open()
+		require.ErrorAs(t, err, &corruption)
+		require.Equal(t, handle.offset, corruption.Offset)
+	}
+
+	corrupt(f.filter.offset)
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
+	require.True(t, sstable.MightContain(kv.Key("absent"))) // no filter, every key may be present
+	requireRecords(t, sstable, 4)
+}
+
+func testPartitionedIndex(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	cfg.IndexPartitionSize = 100 // about 4 index entries
+	cfg.IndexCachePartitions = 2
+
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	require.NoError(t, sstable.Flush(*newMemTable(200)))
+	require.NoError(t, sstable.Close())
+
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
+
+	// Only the top-level index is in memory once the table is opened
+	blocks := uint64(len(dataBlocks(t, sstable)))
+	require.Equal(t, sstable.props.dataBlocks, blocks)
+	stats := sstable.IndexStats()
+	require.Greater(t, stats.Partitions, 10)
+	require.Equal(t, stats.Partitions, stats.TopLevelEntries)
+	require.Less(t, uint64(stats.TopLevelEntries), blocks/3)
+
+	requireRecords(t, sstable, 200)
+	_, found := getKey(t, sstable, kv.Key("k0"))
+	require.False(t, found)
+	_, found = getKey(t, sstable, kv.Key("z"))
+	require.False(t, found)
+
+	records, err := sstable.Scan(kv.Key("k150"), kv.Key("k160"))
 	require.NoError(t, err)
+	require.Len(t, records, 11) // k150..k159 and k16
+	require.Equal(t, kv.Key("k150"), records[0].Key)
+
+	// At most IndexCachePartitions partitions stay cached, repeated reads of a key hit the cache
+	stats = sstable.IndexStats()
+	require.LessOrEqual(t, stats.CachedEntries, 2*int(blocks)/stats.Partitions+4)
+	misses := stats.CacheMisses
+	for i := 0; i < 10; i++ {
+		_, found := getKey(t, sstable, kv.Key("k42"))
+		require.True(t, found)
+	}
+	stats = sstable.IndexStats()
+	require.Equal(t, misses+1, stats.CacheMisses)
+}
+
+func testWriteTime(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	writeTime := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	sstable.WriteTime = writeTime
+	require.NoError(t, sstable.Flush(*newMemTable(5)))
+	require.NoError(t, sstable.Close())
+
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
+	require.True(t, writeTime.Equal(sstable.WriteTime))
 }
 
-func checkSparseIndex(t *testing.T, sstable *SSTable, expected map[string]uint64) {
-	require.Equal(t, len(expected), len(sstable.sparseEntries))
-	for key, offset := range expected {
-		foundOffset, ok := sstable.findSparseOffset(kv.Key(key))
-		require.True(t, ok)
-		require.Equal(t, offset, foundOffset)
+func testWastedReads(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	memTable := newMemTable(5)
+	memTable.Delete(kv.Key("k4"))
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
+	require.NoError(t, sstable.Flush(*memTable))
+
+	// Found keys, tombstones included, and keys out of the key range read no block for nothing
+	for _, key := range []kv.Key{"k3", "k4", "k0", "k6"} {
+		getKey(t, sstable, key)
 	}
+	require.Zero(t, sstable.WastedReads())
 
-	// sparseEntries must remain sorted by key for binary search
-	for i := 1; i < len(sstable.sparseEntries); i++ {
-		require.Less(t, sstable.sparseEntries[i-1].key, sstable.sparseEntries[i].key)
+	for _, key := range []kv.Key{"k2x", "k3x"} {
+		_, found := getKey(t, sstable, key)
+		require.False(t, found)
 	}
+	require.Equal(t, uint64(2), sstable.WastedReads())
 
-	indexFilePath := path.Join(sstable.dirConfig.SparseIndexDir, strconv.Itoa(int(sstable.id))+".index")
-	indexFile, err := os.Open(indexFilePath)
+	sstable.ResetWastedReads()
+	require.Zero(t, sstable.WastedReads())
+}
+
+func testIterator(t *testing.T, cfg *config.Config, dirConfig *config.DirectoryConfig) {
+	memTable := newMemTable(50)
+	memTable.Delete(kv.Key("k7"))
+	sstable := NewSSTable(uint64(1), cfg, dirConfig)
+	require.NoError(t, sstable.Flush(*memTable))
+	require.Greater(t, len(dataBlocks(t, sstable)), 1)
+
+	var records []kv.Record
+	it := sstable.NewIterator()
+	for it.Next() {
+		records = append(records, it.Record())
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, sstable.GetAll(), records)
+	require.False(t, it.Next())
+
+	// The iteration stops at a corrupted block, after the records of the blocks before it
+	blocks := dataBlocks(t, sstable)
+	second := blocks[1].handle
+	firstBlock := 0
+	for _, record := range records {
+		if string(record.Key) <= blocks[0].lastKey {
+			firstBlock++
+		}
+	}
+	require.NoError(t, sstable.Close())
+	data, err := os.ReadFile(tablePath(1, dirConfig))
 	require.NoError(t, err)
-	defer indexFile.Close()
+	data[second.offset] ^= 0x01
+	require.NoError(t, os.WriteFile(tablePath(1, dirConfig), data, 0644))
 
-	scanner := bufio.NewScanner(indexFile)
-	result := make(map[string]uint64)
-	for scanner.Scan() {
-		line := scanner.Text()
-		require.NotEmpty(t, line)
+	cfg.VerifyChecksums = true
+	sstable = NewSSTable(uint64(1), cfg, dirConfig)
+	defer sstable.Close()
+	it = sstable.NewIterator()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	var corruption *CorruptionError
+	require.ErrorAs(t, it.Err(), &corruption)
+	require.Equal(t, second.offset, corruption.Offset)
+	require.Equal(t, firstBlock, n)
+}
 
-		parts := strings.Split(line, ":")
-		require.Equal(t, 2, len(parts))
+// dataBlocks returns the index entries of every data block of the table
+func dataBlocks(t *testing.T, sstable *SSTable) []indexEntry {
+	t.Helper()
 
-		key := parts[0]
-		offset, err := strconv.Atoi(parts[1])
-		require.NoError(t, err)
+	var entries []indexEntry
+	require.NoError(t, sstable.forEachBlock("", func(entry indexEntry) (bool, error) {
+		entries = append(entries, entry)
+		return true, nil
+	}))
+
+	return entries
+}
+
+// getKey reads the key from the SSTable, which must not fail
+func getKey(t *testing.T, sstable *SSTable, key kv.Key) (kv.Value, bool) {
+	t.Helper()
 
-		result[key] = uint64(offset)
+	value, found, err := sstable.Get(key)
+	require.NoError(t, err)
+
+	return value, found
+}
+
+func newMemTable(n int) *memtable.MemTable {
+	memtable := memtable.NewMemTable()
+	for i := 1; i <= n; i++ {
+		memtable.Set(kv.Key("k"+strconv.Itoa(i)), kv.Value("v"+strconv.Itoa(i)))
 	}
 
-	require.Equal(t, len(expected), len(result))
-	for key, offset := range expected {
-		require.Equal(t, offset, result[key])
+	return memtable
+}
+
+// requireRecords checks that kN:vN for N in 1..n can be read from the SSTable
+func requireRecords(t *testing.T, sstable *SSTable, n int) {
+	t.Helper()
+
+	for i := 1; i <= n; i++ {
+		value, found := getKey(t, sstable, kv.Key("k"+strconv.Itoa(i)))
+		require.True(t, found)
+		require.Equal(t, kv.Value("v"+strconv.Itoa(i)), value)
 	}
 }
@@ -0,0 +1,272 @@
+package sstable
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/filter"
+)
+
+/*
+tableWriter writes sorted records into a table file with the layout:
+<data block>...<data block><filter block><index partition>...<index partition><index block><properties block><footer>
+Every block is followed by the CRC32C of its content.
+
+A data block is cut once it reaches blockSize, the index partitions hold one entry per data block,
+the index block one entry per partition and the footer locates the filter, index and properties blocks.
+*/
+type tableWriter struct {
+	buf         *bufio.Writer
+	offset      uint64
+	blockSize   uint64
+	compression config.Compression
+	block       blockBuilder
+	index       []indexEntry // one entry per data block
+	props       properties
+	keys        []string         // keys of the filter when the policy is not a HashPolicy
+	hashes      []filter.KeyHash // hashes of the keys of the filter when it is
+	policy      filter.FilterPolicy
+	hashPolicy  filter.HashPolicy // policy, nil when it is not a HashPolicy
+	fpRate      float64
+	seed        uint32
+	filter      filter.Filter // built by finish
+	footer      footer        // written by finish
+
+	indexPartitionSize uint64       // size of the index partitions, 0 for defaultIndexPartitionSize
+	topIndex           []indexEntry // the index block, written by finish
+}
+
+/*
+newTableWriter creates a writer of data blocks of blockSize bytes before compression, with a restart point
+every restartInterval records, whose filter is built by policy with the target false-positive rate and seed
+*/
+func newTableWriter(file *os.File, blockSize uint64, restartInterval int, compression config.Compression,
+	policy filter.FilterPolicy, fpRate float64, seed uint32) *tableWriter {
+	if restartInterval <= 0 {
+		restartInterval = defaultRestartInterval
+	}
+	hashPolicy, _ := policy.(filter.HashPolicy)
+
+	return &tableWriter{
+		buf:         bufio.NewWriter(file),
+		blockSize:   blockSize,
+		compression: compression,
+		block:       blockBuilder{restartInterval: restartInterval},
+		policy:      policy,
+		hashPolicy:  hashPolicy,
+		fpRate:      fpRate,
+		seed:        seed,
+	}
+}
+
+// add appends a record, records must be added in key order
+func (w *tableWriter) add(record kv.Record) error {
+	if !w.block.empty() && uint64(w.block.size()) >= w.blockSize {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	w.block.add(record)
+	if w.hashPolicy != nil {
+		w.hashes = append(w.hashes, w.hashPolicy.HashKey(string(record.Key), w.seed))
+	} else {
+		w.keys = append(w.keys, string(record.Key))
+	}
+	w.props.keySize += uint64(len(record.Key))
+	w.props.valueSize += uint64(len(record.Value))
+	w.props.entries++
+	if len(record.Value) == 0 {
+		w.props.tombstones++
+	}
+	if w.props.entries == 1 {
+		w.props.smallestKey = string(record.Key)
+	}
+	w.props.largestKey = string(record.Key)
+
+	return nil
+}
+
+// finish writes the last data block, the filter, index and properties blocks and the footer
+func (w *tableWriter) finish() error {
+	if !w.block.empty() {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+
+	// Filters such as xor filters are static, so the filter is built once every key is known
+	if w.hashPolicy != nil {
+		w.filter, err = w.hashPolicy.NewFilterFromHashes(w.hashes, w.fpRate, w.seed)
+	} else {
+		w.filter, err = w.policy.NewFilter(w.keys, w.fpRate, w.seed)
+	}
+	if err != nil {
+		return err
+	}
+	filterData, err := w.filter.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.props.filterPolicy = w.policy.Name()
+	w.props.filterFPRate = w.fpRate
+
+	f := &w.footer
+	f.version = formatVersion
+	if f.filter, err = w.writeBlock(filterData); err != nil {
+		return err
+	}
+	if w.topIndex, err = encodePartitionedIndex(w.index, w.indexPartitionSize, w.writeBlock); err != nil {
+		return err
+	}
+	if f.index, err = w.writeBlock(encodeIndex(w.topIndex)); err != nil {
+		return err
+	}
+	if f.properties, err = w.writeBlock(w.props.encode()); err != nil {
+		return err
+	}
+	if _, err := w.buf.Write(f.encode()); err != nil {
+		return err
+	}
+
+	return w.buf.Flush()
+}
+
+func (w *tableWriter) flushBlock() error {
+	lastKey := w.block.lastKey
+	data := w.block.finish()
+	w.props.rawSize += uint64(len(data))
+
+	data, err := compressBlock(data, w.compression)
+	if err != nil {
+		return err
+	}
+
+	handle, err := w.writeBlock(data)
+	if err != nil {
+		return err
+	}
+
+	w.index = append(w.index, indexEntry{lastKey: string(lastKey), handle: handle})
+	w.props.dataBlocks++
+	w.props.dataSize += handle.size
+
+	return nil
+}
+
+// writeBlock writes a block followed by its checksum
+func (w *tableWriter) writeBlock(data []byte) (blockHandle, error) {
+	handle := blockHandle{offset: w.offset, size: uint64(len(data))}
+	if _, err := w.buf.Write(data); err != nil {
+		return blockHandle{}, err
+	}
+	w.offset += handle.size
+
+	if _, err := w.buf.Write(enc.AppendUint32(nil, checksum(data))); err != nil {
+		return blockHandle{}, err
+	}
+	w.offset += checksumSize
+
+	return handle, nil
+}
+
+/*
+Writer writes the table file of an SSTable from records added in key order, so that a table is written without
+holding its records in memory. Only a fixed-size hash of every key is kept, to build the filter once the table is
+complete, or the key itself with a FilterPolicy that is not a filter.HashPolicy.
+Finish opens the table for reads, Abort removes the partial table file.
+*/
+type Writer struct {
+	table  *SSTable
+	file   *os.File
+	writer *tableWriter
+}
+
+// NewWriter creates the table file of the SSTable and returns a writer of its records, it fails when the file exists
+func (s *SSTable) NewWriter() (*Writer, error) {
+	if err := os.MkdirAll(s.dirConfig.SSTableDir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(s.path(), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s.flushWg.Add(1)
+	return &Writer{table: s, file: file, writer: s.newWriter(file)}, nil
+}
+
+// newWriter returns a writer of the table to file with the configured block and filter settings
+func (s *SSTable) newWriter(file *os.File) *tableWriter {
+	fpRate := s.config.FilterFPRate
+	if s.FilterFPRate > 0 {
+		fpRate = s.FilterFPRate
+	}
+	if s.WriteTime.IsZero() {
+		s.WriteTime = time.Now()
+	}
+
+	// Seeding the filter with the table id keeps false positives of different tables independent
+	writer := newTableWriter(file, s.config.SSTableBlockSize, s.config.SSTableRestartInterval, s.config.BlockCompression, s.filterPolicy(), fpRate, uint32(s.id))
+	writer.indexPartitionSize = s.config.IndexPartitionSize
+	writer.props.writeTime = uint64(s.WriteTime.UnixNano())
+
+	return writer
+}
+
+// Add appends a record, records must be added in key order
+func (w *Writer) Add(record kv.Record) error {
+	if err := w.writer.add(record); err != nil {
+		return fmt.Errorf("add record: %w", err)
+	}
+
+	return nil
+}
+
+// Size returns the bytes of keys and values added so far
+func (w *Writer) Size() uint64 {
+	return w.writer.props.keySize + w.writer.props.valueSize
+}
+
+// Entries returns the number of records added so far
+func (w *Writer) Entries() uint64 {
+	return w.writer.props.entries
+}
+
+// Finish writes the last data block, the filter, index and properties blocks and the footer, then opens the table for reads
+func (w *Writer) Finish() error {
+	s := w.table
+	defer s.flushWg.Done()
+
+	if err := w.writer.finish(); err != nil {
+		w.file.Close()
+		return err
+	}
+
+	s.file = w.file
+	s.index = w.writer.topIndex
+	s.props = w.writer.props
+	s.filter = w.writer.filter
+	s.filterHandle = w.writer.footer.filter
+	s.filterOnce.Do(func() {})
+
+	return nil
+}
+
+// Abort closes and removes the table file being written
+func (w *Writer) Abort() {
+	defer w.table.flushWg.Done()
+
+	w.file.Close()
+	if err := os.Remove(w.table.path()); err != nil && !os.IsNotExist(err) {
+		log.Printf("sstable: remove SSTable %d: %v", w.table.id, err)
+	}
+}
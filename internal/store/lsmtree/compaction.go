@@ -0,0 +1,576 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/manifest"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+)
+
+// compaction is a set of SSTables merged into new SSTables of the output level
+type compaction struct {
+	inputs      []*sstable.SSTable
+	outputLevel int
+
+	// dropTombstones is set when no SSTable outside the inputs may hold an older version of the keys of the inputs
+	dropTombstones bool
+
+	// maxOutputSize splits the output in SSTables of about maxOutputSize bytes of keys and values, 0 for a single SSTable
+	maxOutputSize uint64
+
+	reason string // logged, why the compaction was picked
+
+	full   bool // every SSTable of the store is an input
+	manual bool // run by Compact or CompactRange
+}
+
+// trivialMove reports whether the compaction only changes the level of its single input: nothing to merge it with
+// and no tombstone to drop
+func (c *compaction) trivialMove() bool {
+	return len(c.inputs) == 1 && c.inputs[0].Level != c.outputLevel &&
+		(!c.dropTombstones || c.inputs[0].NumTombstones() == 0)
+}
+
+// Compact runs a full compaction of all SSTables: it merges them into a single SSTable, or SSTables of MaxOutputFileSize, keeping only the newest version of each key and dropping tombstones.
+// It is a no-op when the number of SSTables is below the CompactionThreshold (or when CompactionThreshold is 0, acting as an unconditional manual trigger).
+// It first waits for the compactions running in the background, whose inputs it needs.
+func (s *LSMTreeStore) Compact() error {
+	s.sstableLock.Lock()
+	for len(s.compacting) > 0 {
+		s.compactionDone.Wait()
+	}
+	c := s.pickFullCompaction()
+	if c != nil {
+		c.manual = true
+		s.reserveInputs(c)
+	}
+	s.sstableLock.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	return s.runCompaction(c)
+}
+
+/*
+CompactRange rewrites the SSTables holding keys in [start, end), an empty end has no upper bound, and leaves the
+other SSTables untouched: after a bulk delete the space of the deleted keys is reclaimed without rewriting the rest.
+The output stays in the deepest level of its inputs, see CompactRangeTo. The memTable is flushed first when it holds
+a key of the range, and the flushes in flight are waited for, so the compaction also covers the latest writes.
+It fails when end is not after start.
+*/
+func (s *LSMTreeStore) CompactRange(start, end kv.Key) error {
+	return s.compactRange(start, end, -1)
+}
+
+// CompactRangeTo is CompactRange with the output written to the given level
+func (s *LSMTreeStore) CompactRangeTo(start, end kv.Key, level int) error {
+	if level < 0 || level >= s.maxLevels() {
+		return fmt.Errorf("lsmtree: compact range: level %d out of [0, %d)", level, s.maxLevels())
+	}
+
+	return s.compactRange(start, end, level)
+}
+
+// compactRange runs the compaction of the SSTables overlapping [start, end) into level, -1 for the deepest input level
+func (s *LSMTreeStore) compactRange(start, end kv.Key, level int) error {
+	if end != "" && start >= end {
+		return fmt.Errorf("lsmtree: compact range: empty range [%q, %q), the start must be before the end", start, end)
+	}
+	if err := s.flushRange(start, end); err != nil {
+		return err
+	}
+
+	s.sstableLock.Lock()
+	inputs := s.rangeInputs(start, end)
+	for s.anyCompacting(inputs) {
+		s.compactionDone.Wait()
+		inputs = s.rangeInputs(start, end)
+	}
+	if len(inputs) == 0 {
+		s.sstableLock.Unlock()
+		return nil
+	}
+
+	c := s.rangeCompaction(inputs, level, fmt.Sprintf("range [%q, %q)", start, end))
+	c.manual = true
+	s.reserveInputs(c)
+	s.sstableLock.Unlock()
+
+	if err := s.runCompaction(c); err != nil {
+		return err
+	}
+
+	// The output level may now be over its bound
+	s.scheduler.schedule()
+	return nil
+}
+
+/*
+flushRange flushes the memTable when it holds a key in [start, end) and waits until every frozen memTable is
+flushed. A frozen memTable with a key of the range that is left afterwards failed to flush and fails the compaction.
+*/
+func (s *LSMTreeStore) flushRange(start, end kv.Key) error {
+	s.storeLock.Lock()
+	if s.memTable.Overlaps(start, end) {
+		if err := s.freezeMemTable(); err != nil {
+			s.storeLock.Unlock()
+			return fmt.Errorf("lsmtree: compact range: flush memTable: %w", err)
+		}
+	}
+	s.memTableLock.RLock()
+	frozen := slices.Clone(s.immutableMemTables)
+	s.memTableLock.RUnlock()
+	lastFlush := s.lastFlush
+	s.storeLock.Unlock()
+
+	if lastFlush != nil {
+		<-lastFlush
+	}
+
+	s.memTableLock.RLock()
+	defer s.memTableLock.RUnlock()
+	for _, table := range s.immutableMemTables {
+		if slices.Contains(frozen, table) && table.Overlaps(start, end) {
+			return errors.New("lsmtree: compact range: flush of a memTable holding keys of the range failed")
+		}
+	}
+
+	return nil
+}
+
+/*
+rangeInputs returns the SSTables overlapping [start, end), extended with every SSTable overlapping their key span
+until none is left: no other SSTable may hold a key of the output, so its tombstones are dropped and it can go to
+any level without overlapping the SSTables there. It must be called with sstableLock held.
+*/
+func (s *LSMTreeStore) rangeInputs(start, end kv.Key) []*sstable.SSTable {
+	var inputs []*sstable.SSTable
+	for {
+		n := len(inputs)
+		inputs = inputs[:0]
+		for _, table := range s.ssTables {
+			if table.Overlaps(start, end) {
+				inputs = append(inputs, table)
+			}
+		}
+		if len(inputs) == 0 || len(inputs) == n {
+			return inputs
+		}
+		start, end = keySpan(inputs)
+	}
+}
+
+// rangeCompaction returns the compaction of inputs returned by rangeInputs into level, -1 for the deepest input level.
+// It must be called with sstableLock held.
+func (s *LSMTreeStore) rangeCompaction(inputs []*sstable.SSTable, level int, reason string) *compaction {
+	c := &compaction{
+		inputs:         inputs,
+		outputLevel:    level,
+		dropTombstones: true, // every SSTable that may hold a key of the inputs is an input
+		reason:         reason,
+		full:           len(inputs) == len(s.ssTables),
+	}
+	if level < 0 {
+		for _, table := range inputs {
+			c.outputLevel = max(c.outputLevel, table.Level)
+		}
+	}
+	if s.config.CompactionStyle == config.CompactionLeveled && c.outputLevel > 0 {
+		c.maxOutputSize = s.targetFileSize()
+	}
+
+	return c
+}
+
+/*
+pickFullCompaction returns the compaction of every SSTable, nil below CompactionThreshold SSTables.
+It must be called with sstableLock held.
+The output goes to level 1, or with leveled compaction to the deepest level holding SSTables,
+split in SSTables of TargetFileSize so that the level keeps non-overlapping SSTables of bounded size.
+*/
+func (s *LSMTreeStore) pickFullCompaction() *compaction {
+	if s.config.CompactionThreshold > 0 && len(s.ssTables) < s.config.CompactionThreshold {
+		return nil
+	}
+	if len(s.ssTables) == 0 {
+		return nil
+	}
+
+	c := &compaction{
+		inputs:         append([]*sstable.SSTable(nil), s.ssTables...),
+		outputLevel:    1,
+		dropTombstones: true, // every SSTable is an input, no older version of a key is left
+		reason:         "full",
+		full:           true,
+	}
+	if s.config.CompactionStyle == config.CompactionLeveled {
+		c.outputLevel = max(1, s.ssTables[len(s.ssTables)-1].Level)
+		c.maxOutputSize = s.targetFileSize()
+	}
+
+	return c
+}
+
+/*
+pickCompaction returns the next compaction the configured CompactionStyle asks for, or else the compaction of an
+SSTable with too many tombstones or wasted reads, see pickTriggeredCompaction, with its inputs reserved.
+It returns nil when none is needed or when their inputs are used by running compactions.
+With time-window compaction the windows past Retention are dropped first, even when CompactionThreshold is 0.
+*/
+func (s *LSMTreeStore) pickCompaction() *compaction {
+	s.sstableLock.Lock()
+	var expired []*sstable.SSTable
+	if s.config.CompactionStyle == config.CompactionTimeWindow {
+		var err error
+		if expired, err = s.dropExpiredWindows(); err != nil {
+			log.Printf("lsmtree: retention error, the expired SSTables are kept: %v", err)
+		}
+	}
+	c := s.pickStyleCompaction()
+	if c == nil || s.anyCompacting(c.inputs) {
+		c = s.pickTriggeredCompaction()
+	}
+	if c != nil {
+		c.full = len(c.inputs) == len(s.ssTables)
+		s.reserveInputs(c)
+	}
+	s.sstableLock.Unlock()
+
+	// No reader can reach the expired SSTables any more, their files are deleted without holding the lock
+	deleteExpiredTables(expired)
+	return c
+}
+
+// pickStyleCompaction returns the compaction the configured CompactionStyle asks for, nil when none is needed or
+// when CompactionThreshold is 0. It must be called with sstableLock held.
+func (s *LSMTreeStore) pickStyleCompaction() *compaction {
+	if s.config.CompactionThreshold <= 0 {
+		return nil
+	}
+
+	var c *compaction
+	switch s.config.CompactionStyle {
+	case config.CompactionLeveled:
+		c = s.pickLeveledCompaction()
+	case config.CompactionSizeTiered:
+		c = s.pickSizeTieredCompaction()
+	case config.CompactionTimeWindow:
+		c = s.pickTimeWindowCompaction()
+	default:
+		// The previous full compaction left a single sorted run, split in SSTables of MaxOutputFileSize
+		if len(s.sortedRuns()) >= max(s.config.CompactionThreshold, 2) {
+			c = s.pickFullCompaction()
+		}
+	}
+
+	return c
+}
+
+// reserveInputs marks the inputs of the compaction as used until runCompaction returns. It must be called with sstableLock held.
+func (s *LSMTreeStore) reserveInputs(c *compaction) {
+	if s.compacting == nil {
+		s.compacting = make(map[*sstable.SSTable]bool)
+	}
+	for _, table := range c.inputs {
+		s.compacting[table] = true
+	}
+}
+
+// releaseInputs lets other compactions use the inputs of the compaction again
+func (s *LSMTreeStore) releaseInputs(c *compaction) {
+	s.sstableLock.Lock()
+	defer s.sstableLock.Unlock()
+
+	for _, table := range c.inputs {
+		delete(s.compacting, table)
+	}
+	s.compactionDone.Broadcast()
+}
+
+// anyCompacting reports whether one of the SSTables is an input of a running compaction
+func (s *LSMTreeStore) anyCompacting(tables []*sstable.SSTable) bool {
+	for _, table := range tables {
+		if s.compacting[table] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runCompaction runs the compaction, whose inputs are reserved. It must be called without sstableLock held:
+// the inputs are immutable and only reserved compactions delete them, so they are merged without the lock.
+//
+// Algorithm:
+//  1. Merge the inputs with a k-way merge over their iterators, in lookup order (by level, newest first within
+//     a level), so that each key comes once, in key order, with its newest version.
+//  2. Pass the live records to the CompactionFilter, a removed record becomes a tombstone.
+//     Drop tombstones (empty Value) when no SSTable outside the inputs can hold an older version of the key.
+//  3. Write the records into new SSTables of the output level as they come, starting a new SSTable once one
+//     holds maxOutputSize bytes, and fsync them.
+//  4. Atomically replace the inputs by the new SSTables in the manifest and in the live SSTables: the only step
+//     holding sstableLock, reads and flushes wait for it only.
+//  5. Close and delete the input SSTables.
+//
+// Only a data block per input and the SSTable being written are in memory, whatever the size of the inputs.
+// A crash before step 4 leaves the new SSTables as orphans and a crash after it leaves the inputs
+// as orphans; orphans are removed on startup, so the data is never lost. An error before step 4
+// removes the new SSTables and keeps the inputs live.
+func (s *LSMTreeStore) runCompaction(c *compaction) error {
+	defer s.releaseInputs(c)
+
+	if c.trivialMove() {
+		s.sstableLock.Lock()
+		defer s.sstableLock.Unlock()
+		return s.moveSSTable(c.inputs[0], c.outputLevel)
+	}
+
+	log.Printf("lsmtree: %s compaction starting, merging %d SSTables into level %d", c.reason, len(c.inputs), c.outputLevel)
+
+	inputs := append([]*sstable.SSTable(nil), c.inputs...)
+	sort.Slice(inputs, func(i, j int) bool {
+		if inputs[i].Level != inputs[j].Level {
+			return inputs[i].Level < inputs[j].Level
+		}
+		return inputs[i].Seq > inputs[j].Seq
+	})
+
+	// The merged tables keep the position of their inputs: they hold data up to their newest sequence number.
+	edit := &manifest.VersionEdit{}
+	out := &compactionOutputs{store: s, level: c.outputLevel, maxSize: c.maxOutputSize}
+	var entries uint64
+	for _, table := range inputs {
+		edit.RemovedTables = append(edit.RemovedTables, table.ID())
+		out.seq = max(out.seq, table.Seq)
+		if table.WriteTime.After(out.writeTime) {
+			out.writeTime = table.WriteTime
+		}
+		entries += table.NumEntries()
+	}
+	if out.maxSize == 0 && c.outputLevel > 0 {
+		// Every SSTable of level 0 is a sorted run, an output of level 0 stays whole
+		out.maxSize = s.config.MaxOutputFileSize
+	}
+	// The inputs hold at most as many keys as entries, the filters are sized for the whole output
+	s.sstableLock.RLock()
+	out.fpRate = s.filterFPRate(c.outputLevel, entries, inputs)
+	s.sstableLock.RUnlock()
+
+	merge := newMergeIterator(inputs)
+	for merge.Next() {
+		record := s.filterRecord(c, merge.Record())
+		if c.dropTombstones && len(record.Value) == 0 {
+			continue
+		}
+		if err := out.add(record); err != nil {
+			out.discard()
+			return err
+		}
+	}
+	if err := merge.Err(); err != nil {
+		// Merging without the unreadable records would drop them for good, keep the inputs instead
+		out.discard()
+		return fmt.Errorf("lsmtree: compaction: %w", err)
+	}
+	if err := out.finish(); err != nil {
+		out.discard()
+		return err
+	}
+	for _, output := range out.tables {
+		edit.AddedTables = append(edit.AddedTables, manifest.TableMeta{ID: output.ID(), Level: output.Level, Seq: output.Seq})
+	}
+
+	if err := s.compactionStep(stepOutputWritten); err != nil {
+		out.discard()
+		return fmt.Errorf("lsmtree: compaction: %w", err)
+	}
+
+	// Switch the live table set: once the edit is durable the inputs are no longer needed
+	s.sstableLock.Lock()
+	if err := s.manifest.Apply(edit); err != nil {
+		s.sstableLock.Unlock()
+		out.discard()
+		return fmt.Errorf("lsmtree: compaction: update manifest: %w", err)
+	}
+	s.replaceSSTables(inputs, out.tables)
+	s.sstableLock.Unlock()
+
+	if err := s.compactionStep(stepManifestUpdated); err != nil {
+		log.Printf("lsmtree: compaction: inputs left for the next startup: %v", err)
+		return nil
+	}
+
+	for _, table := range inputs {
+		if err := table.CloseAndDelete(); err != nil {
+			log.Printf("lsmtree: compaction: delete input SSTable %d: %v", table.ID(), err)
+		}
+		if err := s.compactionStep(stepInputDeleted); err != nil {
+			log.Printf("lsmtree: compaction: inputs left for the next startup: %v", err)
+			return nil
+		}
+	}
+
+	log.Printf("lsmtree: compaction done, %d records in %d SSTables", out.records, len(out.tables))
+	return nil
+}
+
+// filterRecord applies the CompactionFilter to a live record, a removed record becomes a tombstone
+func (s *LSMTreeStore) filterRecord(c *compaction, record kv.Record) kv.Record {
+	if s.config.CompactionFilter == nil || len(record.Value) == 0 {
+		return record
+	}
+
+	ctx := config.CompactionFilterContext{Level: c.outputLevel, Full: c.full, Manual: c.manual}
+	switch decision, value := s.config.CompactionFilter(ctx, record.Key, record.Value); decision {
+	case config.CompactionRemove:
+		return kv.Record{Key: record.Key, Value: kv.Value{}}
+	case config.CompactionChangeValue:
+		return kv.Record{Key: record.Key, Value: value}
+	default:
+		return record
+	}
+}
+
+// moveSSTable moves an SSTable to another level without rewriting it, only the manifest changes. It must be called with sstableLock held.
+func (s *LSMTreeStore) moveSSTable(table *sstable.SSTable, level int) error {
+	err := s.manifest.Apply(&manifest.VersionEdit{
+		RemovedTables: []uint64{table.ID()},
+		AddedTables:   []manifest.TableMeta{{ID: table.ID(), Level: level, Seq: table.Seq}},
+	})
+	if err != nil {
+		return fmt.Errorf("lsmtree: compaction: move SSTable %d: %w", table.ID(), err)
+	}
+
+	log.Printf("lsmtree: moved SSTable %d from level %d to level %d", table.ID(), table.Level, level)
+	table.Level = level
+	s.sortSSTables()
+
+	return nil
+}
+
+// replaceSSTables removes the inputs of a compaction from the live SSTables and adds its outputs
+func (s *LSMTreeStore) replaceSSTables(inputs, outputs []*sstable.SSTable) {
+	removed := make(map[*sstable.SSTable]bool, len(inputs))
+	for _, table := range inputs {
+		removed[table] = true
+	}
+
+	live := make([]*sstable.SSTable, 0, len(s.ssTables)-len(inputs)+len(outputs))
+	for _, table := range s.ssTables {
+		if !removed[table] {
+			live = append(live, table)
+		}
+	}
+	s.ssTables = append(live, outputs...)
+	s.sortSSTables()
+}
+
+/*
+compactionOutputs writes the records of a compaction in key order into new SSTables of the output level, with a
+filter of fpRate, the write time and sequence number of the newest input. An SSTable is finished once it holds
+maxSize bytes of keys and values, 0 for a single SSTable, and the next record starts a new one.
+*/
+type compactionOutputs struct {
+	store     *LSMTreeStore
+	level     int
+	seq       uint64
+	writeTime time.Time
+	fpRate    float64
+	maxSize   uint64
+
+	tables  []*sstable.SSTable // finished SSTables, durable and reopened for reads
+	current *sstable.SSTable   // SSTable being written, nil between two SSTables
+	writer  *sstable.Writer
+	records int
+}
+
+// add writes the record to the current SSTable, starting one when needed
+func (o *compactionOutputs) add(record kv.Record) error {
+	if o.current == nil {
+		o.current = sstable.NewSSTable(o.store.manifest.NewFileNumber(), o.store.config, o.store.dirConfig)
+		o.current.FilterFPRate = o.fpRate
+		o.current.WriteTime = o.writeTime
+
+		writer, err := o.current.NewWriter()
+		if err != nil {
+			o.current = nil
+			return fmt.Errorf("lsmtree: compaction: write SSTable: %w", err)
+		}
+		o.writer = writer
+	}
+
+	if err := o.writer.Add(record); err != nil {
+		return fmt.Errorf("lsmtree: compaction: write SSTable %d: %w", o.current.ID(), err)
+	}
+	o.records++
+
+	if o.maxSize > 0 && o.writer.Size() >= o.maxSize {
+		return o.finish()
+	}
+
+	return nil
+}
+
+// finish makes the current SSTable durable and reopens it, so reads go through the file that was just made durable
+func (o *compactionOutputs) finish() error {
+	if o.current == nil {
+		return nil
+	}
+
+	table, id := o.current, o.current.ID()
+	err := o.writer.Finish()
+	o.current, o.writer = nil, nil
+	if err == nil {
+		err = table.Sync()
+	}
+	if err != nil {
+		table.Close()
+		if deleteErr := sstable.DeleteFiles(id, o.store.dirConfig); deleteErr != nil {
+			log.Printf("lsmtree: compaction: remove SSTable %d: %v", id, deleteErr)
+		}
+		return fmt.Errorf("lsmtree: compaction: write SSTable %d: %w", id, err)
+	}
+
+	if err := table.Close(); err != nil {
+		log.Printf("lsmtree: compaction: error closing new SSTable: %v", err)
+	}
+
+	output := sstable.NewSSTable(id, o.store.config, o.store.dirConfig)
+	output.Level = o.level
+	output.Seq = o.seq
+	o.tables = append(o.tables, output)
+
+	return nil
+}
+
+// discard removes the SSTables of a compaction that did not reach the manifest, the one being written included
+func (o *compactionOutputs) discard() {
+	if o.writer != nil {
+		o.writer.Abort()
+		o.current, o.writer = nil, nil
+	}
+
+	for _, output := range o.tables {
+		if err := output.CloseAndDelete(); err != nil {
+			log.Printf("lsmtree: compaction: remove SSTable %d: %v", output.ID(), err)
+		}
+	}
+	o.tables = nil
+}
+
+// compactionStep runs the compaction hook, if any, once a compaction reached the given step
+func (s *LSMTreeStore) compactionStep(step compactionStep) error {
+	if s.compactionHook == nil {
+		return nil
+	}
+
+	return s.compactionHook(step)
+}
@@ -0,0 +1,148 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/stretchr/testify/require"
+)
+
+// errInjected is returned by a compaction hook to make a compaction step fail
+var errInjected = errors.New("injected failure")
+
+// crashPanic is the value a compaction hook panics with to simulate the process dying at a step
+type crashPanic struct {
+	step compactionStep
+}
+
+func TestCompactionCrash(t *testing.T) {
+	for _, step := range []compactionStep{stepOutputWritten, stepManifestUpdated, stepInputDeleted} {
+		t.Run(fmt.Sprintf("crash at %s", step), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "compaction-crash-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			testCrashAtStep(t, dir, step)
+		})
+	}
+
+	t.Run("failure before the manifest switch keeps the inputs", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "compaction-crash-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		testFailureKeepsInputs(t, dir)
+	})
+}
+
+func testCrashAtStep(t *testing.T, dir string, step compactionStep) {
+	store := openStoreAt(dir)
+	expected := writeCompactionDataset(store)
+
+	store.compactionHook = func(current compactionStep) error {
+		if current == step {
+			panic(crashPanic{step: step})
+		}
+		return nil
+	}
+	require.PanicsWithValue(t, crashPanic{step: step}, func() {
+		store.Compact()
+	})
+	crash(t, store)
+
+	store = openStoreAt(dir)
+	defer store.Close()
+
+	requireDataset(t, store, expected)
+	requireNoOrphans(t, store)
+
+	require.NoError(t, store.Compact())
+	require.Equal(t, 1, sstableCount(store))
+	requireDataset(t, store, expected)
+	requireNoOrphans(t, store)
+}
+
+func testFailureKeepsInputs(t *testing.T, dir string) {
+	store := openStoreAt(dir)
+	expected := writeCompactionDataset(store)
+	before := sstableCount(store)
+
+	store.compactionHook = func(current compactionStep) error {
+		if current == stepOutputWritten {
+			return errInjected
+		}
+		return nil
+	}
+	require.ErrorIs(t, store.Compact(), errInjected)
+	require.Equal(t, before, sstableCount(store))
+	requireDataset(t, store, expected)
+	requireNoOrphans(t, store)
+	require.NoError(t, store.Close())
+
+	store = openStoreAt(dir)
+	defer store.Close()
+
+	require.Equal(t, before, sstableCount(store))
+	requireDataset(t, store, expected)
+}
+
+// writeCompactionDataset writes overwrites and deletes spread over several SSTables and returns the expected content
+func writeCompactionDataset(store *LSMTreeStore) map[kv.Key]kv.Value {
+	expected := make(map[kv.Key]kv.Value)
+
+	for batch := 0; batch < 4; batch++ {
+		prefix := fmt.Sprintf("b%d", batch)
+		forceFlush(store, prefix, 6)
+		for i := 0; i < 6; i++ {
+			expected[kv.Key(fmt.Sprintf("%s_k%d", prefix, i))] = kv.Value(fmt.Sprintf("%s_v%d", prefix, i))
+		}
+	}
+
+	store.Set(kv.Key("b0_k1"), kv.Value("new"))
+	expected["b0_k1"] = kv.Value("new")
+	store.Delete(kv.Key("b1_k2"))
+	expected["b1_k2"] = nil
+	forceFlush(store, "tail", 6)
+	for i := 0; i < 6; i++ {
+		expected[kv.Key(fmt.Sprintf("tail_k%d", i))] = kv.Value(fmt.Sprintf("tail_v%d", i))
+	}
+
+	return expected
+}
+
+// crash releases the WAL and the manifest the way the process dying would, leaving every SSTable file as it is
+func crash(t *testing.T, store *LSMTreeStore) {
+	t.Helper()
+
+	store.WaitForFlush()
+	require.NoError(t, store.wal.Close())
+	require.NoError(t, store.manifest.Close())
+}
+
+func requireDataset(t *testing.T, store *LSMTreeStore, expected map[kv.Key]kv.Value) {
+	t.Helper()
+
+	for key, value := range expected {
+		got, found := store.Get(key)
+		if value == nil {
+			require.False(t, found, "deleted key %s is visible", key)
+			continue
+		}
+		require.True(t, found, "key %s is missing", key)
+		require.Equal(t, value, got)
+	}
+}
+
+// requireNoOrphans checks that every SSTable on disk is live in the manifest
+func requireNoOrphans(t *testing.T, store *LSMTreeStore) {
+	t.Helper()
+
+	ssTableIds, err := store.listSSTableIds()
+	require.NoError(t, err)
+	for _, ssTableId := range ssTableIds {
+		require.True(t, store.manifest.Contains(ssTableId), "SSTable %d is not in the manifest", ssTableId)
+	}
+}
@@ -1,12 +1,18 @@
 package lsmtree
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,7 +30,6 @@ func newCompactionStore(t *testing.T, compactionThreshold int) (*LSMTreeStore, f
 	appConfig := &config.Config{
 		MemTableSizeThreshold: 10,
 		SSTableBlockSize:      40,
-		SparseWALBufferSize:   10,
 		BloomFilterSize:       1000,
 		BloomFilterHashCount:  3,
 		RootDataDir:           dir,
@@ -75,6 +80,17 @@ func TestCompaction(t *testing.T) {
 		"Compact drops tombstones":                                testCompactionDropsTombstones,
 		"Compact deduplicates keys keeping newest value":          testCompactionDeduplicatesKeys,
 		"Auto compaction triggered after flush exceeds threshold": testAutoCompactionTriggeredOnFlush,
+		"Compact keeps the inputs when a block is corrupted":      testCompactionKeepsCorruptedInputs,
+		"a corrupted newer SSTable stops a lookup":                testCorruptedSSTableStopsLookup,
+		"Compact keeps an SSTable that cannot be opened":          testCompactionKeepsUnopenedTables,
+		"Compact splits its output at MaxOutputFileSize":          testCompactionSplitsOutput,
+		"auto compaction leaves a split output alone":             testAutoCompactionKeepsSplitOutput,
+		"merge returns the newest version of each key":            testMergeIterator,
+		"CompactRange rewrites only the SSTables of the range":    testCompactRange,
+		"CompactRangeTo writes the range to the target level":     testCompactRangeTo,
+		"CompactRange flushes the memTable of the range first":    testCompactRangeFlushesMemTable,
+		"compaction filter keeps, removes and rewrites records":   testCompactionFilter,
+		"a removed record masks its older versions":               testCompactionFilterKeepsTombstones,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			fn(t)
@@ -229,3 +245,400 @@ func testAutoCompactionTriggeredOnFlush(t *testing.T) {
 		}
 	}
 }
+
+// testCompactionKeepsCorruptedInputs verifies that a compaction reading a corrupted
+// block fails with a CorruptionError instead of dropping the records of the block.
+func testCompactionKeepsCorruptedInputs(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+	store.config.VerifyChecksums = true
+
+	forceFlush(store, "a", 5)
+	forceFlush(store, "b", 5)
+	before := sstableCount(store)
+	require.Greater(t, before, 1)
+
+	// Flip a byte of the first data block of the oldest SSTable
+	store.sstableLock.RLock()
+	oldest := store.ssTables[len(store.ssTables)-1]
+	store.sstableLock.RUnlock()
+	tablePath := path.Join(store.dirConfig.SSTableDir, fmt.Sprintf("%d%s", oldest.ID(), sstable.TableFileExt))
+	data, err := os.ReadFile(tablePath)
+	require.NoError(t, err)
+	data[1] ^= 0xff
+	require.NoError(t, os.WriteFile(tablePath, data, 0644))
+
+	err = store.Compact()
+	var corruption *sstable.CorruptionError
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, tablePath, corruption.Path)
+	require.Equal(t, before, sstableCount(store))
+	requireNoOrphans(t, store)
+
+	_, err = store.Scan(kv.Key(""), kv.Key(""))
+	require.ErrorAs(t, err, &corruption)
+}
+
+// testCompactionKeepsUnopenedTables verifies that an SSTable with a corrupted footer stops the store from opening,
+// and that Compact fails rather than merging it as an empty table and deleting its file.
+func testCompactionKeepsUnopenedTables(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+
+	forceFlush(store, "a", 5)
+	forceFlush(store, "b", 5)
+	before := sstableCount(store)
+	require.Greater(t, before, 1)
+
+	// Flip the last byte of the footer magic of the oldest SSTable
+	store.sstableLock.Lock()
+	oldest := store.ssTables[len(store.ssTables)-1]
+	tablePath := path.Join(store.dirConfig.SSTableDir, fmt.Sprintf("%d%s", oldest.ID(), sstable.TableFileExt))
+	data, err := os.ReadFile(tablePath)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(tablePath, data, 0644))
+
+	require.Panics(t, func() {
+		NewStore(store.config, &config.DirectoryConfig{WALDir: "wal", SSTableDir: "sstables", SparseIndexDir: "indexes"})
+	})
+
+	// A table that cannot be opened fails every read
+	unopened := sstable.NewSSTable(oldest.ID(), store.config, store.dirConfig)
+	unopened.Level, unopened.Seq = oldest.Level, oldest.Seq
+	require.NoError(t, oldest.Close())
+	store.ssTables[len(store.ssTables)-1] = unopened
+	store.sstableLock.Unlock()
+
+	err = store.Compact()
+	var corruption *sstable.CorruptionError
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, tablePath, corruption.Path)
+	require.Equal(t, before, sstableCount(store))
+	require.FileExists(t, tablePath)
+
+	_, _, err = store.Lookup(kv.Key("a_k0"))
+	require.ErrorAs(t, err, &corruption)
+}
+
+// testCorruptedSSTableStopsLookup verifies that a corrupted block of a newer SSTable is reported
+// instead of returning the older version of the key from an older SSTable.
+func testCorruptedSSTableStopsLookup(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+
+	writeSSTable(t, store, 0, 1, []kv.Record{{Key: "k", Value: kv.Value("old")}})
+	newer := writeSSTable(t, store, 0, 2, []kv.Record{{Key: "k", Value: kv.Value("new")}})
+
+	tablePath := path.Join(store.dirConfig.SSTableDir, fmt.Sprintf("%d%s", newer.ID(), sstable.TableFileExt))
+	data, err := os.ReadFile(tablePath)
+	require.NoError(t, err)
+	data[1] ^= 0xff
+	require.NoError(t, os.WriteFile(tablePath, data, 0644))
+
+	_, _, err = store.Lookup(kv.Key("k"))
+	var corruption *sstable.CorruptionError
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, tablePath, corruption.Path)
+
+	_, found := store.Get(kv.Key("k"))
+	require.False(t, found)
+}
+
+// testCompactionSplitsOutput verifies that a compaction starts a new SSTable once
+// one holds MaxOutputFileSize bytes, giving SSTables with disjoint key ranges.
+func testCompactionSplitsOutput(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+	store.config.MaxOutputFileSize = 40
+
+	forceFlush(store, "a", 20)
+	forceFlush(store, "b", 20)
+	require.NoError(t, store.Compact())
+
+	store.sstableLock.RLock()
+	tables := append([]*sstable.SSTable(nil), store.ssTables...)
+	store.sstableLock.RUnlock()
+
+	// Records are at most 10 bytes, an SSTable is cut once it holds 40 bytes
+	require.Greater(t, len(tables), 5)
+	for _, table := range tables {
+		require.Equal(t, 1, table.Level)
+		require.Less(t, table.Size(), uint64(50))
+	}
+	requireLevelsSorted(t, store)
+	requireNoOrphans(t, store)
+
+	for _, prefix := range []string{"a", "b"} {
+		for i := 0; i < 20; i++ {
+			value, found := store.Get(kv.Key(fmt.Sprintf("%s_k%d", prefix, i)))
+			require.True(t, found)
+			require.Equal(t, kv.Value(fmt.Sprintf("%s_v%d", prefix, i)), value)
+		}
+	}
+}
+
+// testAutoCompactionKeepsSplitOutput verifies that the SSTables written by a full compaction split at
+// MaxOutputFileSize count as a single sorted run, so the scheduler does not compact them again and again.
+func testAutoCompactionKeepsSplitOutput(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 2)
+	defer cleanup()
+	store.config.MaxOutputFileSize = 40
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forceFlush(store, "a", 20)
+		forceFlush(store, "b", 20)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the compactions did not settle")
+	}
+
+	ids := func() []uint64 {
+		store.sstableLock.RLock()
+		defer store.sstableLock.RUnlock()
+
+		var ids []uint64
+		for _, table := range store.ssTables {
+			require.Equal(t, 1, table.Level)
+			ids = append(ids, table.ID())
+		}
+		return ids
+	}
+	before := ids()
+	require.Greater(t, len(before), 1)
+
+	runCompactions(store)
+	require.Equal(t, before, ids())
+	requireLevelsSorted(t, store)
+}
+
+// testMergeIterator verifies that the k-way merge of SSTables given in lookup order
+// returns every key once, in key order, with the value of the first SSTable holding it.
+func testMergeIterator(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+
+	writeSSTable(t, store, 1, 1, []kv.Record{{Key: "a", Value: kv.Value("1")}, {Key: "c", Value: kv.Value("1")}, {Key: "e", Value: kv.Value("1")}})
+	writeSSTable(t, store, 0, 2, []kv.Record{{Key: "b", Value: kv.Value("2")}, {Key: "c", Value: kv.Value{}}})
+	writeSSTable(t, store, 0, 3, []kv.Record{{Key: "a", Value: kv.Value("3")}, {Key: "d", Value: kv.Value("3")}})
+
+	store.sstableLock.RLock()
+	merge := newMergeIterator(store.ssTables)
+	store.sstableLock.RUnlock()
+
+	var records []kv.Record
+	for merge.Next() {
+		records = append(records, merge.Record())
+	}
+	require.NoError(t, merge.Err())
+	require.Equal(t, []kv.Record{
+		{Key: "a", Value: kv.Value("3")},
+		{Key: "b", Value: kv.Value("2")},
+		{Key: "c", Value: kv.Value{}},
+		{Key: "d", Value: kv.Value("3")},
+		{Key: "e", Value: kv.Value("1")},
+	}, records)
+}
+
+// testCompactRange verifies that CompactRange merges the SSTables overlapping
+// the range, and those overlapping them, drops their tombstones and leaves the others untouched.
+func testCompactRange(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+
+	a := addSSTable(t, store, 1, 1, "a", 10)
+	addSSTable(t, store, 1, 2, "b", 10)
+	c := addSSTable(t, store, 1, 3, "c", 10)
+	d := addSSTable(t, store, 0, 4, "d", 10)
+	var tombstones []kv.Record
+	for i := 0; i < 10; i++ {
+		tombstones = append(tombstones, kv.Record{Key: kv.Key(fmt.Sprintf("b%04d", i)), Value: kv.Value{}})
+	}
+	tombstones = append(tombstones, kv.Record{Key: "c0000", Value: kv.Value("new")})
+	writeSSTable(t, store, 0, 6, tombstones)
+
+	// A range whose end is not after its start selects nothing and is refused
+	before := sstableCount(store)
+	require.Error(t, store.CompactRange(kv.Key("b9"), kv.Key("b")))
+	require.Error(t, store.CompactRange(kv.Key("b"), kv.Key("b")))
+	require.Equal(t, before, sstableCount(store))
+
+	// The tombstones of b reach c0000, so the SSTable of c is merged too
+	require.NoError(t, store.CompactRange(kv.Key("b"), kv.Key("b9")))
+
+	store.sstableLock.RLock()
+	live := append([]*sstable.SSTable(nil), store.ssTables...)
+	store.sstableLock.RUnlock()
+	require.Len(t, live, 3)
+	require.Contains(t, live, a)
+	require.Contains(t, live, d)
+	require.NotContains(t, live, c)
+	for _, table := range live {
+		require.Zero(t, table.NumTombstones())
+	}
+	// Lookup order: d in L0, then the output holding the newest data of L1, then a
+	require.Equal(t, []*sstable.SSTable{d, a}, []*sstable.SSTable{live[0], live[2]})
+	merged := live[1]
+	require.Equal(t, 1, merged.Level)
+	require.Equal(t, uint64(6), merged.Seq)
+	require.Equal(t, uint64(10), merged.NumEntries())
+	requireNoOrphans(t, store)
+
+	_, found := store.Get(kv.Key("b0003"))
+	require.False(t, found)
+	value, found := store.Get(kv.Key("c0000"))
+	require.True(t, found)
+	require.Equal(t, kv.Value("new"), value)
+	_, found = store.Get(kv.Key("a0003"))
+	require.True(t, found)
+
+	// Nothing overlaps the range
+	require.NoError(t, store.CompactRange(kv.Key("x"), kv.Key("")))
+	require.Equal(t, 3, sstableCount(store))
+}
+
+// testCompactRangeTo verifies that CompactRangeTo writes the merged SSTables to the given level
+func testCompactRangeTo(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	addSSTable(t, store, 0, 2, "a", 5)
+	b := addSSTable(t, store, 0, 3, "b", 10)
+
+	require.Error(t, store.CompactRangeTo(kv.Key("a"), kv.Key("b"), store.maxLevels()))
+	require.NoError(t, store.CompactRangeTo(kv.Key("a"), kv.Key("b"), 3))
+
+	store.sstableLock.RLock()
+	defer store.sstableLock.RUnlock()
+	require.Len(t, store.ssTables, 2)
+	require.Equal(t, b, store.ssTables[0])
+	require.Equal(t, 3, store.ssTables[1].Level)
+	require.Equal(t, uint64(10), store.ssTables[1].NumEntries())
+}
+
+// testCompactRangeFlushesMemTable verifies that CompactRange also compacts the writes of the range still in the
+// memTable, and leaves a memTable without keys of the range alone
+func testCompactRangeFlushesMemTable(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+
+	addSSTable(t, store, 1, 1, "b", 10)
+	store.Delete(kv.Key("b0003"))
+
+	require.NoError(t, store.CompactRange(kv.Key("b"), kv.Key("b9")))
+
+	store.sstableLock.RLock()
+	require.Len(t, store.ssTables, 1)
+	merged := store.ssTables[0]
+	store.sstableLock.RUnlock()
+	require.Equal(t, 1, merged.Level)
+	require.Equal(t, uint64(9), merged.NumEntries())
+	require.Zero(t, merged.NumTombstones())
+	require.Zero(t, store.memTable.Size())
+	_, found := store.Get(kv.Key("b0003"))
+	require.False(t, found)
+
+	store.Set(kv.Key("z"), kv.Value("1"))
+	require.NoError(t, store.CompactRange(kv.Key("a"), kv.Key("c")))
+	_, found = store.memTable.Get(kv.Key("z"))
+	require.True(t, found)
+	require.Equal(t, 1, sstableCount(store))
+}
+
+// testCompactionFilter verifies that the CompactionFilter decides the fate of every live
+// record a compaction writes, and gets the context of the compaction.
+func testCompactionFilter(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+
+	var lock sync.Mutex
+	var contexts []config.CompactionFilterContext
+	var keys []kv.Key
+	store.config.CompactionFilter = func(ctx config.CompactionFilterContext, key kv.Key, value kv.Value) (config.CompactionDecision, kv.Value) {
+		lock.Lock()
+		defer lock.Unlock()
+		contexts = append(contexts, ctx)
+		keys = append(keys, key)
+
+		switch {
+		case strings.HasPrefix(string(key), "a"):
+			return config.CompactionRemove, nil
+		case strings.HasPrefix(string(key), "b"):
+			return config.CompactionChangeValue, bytes.ToUpper(value)
+		default:
+			return config.CompactionKeep, nil
+		}
+	}
+
+	addSSTable(t, store, 0, 1, "a", 3)
+	writeSSTable(t, store, 0, 2, []kv.Record{{Key: "b0000", Value: kv.Value("x")}, {Key: "b0001", Value: kv.Value{}}})
+	writeSSTable(t, store, 0, 3, []kv.Record{{Key: "c0000", Value: kv.Value("c")}})
+	require.NoError(t, store.Compact())
+
+	// Tombstones are not filtered
+	require.Equal(t, []kv.Key{"a0000", "a0001", "a0002", "b0000", "c0000"}, keys)
+	for _, ctx := range contexts {
+		require.Equal(t, config.CompactionFilterContext{Level: 1, Full: true, Manual: true}, ctx)
+	}
+
+	store.sstableLock.RLock()
+	require.Len(t, store.ssTables, 1)
+	require.Zero(t, store.ssTables[0].NumTombstones())
+	require.Equal(t, uint64(2), store.ssTables[0].NumEntries())
+	store.sstableLock.RUnlock()
+
+	_, found := store.Get(kv.Key("a0001"))
+	require.False(t, found)
+	value, found := store.Get(kv.Key("b0000"))
+	require.True(t, found)
+	require.Equal(t, kv.Value("X"), value)
+	value, found = store.Get(kv.Key("c0000"))
+	require.True(t, found)
+	require.Equal(t, kv.Value("c"), value)
+
+	// A range compaction of part of the store is not full
+	addSSTable(t, store, 0, 4, "d", 1)
+	contexts = nil
+	require.NoError(t, store.CompactRange(kv.Key("d"), kv.Key("")))
+	require.Equal(t, []config.CompactionFilterContext{{Level: 0, Full: false, Manual: true}}, contexts)
+}
+
+// testCompactionFilterKeepsTombstones verifies that a record removed by the filter while
+// an older version of the key is outside the compaction is written as a tombstone.
+func testCompactionFilterKeepsTombstones(t *testing.T) {
+	store, cleanup := newCompactionStore(t, 0)
+	defer cleanup()
+
+	store.config.CompactionFilter = func(ctx config.CompactionFilterContext, key kv.Key, value kv.Value) (config.CompactionDecision, kv.Value) {
+		require.False(t, ctx.Full)
+		require.False(t, ctx.Manual)
+		if key == "k" {
+			return config.CompactionRemove, nil
+		}
+		return config.CompactionKeep, nil
+	}
+
+	writeSSTable(t, store, 1, 1, []kv.Record{{Key: "k", Value: kv.Value("old")}})
+	newer := []*sstable.SSTable{
+		writeSSTable(t, store, 0, 2, []kv.Record{{Key: "k", Value: kv.Value("new")}}),
+		writeSSTable(t, store, 0, 3, []kv.Record{{Key: "l", Value: kv.Value("l")}}),
+	}
+
+	store.sstableLock.Lock()
+	c := &compaction{inputs: newer, reason: "test", full: len(newer) == len(store.ssTables)}
+	store.reserveInputs(c)
+	store.sstableLock.Unlock()
+	require.NoError(t, store.runCompaction(c))
+
+	_, found := store.Get(kv.Key("k"))
+	require.False(t, found, "the old value is masked")
+	store.sstableLock.RLock()
+	defer store.sstableLock.RUnlock()
+	require.Len(t, store.ssTables, 2)
+	require.Equal(t, uint64(1), store.ssTables[0].NumTombstones())
+}
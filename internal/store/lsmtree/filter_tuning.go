@@ -0,0 +1,113 @@
+package lsmtree
+
+import (
+	"fmt"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/filter"
+)
+
+// LevelFilterStats describes the filters of the SSTables of one level
+type LevelFilterStats struct {
+	Level       int
+	Tables      int
+	Keys        uint64
+	FilterBytes uint64
+	BitsPerKey  float64
+
+	// ExpectedFPRate is the expected number of SSTables of the level a lookup of an absent key reads for nothing,
+	// the sum of the false-positive rates of their filters
+	ExpectedFPRate float64
+}
+
+// FilterReport returns the filter statistics of every level holding SSTables, ordered by level
+func (s *LSMTreeStore) FilterReport() []LevelFilterStats {
+	s.sstableLock.RLock()
+	defer s.sstableLock.RUnlock()
+
+	var report []LevelFilterStats
+	for _, table := range s.ssTables {
+		for len(report) <= table.Level {
+			report = append(report, LevelFilterStats{Level: len(report)})
+		}
+
+		size, fpRate := table.FilterStats()
+		if fpRate == 0 {
+			fpRate = s.config.FilterFPRate
+		}
+
+		stats := &report[table.Level]
+		stats.Tables++
+		stats.Keys += table.NumEntries()
+		stats.FilterBytes += size
+		stats.ExpectedFPRate += min(fpRate, 1)
+	}
+
+	levels := report[:0]
+	for _, stats := range report {
+		if stats.Tables > 0 {
+			if stats.Keys > 0 {
+				stats.BitsPerKey = float64(8*stats.FilterBytes) / float64(stats.Keys)
+			}
+			levels = append(levels, stats)
+		}
+	}
+
+	return levels
+}
+
+/*
+checkFilterMemoryBudget refuses a FilterMemoryBudget with a FilterPolicy other than Bloom filters: the budget is split
+with the bits per key of Bloom filters, other policies would get rates that do not match the memory they use.
+*/
+func checkFilterMemoryBudget(cfg *config.Config) error {
+	if cfg.FilterMemoryBudget == 0 || cfg.FilterPolicy == nil {
+		return nil
+	}
+	if _, ok := cfg.FilterPolicy.(filter.BloomPolicy); ok {
+		return nil
+	}
+
+	return fmt.Errorf("lsmtree: FilterMemoryBudget needs the bloom filter policy, not %s", cfg.FilterPolicy.Name())
+}
+
+/*
+filterFPRate returns the false-positive rate of the filter of a new SSTable of the given level holding keys keys,
+once the replaced SSTables are gone. It is 0, the configured FilterFPRate, when there is no filter memory budget.
+
+The budget is split by filter.AllocateFPRates between the sorted runs a lookup reads, so smaller runs get more
+bits per key: every SSTable of level 0 is a run of its own, the SSTables of a deeper level form a single run.
+The filter of a table is built once, so the split is recomputed for every new table as the tree grows.
+*/
+func (s *LSMTreeStore) filterFPRate(level int, keys uint64, replaced []*sstable.SSTable) float64 {
+	if s.config.FilterMemoryBudget == 0 {
+		return 0
+	}
+
+	skip := make(map[*sstable.SSTable]bool, len(replaced))
+	for _, table := range replaced {
+		skip[table] = true
+	}
+
+	// runs[0] is the new table, or the level it joins
+	runs := []uint64{keys}
+	levelRuns := make(map[int]int)
+	for _, table := range s.ssTables {
+		if skip[table] {
+			continue
+		}
+		if table.Level == level && level > 0 {
+			runs[0] += table.NumEntries()
+			continue
+		}
+		if run, ok := levelRuns[table.Level]; ok && table.Level > 0 {
+			runs[run] += table.NumEntries()
+			continue
+		}
+		levelRuns[table.Level] = len(runs)
+		runs = append(runs, table.NumEntries())
+	}
+
+	return filter.AllocateFPRates(runs, 8*s.config.FilterMemoryBudget)[0]
+}
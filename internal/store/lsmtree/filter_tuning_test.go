@@ -0,0 +1,76 @@
+package lsmtree
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/filter"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterTuning(t *testing.T) {
+	t.Run("without a budget every table has the configured rate", func(t *testing.T) {
+		store, cleanup := newCompactionStore(t, 0)
+		defer cleanup()
+		store.config.FilterFPRate = 0.01
+
+		forceFlush(store, "a", 20)
+
+		report := store.FilterReport()
+		require.Len(t, report, 1)
+		require.Equal(t, 0, report[0].Level)
+		require.Equal(t, sstableCount(store), report[0].Tables)
+		require.InDelta(t, 0.01*float64(report[0].Tables), report[0].ExpectedFPRate, 1e-9)
+	})
+
+	t.Run("smaller levels get more bits per key", func(t *testing.T) {
+		store, cleanup := newCompactionStore(t, 0)
+		defer cleanup()
+		store.config.FilterFPRate = 0.01
+		store.config.FilterMemoryBudget = 100
+
+		forceFlush(store, "a", 60)
+		require.NoError(t, store.Compact())
+		forceFlush(store, "b", 6)
+
+		report := store.FilterReport()
+		require.Len(t, report, 2)
+		l0, l1 := report[0], report[1]
+		require.Greater(t, l1.Keys, l0.Keys)
+		require.Equal(t, 1, l1.Tables)
+		require.Greater(t, l0.BitsPerKey, l1.BitsPerKey)
+
+		// The filters stay within the budget, give or take the header and word rounding of each filter
+		require.LessOrEqual(t, l0.FilterBytes+l1.FilterBytes, uint64(100+40*(l0.Tables+1)))
+
+		// The rates are recorded in the tables
+		for _, table := range store.ssTables {
+			_, fpRate := table.FilterStats()
+			require.Greater(t, fpRate, 0.0)
+		}
+	})
+
+	t.Run("a budget needs bloom filters", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "filter-tuning-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		for _, policy := range []filter.FilterPolicy{filter.CuckooPolicy{}, filter.XorPolicy{}} {
+			require.PanicsWithError(t, fmt.Sprintf("lsmtree: FilterMemoryBudget needs the bloom filter policy, not %s", policy.Name()), func() {
+				openLeveledStoreAt(dir, func(cfg *config.Config) {
+					cfg.FilterPolicy = policy
+					cfg.FilterMemoryBudget = 100
+				})
+			})
+		}
+
+		store := openLeveledStoreAt(dir, func(cfg *config.Config) {
+			cfg.FilterPolicy = filter.BloomPolicy{Size: 1000, HashCount: 3}
+			cfg.FilterMemoryBudget = 100
+		})
+		require.NoError(t, store.Close())
+	})
+}
@@ -0,0 +1,260 @@
+package lsmtree
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+)
+
+const (
+	defaultMaxLevels           = 7
+	defaultLevelBaseSize       = 10 << 20
+	defaultLevelSizeMultiplier = 10
+	defaultTargetFileSize      = 2 << 20
+)
+
+/*
+Leveled compaction, as in LevelDB and RocksDB:
+  - L0 holds the SSTables written by flushes, their key ranges overlap
+  - every level from L1 on holds SSTables of about TargetFileSize with non-overlapping key ranges,
+    so a lookup reads at most one SSTable per level
+  - the size of L1 is bounded by LevelBaseSize and every deeper level by LevelSizeMultiplier times the previous bound
+
+Every level gets a score: the number of L0 SSTables over CompactionThreshold for L0, the size of the level over its
+bound for the others. The level with the highest score of at least 1 is compacted into the next one:
+all of L0, or a single SSTable of a deeper level, is merged with the SSTables of the next level it overlaps.
+An SSTable that overlaps nothing in the next level is moved there without being rewritten.
+A record is written once per level, instead of once per full compaction of the whole store.
+*/
+
+// LevelStats describes the SSTables of one level
+type LevelStats struct {
+	Level  int
+	Tables int
+	Size   uint64  // bytes of keys and values
+	Score  float64 // the level is compacted when its score reaches 1, 0 for the last level
+}
+
+// LevelReport returns the statistics of every level, including empty ones, as seen by leveled compaction
+func (s *LSMTreeStore) LevelReport() []LevelStats {
+	s.sstableLock.RLock()
+	defer s.sstableLock.RUnlock()
+
+	scores := s.levelScores()
+	report := make([]LevelStats, s.maxLevels())
+	for level := range report {
+		report[level] = LevelStats{Level: level, Score: scores[level]}
+	}
+	for _, table := range s.ssTables {
+		level := min(table.Level, len(report)-1)
+		report[level].Tables++
+		report[level].Size += table.Size()
+	}
+
+	return report
+}
+
+/*
+pickLeveledCompaction returns the compaction of the level with the highest score of at least 1, nil when no level
+needs one. A level whose SSTables are used by a running compaction leaves its turn to the next highest score.
+*/
+func (s *LSMTreeStore) pickLeveledCompaction() *compaction {
+	scores := s.levelScores()
+	var levels []int
+	for level, score := range scores {
+		if score >= 1 {
+			levels = append(levels, level)
+		}
+	}
+	sort.SliceStable(levels, func(i, j int) bool {
+		return scores[levels[i]] > scores[levels[j]]
+	})
+
+	for _, level := range levels {
+		if c := s.leveledCompaction(level, scores[level]); c != nil {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// leveledCompaction returns the compaction of the level into the next one, nil when its inputs are used by a running compaction
+func (s *LSMTreeStore) leveledCompaction(level int, score float64) *compaction {
+	c := &compaction{
+		outputLevel:   level + 1,
+		maxOutputSize: s.targetFileSize(),
+		reason:        fmt.Sprintf("level %d score %.2f", level, score),
+	}
+	if level == 0 {
+		c.inputs = s.levelTables(0)
+	} else {
+		table := s.nextTableToCompact(level)
+		if table == nil {
+			return nil
+		}
+		c.inputs = []*sstable.SSTable{table}
+	}
+
+	start, end := keySpan(c.inputs)
+	c.inputs = append(c.inputs, s.overlappingTables(c.outputLevel, start, end)...)
+	if s.anyCompacting(c.inputs) {
+		return nil
+	}
+	c.dropTombstones = !s.overlapsDeeperLevels(c.outputLevel, start, end)
+
+	if level > 0 {
+		if s.compactPointers == nil {
+			s.compactPointers = make(map[int]kv.Key)
+		}
+		_, s.compactPointers[level] = c.inputs[0].KeyRange()
+	}
+
+	return c
+}
+
+/*
+nextTableToCompact returns the SSTable of the level following the last one compacted out of it, wrapping around,
+so that compactions of a level go round its key space instead of always rewriting the same keys.
+SSTables used by a running compaction are skipped, it returns nil when every SSTable of the level is.
+*/
+func (s *LSMTreeStore) nextTableToCompact(level int) *sstable.SSTable {
+	var free []*sstable.SSTable
+	for _, table := range s.levelTables(level) {
+		if !s.compacting[table] {
+			free = append(free, table)
+		}
+	}
+	if len(free) == 0 {
+		return nil
+	}
+
+	if pointer, ok := s.compactPointers[level]; ok {
+		for _, table := range free {
+			if smallest, _ := table.KeyRange(); smallest > pointer {
+				return table
+			}
+		}
+	}
+
+	return free[0]
+}
+
+// levelScores returns the score of every level, see the description of leveled compaction
+func (s *LSMTreeStore) levelScores() []float64 {
+	scores := make([]float64, s.maxLevels())
+	sizes := make([]uint64, len(scores))
+	l0Tables := 0
+	for _, table := range s.ssTables {
+		if table.Level == 0 {
+			l0Tables++
+		}
+		sizes[min(table.Level, len(sizes)-1)] += table.Size()
+	}
+
+	if s.config.CompactionThreshold > 0 {
+		scores[0] = float64(l0Tables) / float64(s.config.CompactionThreshold)
+	}
+	for level := 1; level < len(scores)-1; level++ {
+		scores[level] = float64(sizes[level]) / float64(s.maxLevelSize(level))
+	}
+
+	return scores
+}
+
+// levelTables returns the SSTables of the level, sorted by smallest key
+func (s *LSMTreeStore) levelTables(level int) []*sstable.SSTable {
+	var tables []*sstable.SSTable
+	for _, table := range s.ssTables {
+		if table.Level == level {
+			tables = append(tables, table)
+		}
+	}
+
+	sort.SliceStable(tables, func(i, j int) bool {
+		smallestI, _ := tables[i].KeyRange()
+		smallestJ, _ := tables[j].KeyRange()
+		return smallestI < smallestJ
+	})
+
+	return tables
+}
+
+// overlappingTables returns the SSTables of the level that may hold keys in [start, end)
+func (s *LSMTreeStore) overlappingTables(level int, start, end kv.Key) []*sstable.SSTable {
+	var tables []*sstable.SSTable
+	for _, table := range s.ssTables {
+		if table.Level == level && table.Overlaps(start, end) {
+			tables = append(tables, table)
+		}
+	}
+
+	return tables
+}
+
+// overlapsDeeperLevels reports whether an SSTable of a level deeper than the given one may hold keys in [start, end)
+func (s *LSMTreeStore) overlapsDeeperLevels(level int, start, end kv.Key) bool {
+	for _, table := range s.ssTables {
+		if table.Level > level && table.Overlaps(start, end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keySpan returns the range [start, end) covering the keys of the SSTables, an empty end has no upper bound
+func keySpan(tables []*sstable.SSTable) (start, end kv.Key) {
+	unbounded := false
+	for i, table := range tables {
+		smallest, largest := table.KeyRange()
+		if i == 0 || smallest < start {
+			start = smallest
+		}
+		if largest == "" {
+			unbounded = true // a legacy SSTable with unknown bounds
+		} else if largest+"\x00" > end {
+			end = largest + "\x00"
+		}
+	}
+	if unbounded {
+		end = ""
+	}
+
+	return start, end
+}
+
+// maxLevels returns the number of levels of leveled compaction, L0 included
+func (s *LSMTreeStore) maxLevels() int {
+	if s.config.MaxLevels > 1 {
+		return s.config.MaxLevels
+	}
+
+	return defaultMaxLevels
+}
+
+// maxLevelSize returns the bound of the size of a level from L1 on
+func (s *LSMTreeStore) maxLevelSize(level int) uint64 {
+	base := s.config.LevelBaseSize
+	if base == 0 {
+		base = defaultLevelBaseSize
+	}
+	multiplier := s.config.LevelSizeMultiplier
+	if multiplier <= 0 {
+		multiplier = defaultLevelSizeMultiplier
+	}
+
+	return uint64(float64(base) * math.Pow(float64(multiplier), float64(level-1)))
+}
+
+// targetFileSize returns the size of the SSTables written by leveled compactions
+func (s *LSMTreeStore) targetFileSize() uint64 {
+	if s.config.TargetFileSize > 0 {
+		return s.config.TargetFileSize
+	}
+
+	return defaultTargetFileSize
+}
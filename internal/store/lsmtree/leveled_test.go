@@ -0,0 +1,240 @@
+package lsmtree
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/stretchr/testify/require"
+)
+
+// openLeveledStoreAt opens a store with leveled compaction and tiny levels, configure adjusts the config
+func openLeveledStoreAt(dir string, configure func(cfg *config.Config)) *LSMTreeStore {
+	appConfig := &config.Config{
+		MemTableSizeThreshold: 40,
+		SSTableBlockSize:      40,
+		BloomFilterSize:       1000,
+		BloomFilterHashCount:  3,
+		RootDataDir:           dir,
+		CompactionThreshold:   2,
+		CompactionStyle:       config.CompactionLeveled,
+		MaxLevels:             4,
+		LevelBaseSize:         200,
+		LevelSizeMultiplier:   3,
+		TargetFileSize:        80,
+	}
+	if configure != nil {
+		configure(appConfig)
+	}
+	dirConfig := &config.DirectoryConfig{
+		WALDir:         "wal",
+		SSTableDir:     "sstables",
+		SparseIndexDir: "indexes",
+	}
+
+	return NewStore(appConfig, dirConfig)
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"levels stay sorted and within their size":        testLeveledLevelsWithinSize,
+		"an SSTable without overlap is moved":             testLeveledTrivialMove,
+		"sequential writes do not rewrite older SSTables": testLeveledSequentialWrites,
+		"full compaction goes to the deepest level":       testLeveledFullCompaction,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "leveled-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+func testLeveledLevelsWithinSize(t *testing.T, dir string) {
+	store := openLeveledStoreAt(dir, nil)
+
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[kv.Key]kv.Value)
+	for i := 0; i < 600; i++ {
+		key := kv.Key(fmt.Sprintf("key%03d", rnd.Intn(200)))
+		if rnd.Intn(10) == 0 {
+			store.Delete(key)
+			expected[key] = nil
+			continue
+		}
+		value := kv.Value(fmt.Sprintf("v%d", i))
+		store.Set(key, value)
+		expected[key] = value
+	}
+	store.WaitForFlush()
+
+	requireLevelsSorted(t, store)
+	report := store.LevelReport()
+	require.Len(t, report, 4)
+	require.Less(t, report[0].Tables, 2)
+	for _, level := range report[:len(report)-1] {
+		require.Less(t, level.Score, 1.0, "level %d", level.Level)
+	}
+	require.Greater(t, report[2].Tables+report[3].Tables, 0, "data reached the deeper levels")
+	requireDataset(t, store, expected)
+	requireScan(t, store, expected)
+	require.NoError(t, store.Close())
+
+	// Levels are recorded in the manifest
+	store = openLeveledStoreAt(dir, nil)
+	defer store.Close()
+	require.Equal(t, report, store.LevelReport())
+	requireDataset(t, store, expected)
+}
+
+func testLeveledTrivialMove(t *testing.T, dir string) {
+	store := openLeveledStoreAt(dir, func(cfg *config.Config) {
+		cfg.LevelBaseSize = 1 << 20
+	})
+	forceFlush(store, "a", 60)
+
+	l1 := tableIDs(store, 1)
+	require.Greater(t, len(l1), 1)
+	files, err := os.ReadDir(store.dirConfig.SSTableDir)
+	require.NoError(t, err)
+
+	// L1 is now too large: its SSTables overlap nothing below, so they go down without being rewritten
+	store.config.LevelBaseSize = 1
+	runCompactions(store)
+
+	require.Empty(t, tableIDs(store, 1))
+	require.Equal(t, l1, tableIDs(store, 3))
+	after, err := os.ReadDir(store.dirConfig.SSTableDir)
+	require.NoError(t, err)
+	require.Equal(t, len(files), len(after))
+	require.NoError(t, store.Close())
+
+	store = openLeveledStoreAt(dir, nil)
+	defer store.Close()
+	require.Equal(t, l1, tableIDs(store, 3))
+	for i := 0; i < 60; i++ {
+		value, found := store.Get(kv.Key(fmt.Sprintf("a_k%d", i)))
+		require.True(t, found)
+		require.Equal(t, kv.Value(fmt.Sprintf("a_v%d", i)), value)
+	}
+}
+
+func testLeveledSequentialWrites(t *testing.T, dir string) {
+	store := openLeveledStoreAt(dir, func(cfg *config.Config) {
+		cfg.LevelBaseSize = 1 << 20
+	})
+	defer store.Close()
+
+	var previous []uint64
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			store.Set(kv.Key(fmt.Sprintf("r%d_k%02d", round, i)), kv.Value("v"))
+		}
+		store.WaitForFlush()
+
+		// Keys only grow, so merging L0 never overlaps the SSTables of L1 written before
+		current := tableIDs(store, 1)
+		require.Subset(t, current, previous)
+		require.Greater(t, len(current), len(previous))
+		previous = current
+	}
+	requireLevelsSorted(t, store)
+}
+
+func testLeveledFullCompaction(t *testing.T, dir string) {
+	store := openLeveledStoreAt(dir, nil)
+	defer store.Close()
+
+	expected := make(map[kv.Key]kv.Value)
+	for i := 0; i < 200; i++ {
+		key := kv.Key(fmt.Sprintf("key%03d", i%120))
+		value := kv.Value(fmt.Sprintf("v%d", i))
+		store.Set(key, value)
+		expected[key] = value
+	}
+	for i := 0; i < 120; i += 3 {
+		key := kv.Key(fmt.Sprintf("key%03d", i))
+		store.Delete(key)
+		expected[key] = nil
+	}
+	store.WaitForFlush()
+	require.NoError(t, store.Compact())
+
+	// Everything is in the deepest level, split in SSTables of TargetFileSize without tombstones
+	report := store.LevelReport()
+	for _, level := range report[:len(report)-1] {
+		require.Zero(t, level.Tables, "level %d", level.Level)
+	}
+	require.Greater(t, report[len(report)-1].Tables, 1)
+	store.sstableLock.RLock()
+	for _, table := range store.ssTables {
+		require.Zero(t, table.NumTombstones())
+	}
+	store.sstableLock.RUnlock()
+	requireLevelsSorted(t, store)
+	requireDataset(t, store, expected)
+}
+
+// runCompactions runs the compactions the store needs and waits for them
+func runCompactions(store *LSMTreeStore) {
+	store.scheduler.schedule()
+	store.WaitForFlush()
+}
+
+// requireLevelsSorted checks that the SSTables of every level from L1 on have non-overlapping key ranges
+func requireLevelsSorted(t *testing.T, store *LSMTreeStore) {
+	t.Helper()
+
+	store.sstableLock.RLock()
+	defer store.sstableLock.RUnlock()
+
+	for level := 1; level < store.maxLevels(); level++ {
+		tables := store.levelTables(level)
+		for i := 1; i < len(tables); i++ {
+			_, previousLargest := tables[i-1].KeyRange()
+			smallest, _ := tables[i].KeyRange()
+			require.Less(t, previousLargest, smallest, "SSTables of level %d overlap", level)
+		}
+	}
+}
+
+// requireScan checks that a scan of the whole store returns the live keys of expected
+func requireScan(t *testing.T, store *LSMTreeStore, expected map[kv.Key]kv.Value) {
+	t.Helper()
+
+	var live []kv.Record
+	for key, value := range expected {
+		if value != nil {
+			live = append(live, kv.Record{Key: key, Value: value})
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].Key < live[j].Key
+	})
+
+	records, err := store.Scan(kv.Key(""), kv.Key(""))
+	require.NoError(t, err)
+	require.Equal(t, live, records)
+}
+
+// tableIDs returns the sorted ids of the SSTables of the level
+func tableIDs(store *LSMTreeStore, level int) []uint64 {
+	store.sstableLock.RLock()
+	defer store.sstableLock.RUnlock()
+
+	var ids []uint64
+	for _, table := range store.levelTables(level) {
+		ids = append(ids, table.ID())
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
@@ -0,0 +1,103 @@
+package lsmtree
+
+import (
+	"container/heap"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+)
+
+/*
+mergeIterator is a k-way merge of the records of SSTables: a min-heap holds the iterator of every SSTable ordered by
+its current key, so that only one data block per SSTable is in memory. The SSTables are given in lookup order, a key
+found in several of them is returned once with the version of the first one, the newest.
+*/
+type mergeIterator struct {
+	sources mergeHeap
+	record  kv.Record
+	err     error
+}
+
+// mergeSource is the iterator of one SSTable, rank is the position of the SSTable in lookup order
+type mergeSource struct {
+	it   *sstable.Iterator
+	rank int
+}
+
+// newMergeIterator returns a merge of the tables given in lookup order, positioned before the first record
+func newMergeIterator(tables []*sstable.SSTable) *mergeIterator {
+	m := &mergeIterator{}
+	for rank, table := range tables {
+		it := table.NewIterator()
+		if it.Next() {
+			m.sources = append(m.sources, &mergeSource{it: it, rank: rank})
+			continue
+		}
+		if err := it.Err(); err != nil {
+			m.err = err
+			return m
+		}
+	}
+	heap.Init(&m.sources)
+
+	return m
+}
+
+// Next moves to the next key, it returns false once every SSTable is read or on error
+func (m *mergeIterator) Next() bool {
+	if m.err != nil || len(m.sources) == 0 {
+		return false
+	}
+
+	m.record = m.sources[0].it.Record()
+
+	// Skip the older versions of the key: they come next in the heap
+	for len(m.sources) > 0 && m.sources[0].it.Record().Key == m.record.Key {
+		source := m.sources[0]
+		if source.it.Next() {
+			heap.Fix(&m.sources, 0)
+			continue
+		}
+		if err := source.it.Err(); err != nil {
+			m.err = err
+			return false
+		}
+		heap.Pop(&m.sources)
+	}
+
+	return true
+}
+
+// Record returns the newest version of the current key, valid after Next returned true
+func (m *mergeIterator) Record() kv.Record {
+	return m.record
+}
+
+// Err returns the error that stopped the merge, a block that cannot be read, nil once every SSTable is read
+func (m *mergeIterator) Err() error {
+	return m.err
+}
+
+// mergeHeap orders the sources by current key, then by lookup order
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].it.Record().Key, h[j].it.Record().Key
+	if a != b {
+		return a < b
+	}
+	return h[i].rank < h[j].rank
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	source := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return source
+}
@@ -0,0 +1,188 @@
+package lsmtree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+	"github.com/stretchr/testify/require"
+)
+
+// openStoreAt opens an LSMTreeStore on an existing data directory, so a test can close and reopen it
+func openStoreAt(dir string) *LSMTreeStore {
+	appConfig := &config.Config{
+		MemTableSizeThreshold: 10,
+		SSTableBlockSize:      40,
+		BloomFilterSize:       1000,
+		BloomFilterHashCount:  3,
+		RootDataDir:           dir,
+	}
+	dirConfig := &config.DirectoryConfig{
+		WALDir:         "wal",
+		SSTableDir:     "sstables",
+		SparseIndexDir: "indexes",
+	}
+
+	return NewStore(appConfig, dirConfig)
+}
+
+func TestRecovery(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"newest value wins after reopen":            testNewestValueWinsAfterReopen,
+		"orphan SSTable of a crashed flush is gone": testOrphanSSTableRemoved,
+		"tables without a manifest are adopted":     testTablesAdoptedWithoutManifest,
+		"unflushed writes are replayed from WAL":    testUnflushedWritesReplayed,
+		"a failed flush is retried":                 testFailedFlushRetried,
+		"Close stops the retries of a failed flush": testCloseStopsFlushRetries,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "recovery-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+func testNewestValueWinsAfterReopen(t *testing.T, dir string) {
+	store := openStoreAt(dir)
+	for i := 0; i < 5; i++ {
+		store.Set(kv.Key("shared"), kv.Value(fmt.Sprintf("value%d", i)))
+		forceFlush(store, fmt.Sprintf("batch%d", i), 3)
+	}
+	require.GreaterOrEqual(t, sstableCount(store), 2)
+	require.NoError(t, store.Close())
+
+	store = openStoreAt(dir)
+	defer store.Close()
+
+	val, found := store.Get(kv.Key("shared"))
+	require.True(t, found)
+	require.Equal(t, kv.Value("value4"), val)
+}
+
+func testOrphanSSTableRemoved(t *testing.T, dir string) {
+	store := openStoreAt(dir)
+	forceFlush(store, "a", 5)
+	require.NoError(t, store.Close())
+
+	// A flush that died half way: blocks and sparse index exist but the manifest never saw the table
+	orphanDir := filepath.Join(dir, "sstables", "42")
+	require.NoError(t, os.MkdirAll(orphanDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(orphanDir, "0.sst"), []byte{0, 0, 0}, 0644))
+	orphanIndex := filepath.Join(dir, "indexes", "42.index")
+	require.NoError(t, os.WriteFile(orphanIndex, []byte("a_k0:0\n"), 0644))
+
+	store = openStoreAt(dir)
+	defer store.Close()
+
+	_, err := os.Stat(orphanDir)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(orphanIndex)
+	require.True(t, os.IsNotExist(err))
+
+	for i := 0; i < 5; i++ {
+		val, found := store.Get(kv.Key(fmt.Sprintf("a_k%d", i)))
+		require.True(t, found)
+		require.Equal(t, kv.Value(fmt.Sprintf("a_v%d", i)), val)
+	}
+}
+
+func testTablesAdoptedWithoutManifest(t *testing.T, dir string) {
+	store := openStoreAt(dir)
+	forceFlush(store, "a", 5)
+	before := sstableCount(store)
+	require.NoError(t, store.Close())
+
+	manifests, err := filepath.Glob(filepath.Join(dir, "MANIFEST-*"))
+	require.NoError(t, err)
+	for _, path := range append(manifests, filepath.Join(dir, "CURRENT")) {
+		require.NoError(t, os.Remove(path))
+	}
+
+	store = openStoreAt(dir)
+	defer store.Close()
+
+	require.Equal(t, before, sstableCount(store))
+	for i := 0; i < 5; i++ {
+		_, found := store.Get(kv.Key(fmt.Sprintf("a_k%d", i)))
+		require.True(t, found)
+	}
+}
+
+func testUnflushedWritesReplayed(t *testing.T, dir string) {
+	store := openStoreAt(dir)
+	forceFlush(store, "a", 4)
+	store.Delete(kv.Key("a_k0"))
+	require.NoError(t, store.Close())
+
+	store = openStoreAt(dir)
+	defer store.Close()
+
+	_, found := store.Get(kv.Key("a_k0"))
+	require.False(t, found)
+	val, found := store.Get(kv.Key("a_k3"))
+	require.True(t, found)
+	require.Equal(t, kv.Value("a_v3"), val)
+}
+
+func testFailedFlushRetried(t *testing.T, dir string) {
+	store := openStoreAt(dir)
+	defer store.Close()
+
+	failures := 2
+	store.flushHook = func(ssTable *sstable.SSTable) error {
+		if failures > 0 {
+			failures--
+			return errInjected
+		}
+		return nil
+	}
+	forceFlush(store, "a", 5)
+
+	require.Zero(t, failures)
+	require.Greater(t, sstableCount(store), 0)
+	requireNoOrphans(t, store)
+	store.memTableLock.RLock()
+	frozen := len(store.immutableMemTables)
+	store.memTableLock.RUnlock()
+	require.Zero(t, frozen)
+
+	// Only the active WAL segment is left, the segments of the flushed memTables were released
+	segments, err := filepath.Glob(filepath.Join(store.dirConfig.WALDir, "*.log"))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	for i := 0; i < 5; i++ {
+		val, found := store.Get(kv.Key(fmt.Sprintf("a_k%d", i)))
+		require.True(t, found)
+		require.Equal(t, kv.Value(fmt.Sprintf("a_v%d", i)), val)
+	}
+}
+
+func testCloseStopsFlushRetries(t *testing.T, dir string) {
+	store := openStoreAt(dir)
+	store.flushHook = func(ssTable *sstable.SSTable) error {
+		return errInjected
+	}
+	for i := 0; i < 5; i++ {
+		store.Set(kv.Key(fmt.Sprintf("a_k%d", i)), kv.Value(fmt.Sprintf("a_v%d", i)))
+	}
+	require.NoError(t, store.Close())
+
+	// The records of the memTables that were never flushed are replayed from the WAL
+	store = openStoreAt(dir)
+	defer store.Close()
+
+	require.Zero(t, sstableCount(store))
+	for i := 0; i < 5; i++ {
+		val, found := store.Get(kv.Key(fmt.Sprintf("a_k%d", i)))
+		require.True(t, found)
+		require.Equal(t, kv.Value(fmt.Sprintf("a_v%d", i)), val)
+	}
+}
@@ -0,0 +1,115 @@
+package lsmtree
+
+import (
+	"log"
+	"sync"
+)
+
+const defaultCompactionWorkers = 1
+
+/*
+compactionScheduler runs the compactions of the store on CompactionWorkers background goroutines.
+A flush calls schedule once it added an SSTable, and a worker picks and runs compactions until none is needed.
+Each compaction reserves its inputs while it runs, so a worker that picks one wakes another worker to look for a
+compaction of other SSTables: compactions of disjoint SSTables run in parallel.
+
+sstableLock is only held to pick a compaction and to install its output, see runCompaction, so reads and flushes
+go on while SSTables are merged.
+*/
+type compactionScheduler struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	pending bool // a compaction may be needed
+	running int  // workers looking for or running compactions
+	stopped bool
+	workers sync.WaitGroup
+}
+
+// startCompactionScheduler starts the workers running the compactions of the store
+func (s *LSMTreeStore) startCompactionScheduler() {
+	s.scheduler = &compactionScheduler{}
+	s.scheduler.cond = sync.NewCond(&s.scheduler.lock)
+
+	workers := s.config.CompactionWorkers
+	if workers <= 0 {
+		workers = defaultCompactionWorkers
+	}
+	for i := 0; i < workers; i++ {
+		s.scheduler.workers.Add(1)
+		go s.compactionWorker()
+	}
+}
+
+// compactionWorker runs compactions each time one may be needed, until the scheduler stops
+func (s *LSMTreeStore) compactionWorker() {
+	sched := s.scheduler
+	defer sched.workers.Done()
+
+	for {
+		sched.lock.Lock()
+		for !sched.pending && !sched.stopped {
+			sched.cond.Wait()
+		}
+		if sched.stopped {
+			sched.lock.Unlock()
+			return
+		}
+		sched.pending = false
+		sched.running++
+		sched.lock.Unlock()
+
+		for !sched.isStopped() {
+			c := s.pickCompaction()
+			if c == nil {
+				break
+			}
+			// Another worker may find a compaction of the SSTables this one does not use
+			sched.schedule()
+			if err := s.runCompaction(c); err != nil {
+				log.Printf("lsmtree: auto-compaction error: %v", err)
+				break
+			}
+		}
+
+		sched.lock.Lock()
+		sched.running--
+		sched.cond.Broadcast()
+		sched.lock.Unlock()
+	}
+}
+
+// schedule wakes a worker to look for a compaction
+func (sched *compactionScheduler) schedule() {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+
+	sched.pending = true
+	sched.cond.Broadcast()
+}
+
+// wait blocks until no compaction is needed or running
+func (sched *compactionScheduler) wait() {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+
+	for (sched.pending || sched.running > 0) && !sched.stopped {
+		sched.cond.Wait()
+	}
+}
+
+// stop waits for the running compactions, then stops the workers
+func (sched *compactionScheduler) stop() {
+	sched.lock.Lock()
+	sched.stopped = true
+	sched.cond.Broadcast()
+	sched.lock.Unlock()
+
+	sched.workers.Wait()
+}
+
+func (sched *compactionScheduler) isStopped() bool {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+
+	return sched.stopped
+}
@@ -0,0 +1,167 @@
+package lsmtree
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionScheduler(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"reads and flushes go on during a merge":       testSchedulerDoesNotBlock,
+		"disjoint compactions run on parallel workers": testSchedulerParallelWorkers,
+		"Compact waits for the running compactions":    testSchedulerManualCompaction,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "scheduler-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+// blockCompactions makes every compaction wait at stepOutputWritten, before it takes sstableLock, until release is
+// closed. It returns a channel receiving a value each time a compaction starts waiting.
+func blockCompactions(store *LSMTreeStore, release <-chan struct{}) <-chan struct{} {
+	waiting := make(chan struct{}, 10)
+	store.compactionHook = func(step compactionStep) error {
+		if step == stepOutputWritten {
+			waiting <- struct{}{}
+			<-release
+		}
+		return nil
+	}
+
+	return waiting
+}
+
+// within fails the test when fn does not return in time
+func within(t *testing.T, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked by a running compaction")
+	}
+}
+
+func testSchedulerDoesNotBlock(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart, nil)
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	addSSTable(t, store, 0, 2, "b", 10)
+	*clock = windowStart.Add(time.Hour)
+
+	release := make(chan struct{})
+	waiting := blockCompactions(store, release)
+	store.scheduler.schedule()
+	<-waiting
+
+	// The first window is merged, its inputs are still read and new SSTables are added
+	within(t, func() {
+		value, found := store.Get(kv.Key("a0001"))
+		require.True(t, found)
+		require.Equal(t, 15, len(value))
+		addSSTable(t, store, 0, 3, "c", 10)
+		require.Len(t, store.LevelReport(), 4)
+	})
+
+	close(release)
+	store.WaitForFlush()
+
+	store.sstableLock.RLock()
+	windows := store.timeWindows()
+	require.Empty(t, store.compacting)
+	store.sstableLock.RUnlock()
+	require.Len(t, windows[windowStart], 1)
+	require.Len(t, windows[windowStart.Add(time.Hour)], 1)
+	for _, key := range []string{"a0001", "b0002", "c0003"} {
+		_, found := store.Get(kv.Key(key))
+		require.True(t, found, key)
+	}
+}
+
+func testSchedulerParallelWorkers(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart, func(cfg *config.Config) {
+		cfg.CompactionWorkers = 2
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	addSSTable(t, store, 0, 2, "b", 10)
+	*clock = windowStart.Add(time.Hour)
+	addSSTable(t, store, 0, 3, "c", 10)
+	addSSTable(t, store, 0, 4, "d", 10)
+	*clock = windowStart.Add(2 * time.Hour)
+
+	// Both past windows are merged at the same time, each by its own worker
+	release := make(chan struct{})
+	waiting := blockCompactions(store, release)
+	store.scheduler.schedule()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-waiting:
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatalf("%d compactions running, expected 2", i)
+		}
+	}
+	close(release)
+	store.WaitForFlush()
+
+	store.sstableLock.RLock()
+	defer store.sstableLock.RUnlock()
+	require.Len(t, store.ssTables, 2)
+	require.Empty(t, store.compacting)
+}
+
+func testSchedulerManualCompaction(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart, func(cfg *config.Config) {
+		cfg.CompactionThreshold = 2
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	addSSTable(t, store, 0, 2, "b", 10)
+	*clock = windowStart.Add(time.Hour)
+	addSSTable(t, store, 0, 3, "c", 10)
+
+	release := make(chan struct{})
+	waiting := blockCompactions(store, release)
+	store.scheduler.schedule()
+	<-waiting
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var err error
+	go func() {
+		defer wg.Done()
+		err = store.Compact()
+	}()
+
+	// Compact needs the inputs of the running compaction, it merges everything once they are released
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.NoError(t, err)
+
+	store.sstableLock.RLock()
+	defer store.sstableLock.RUnlock()
+	require.Len(t, store.ssTables, 1)
+	require.Equal(t, uint64(30), store.ssTables[0].NumEntries())
+}
@@ -0,0 +1,131 @@
+package lsmtree
+
+import (
+	"fmt"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+)
+
+const (
+	defaultSizeRatio             = 1
+	defaultMinMergeWidth         = 2
+	defaultMaxSpaceAmplification = 200
+)
+
+/*
+Size-tiered compaction, the universal compaction of RocksDB: the store is a list of sorted runs ordered from the
+newest to the oldest, every SSTable of L0 is a run and every deeper level is a run. A record is rewritten only when
+its run is merged with runs of a similar size, so it is rewritten about log(data size) times, at the cost of more
+runs to read and of space taken by the versions not merged yet.
+
+Once there are CompactionThreshold runs, the first rule that applies picks the compaction:
+ 1. space amplification: when the runs but the oldest take more than MaxSpaceAmplification percent of the size of the
+    oldest one, every run is merged
+ 2. size ratio: from the newest run, the following runs are added while a run is at most SizeRatio percent larger
+    than the runs before it together; at least MinMergeWidth runs are merged
+ 3. run count: the newest runs are merged so that CompactionThreshold-1 runs are left
+
+Only adjacent runs are merged and the output keeps their place in the list, so the newest version of a key stays first.
+*/
+
+// pickSizeTieredCompaction returns the next size-tiered compaction, nil when there are fewer than CompactionThreshold runs
+func (s *LSMTreeStore) pickSizeTieredCompaction() *compaction {
+	runs := s.sortedRuns()
+	if s.config.CompactionThreshold <= 0 || len(runs) < max(s.config.CompactionThreshold, 2) {
+		return nil
+	}
+
+	sizes := make([]uint64, len(runs))
+	for i, run := range runs {
+		for _, table := range run {
+			sizes[i] += table.Size()
+		}
+	}
+
+	oldest := sizes[len(sizes)-1]
+	var newer uint64
+	for _, size := range sizes[:len(sizes)-1] {
+		newer += size
+	}
+	if amplification := s.maxSpaceAmplification(); newer*100 > uint64(amplification)*oldest {
+		return s.sizeTieredCompaction(runs, 0, len(runs), fmt.Sprintf("space amplification %d%%", percent(newer, oldest)))
+	}
+
+	ratio := uint64(100 + s.sizeRatio())
+	for first := 0; first < len(runs)-1; first++ {
+		sum := sizes[first]
+		last := first + 1
+		for ; last < len(runs) && sizes[last]*100 <= sum*ratio; last++ {
+			sum += sizes[last]
+		}
+		if last-first >= s.minMergeWidth() {
+			return s.sizeTieredCompaction(runs, first, last, fmt.Sprintf("size ratio, runs %d to %d", first, last-1))
+		}
+	}
+
+	last := min(len(runs), len(runs)-s.config.CompactionThreshold+2)
+	return s.sizeTieredCompaction(runs, 0, last, fmt.Sprintf("%d sorted runs", len(runs)))
+}
+
+// sizeTieredCompaction merges the runs [first, last) into the level of the oldest of them
+func (s *LSMTreeStore) sizeTieredCompaction(runs [][]*sstable.SSTable, first, last int, reason string) *compaction {
+	c := &compaction{
+		// Nothing older than the merged runs is left when the oldest run is merged
+		dropTombstones: last == len(runs),
+		reason:         "size-tiered " + reason,
+	}
+	for _, run := range runs[first:last] {
+		c.inputs = append(c.inputs, run...)
+		c.outputLevel = max(c.outputLevel, run[0].Level)
+	}
+
+	return c
+}
+
+// sortedRuns returns the sorted runs of the store from the newest to the oldest:
+// every SSTable of level 0, newest first, then every deeper level
+func (s *LSMTreeStore) sortedRuns() [][]*sstable.SSTable {
+	var runs [][]*sstable.SSTable
+	for _, table := range s.ssTables {
+		last := len(runs) - 1
+		if table.Level > 0 && last >= 0 && runs[last][0].Level == table.Level {
+			runs[last] = append(runs[last], table)
+			continue
+		}
+		runs = append(runs, []*sstable.SSTable{table})
+	}
+
+	return runs
+}
+
+func (s *LSMTreeStore) sizeRatio() int {
+	if s.config.SizeRatio > 0 {
+		return s.config.SizeRatio
+	}
+
+	return defaultSizeRatio
+}
+
+func (s *LSMTreeStore) minMergeWidth() int {
+	if s.config.MinMergeWidth >= 2 {
+		return s.config.MinMergeWidth
+	}
+
+	return defaultMinMergeWidth
+}
+
+func (s *LSMTreeStore) maxSpaceAmplification() int {
+	if s.config.MaxSpaceAmplification > 0 {
+		return s.config.MaxSpaceAmplification
+	}
+
+	return defaultMaxSpaceAmplification
+}
+
+func percent(a, b uint64) uint64 {
+	if b == 0 {
+		return 0
+	}
+
+	return a * 100 / b
+}
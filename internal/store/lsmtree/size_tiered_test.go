@@ -0,0 +1,181 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeTieredCompaction(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"runs of similar size are merged":           testSizeTieredSizeRatio,
+		"space amplification merges every run":      testSizeTieredSpaceAmplification,
+		"too many runs are merged without a ratio":  testSizeTieredRunCount,
+		"writes keep fewer runs than the threshold": testSizeTieredWrites,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "size-tiered-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+// openSizeTieredStoreAt opens a store with size-tiered compaction, configure adjusts the config
+func openSizeTieredStoreAt(dir string, configure func(cfg *config.Config)) *LSMTreeStore {
+	return openLeveledStoreAt(dir, func(cfg *config.Config) {
+		cfg.CompactionStyle = config.CompactionSizeTiered
+		cfg.CompactionThreshold = 4
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+}
+
+func testSizeTieredSizeRatio(t *testing.T, dir string) {
+	store := openSizeTieredStoreAt(dir, nil)
+	defer store.Close()
+
+	// From the oldest to the newest: one large run, then three small runs of the same size
+	oldest := addSSTable(t, store, 0, 1, "a", 100)
+	small := []*sstable.SSTable{
+		addSSTable(t, store, 0, 2, "b", 10),
+		addSSTable(t, store, 0, 3, "c", 10),
+		addSSTable(t, store, 0, 4, "d", 10),
+	}
+
+	store.sstableLock.Lock()
+	c := store.pickSizeTieredCompaction()
+	store.sstableLock.Unlock()
+	require.NotNil(t, c)
+	require.ElementsMatch(t, small, c.inputs)
+	require.Equal(t, 0, c.outputLevel)
+	require.False(t, c.dropTombstones)
+
+	require.NoError(t, store.runCompaction(c))
+	store.sstableLock.Lock()
+	defer store.sstableLock.Unlock()
+	runs := store.sortedRuns()
+	require.Len(t, runs, 2)
+	require.Equal(t, []*sstable.SSTable{oldest}, runs[1])
+	require.Equal(t, 30*recordSize, runs[0][0].Size())
+	require.Nil(t, store.pickSizeTieredCompaction())
+}
+
+func testSizeTieredSpaceAmplification(t *testing.T, dir string) {
+	store := openSizeTieredStoreAt(dir, func(cfg *config.Config) {
+		cfg.MaxSpaceAmplification = 50
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 1, 1, "a", 40)
+	addSSTable(t, store, 0, 2, "b", 10)
+	addSSTable(t, store, 0, 3, "c", 10)
+	addSSTable(t, store, 0, 4, "d", 10)
+
+	// The newer runs take 75% of the size of the oldest one
+	store.sstableLock.Lock()
+	defer store.sstableLock.Unlock()
+	c := store.pickSizeTieredCompaction()
+	require.NotNil(t, c)
+	require.Len(t, c.inputs, 4)
+	require.Equal(t, 1, c.outputLevel)
+	require.True(t, c.dropTombstones)
+}
+
+func testSizeTieredRunCount(t *testing.T, dir string) {
+	store := openSizeTieredStoreAt(dir, func(cfg *config.Config) {
+		cfg.MinMergeWidth = 3
+		cfg.MaxSpaceAmplification = 1000
+	})
+	defer store.Close()
+
+	// Every run is much larger than the newer ones, the size ratio never lets 3 runs merge
+	addSSTable(t, store, 0, 1, "a", 80)
+	addSSTable(t, store, 0, 2, "b", 40)
+	third := addSSTable(t, store, 0, 3, "c", 20)
+	second := addSSTable(t, store, 0, 4, "d", 10)
+	newest := addSSTable(t, store, 0, 5, "e", 5)
+
+	// 5 runs with a threshold of 4: merging the newest 3 leaves 3 runs
+	store.sstableLock.Lock()
+	defer store.sstableLock.Unlock()
+	c := store.pickSizeTieredCompaction()
+	require.NotNil(t, c)
+	require.ElementsMatch(t, []*sstable.SSTable{newest, second, third}, c.inputs)
+}
+
+func testSizeTieredWrites(t *testing.T, dir string) {
+	store := openSizeTieredStoreAt(dir, nil)
+
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[kv.Key]kv.Value)
+	for i := 0; i < 600; i++ {
+		key := kv.Key(fmt.Sprintf("key%03d", rnd.Intn(200)))
+		if rnd.Intn(10) == 0 {
+			store.Delete(key)
+			expected[key] = nil
+			continue
+		}
+		value := kv.Value(fmt.Sprintf("v%d", i))
+		store.Set(key, value)
+		expected[key] = value
+	}
+	store.WaitForFlush()
+
+	store.sstableLock.RLock()
+	require.Less(t, len(store.sortedRuns()), 4)
+	store.sstableLock.RUnlock()
+	requireDataset(t, store, expected)
+	requireScan(t, store, expected)
+	require.NoError(t, store.Close())
+
+	store = openSizeTieredStoreAt(dir, nil)
+	defer store.Close()
+	requireDataset(t, store, expected)
+}
+
+// recordSize is the size of the key and value of every record written by addSSTable
+const recordSize = uint64(len("a0000") + 15)
+
+// addSSTable writes an SSTable of n records <prefix>NNNN and records it in the manifest at the level,
+// with seq as sequence number
+func addSSTable(t *testing.T, store *LSMTreeStore, level int, seq uint64, prefix string, n int) *sstable.SSTable {
+	t.Helper()
+
+	records := make([]kv.Record, n)
+	for i := range records {
+		records[i] = kv.Record{Key: kv.Key(fmt.Sprintf("%s%04d", prefix, i)), Value: bytes.Repeat([]byte("v"), 15)}
+	}
+
+	return writeSSTable(t, store, level, seq, records)
+}
+
+// writeSSTable writes an SSTable of sorted records written at store.now() and records it in the manifest at the level,
+// with seq as sequence number
+func writeSSTable(t *testing.T, store *LSMTreeStore, level int, seq uint64, records []kv.Record) *sstable.SSTable {
+	t.Helper()
+
+	table := sstable.NewSSTable(store.manifest.NewFileNumber(), store.config, store.dirConfig)
+	table.Level = level
+	table.Seq = seq
+	table.WriteTime = store.now()
+	require.NoError(t, table.FlushRecords(records))
+
+	store.sstableLock.Lock()
+	defer store.sstableLock.Unlock()
+	require.NoError(t, store.commitFlush(table))
+	store.ssTables = append(store.ssTables, table)
+	store.sortSSTables()
+
+	return table
+}
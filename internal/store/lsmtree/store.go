@@ -1,81 +1,167 @@
 package lsmtree
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/manifest"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/memtable"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/store"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/wal"
 )
 
-// Ensure LSMTreeStore implements the store.Store interface
-var _ store.Store = (*LSMTreeStore)(nil)
+// Ensure LSMTreeStore implements the store.Store, store.Reader and store.Compacter interfaces
+var (
+	_ store.Store     = (*LSMTreeStore)(nil)
+	_ store.Reader    = (*LSMTreeStore)(nil)
+	_ store.Compacter = (*LSMTreeStore)(nil)
+)
+
+// A failed flush is retried after flushRetryDelay, the delay doubles up to maxFlushRetryDelay
+const (
+	flushRetryDelay    = 100 * time.Millisecond
+	maxFlushRetryDelay = 10 * time.Second
+)
 
 type LSMTreeStore struct {
 	config    *config.Config
 	dirConfig *config.DirectoryConfig
 	storeLock sync.RWMutex
 	wal       *wal.WAL
-	flushWg sync.WaitGroup
+	manifest  *manifest.Manifest
+	seq       uint64 // sequence number of the last write, guarded by storeLock
+	flushWg   sync.WaitGroup
+	lastFlush chan struct{} // closed once the last started flush is done, guarded by storeLock
+	closing   chan struct{} // closed by Close, stops the retries of a failed flush
+
+	// flushAborted is set when Close stopped the retries of a flush, the later flushes are not committed either
+	flushAborted atomic.Bool
+
+	// compactionHook is called by tests at every step of a compaction to inject failures and crashes
+	compactionHook func(step compactionStep) error
+
+	// flushHook is called by tests once the SSTable of a flush is written, before it is committed, to inject failures
+	flushHook func(ssTable *sstable.SSTable) error
+
+	// now is the clock of the write times of flushed SSTables and of time-window compaction, replaced by tests
+	now func() time.Time
+
+	scheduler *compactionScheduler
+
 	SSTable
 	MemTable
 }
 
+// compactionStep is a point of a compaction where the on-disk state changes
+type compactionStep string
+
+const (
+	stepOutputWritten   compactionStep = "output-written"   // the new SSTable is durable, the manifest still lists the inputs
+	stepManifestUpdated compactionStep = "manifest-updated" // the manifest lists the new SSTable, the inputs are still on disk
+	stepInputDeleted    compactionStep = "input-deleted"    // one more input was deleted
+)
+
 type SSTable struct {
 	sstableLock sync.RWMutex
 	ssTables    []*sstable.SSTable
+
+	// compactPointers holds the largest key of the last SSTable compacted out of every level, see pickLeveledCompaction
+	compactPointers map[int]kv.Key
+
+	// compacting holds the inputs of the running compactions, compactionDone is broadcast when they are released
+	compacting     map[*sstable.SSTable]bool
+	compactionDone *sync.Cond
 }
 
 type MemTable struct {
-	memTableLock    sync.RWMutex
-	memTable        *memtable.MemTable
-	freezedMemTable *memtable.MemTable
+	memTableLock sync.RWMutex
+	memTable     *memtable.MemTable
+
+	// immutableMemTables holds the frozen memTables whose flush is queued or running, oldest first
+	immutableMemTables []*memtable.MemTable
 }
 
 // NewStore creates a new LSMTreeStore instance, initializes the WAL, memTable, and SSTables from disk
 func NewStore(config *config.Config, dirConfig *config.DirectoryConfig) *LSMTreeStore {
+	if err := checkFilterMemoryBudget(config); err != nil {
+		panic(err)
+	}
 	initDirs(config.RootDataDir, dirConfig)
 
 	tree := &LSMTreeStore{
 		config:    config,
 		dirConfig: dirConfig,
+		now:       time.Now,
+		closing:   make(chan struct{}),
 		SSTable: SSTable{
 			ssTables: make([]*sstable.SSTable, 0),
 		},
 	}
 
-	wal, err := wal.NewWAL(dirConfig.WALDir)
+	manifest, err := manifest.Open(config.RootDataDir)
+	if err != nil {
+		panic(err)
+	}
+	tree.manifest = manifest
+
+	wal, err := wal.NewWAL(dirConfig.WALDir, config)
 	if err != nil {
 		panic(err)
 	}
 	tree.wal = wal
 
-	memTable, err := memtable.LoadFromWAL(wal)
+	// Refuse to start rather than silently dropping what the recovery mode does not allow to drop
+	memTable, recovery, err := memtable.LoadFromWAL(wal)
 	if err != nil {
-		log.Println("Error loading memtable from WAL: ", err)
+		panic(err)
+	}
+	if recovery.Recovered > 0 || recovery.Dropped > 0 {
+		log.Printf("lsmtree: WAL recovery: %d records recovered, %d dropped", recovery.Recovered, recovery.Dropped)
 	}
 	tree.memTable = memTable
 
+	// A table of the manifest that cannot be opened would read as empty and be dropped by the next compaction
 	ssTables, err := tree.loadSSTables()
 	if err != nil {
-		log.Println("Error loading SSTables: ", err)
+		panic(err)
 	}
 	tree.ssTables = ssTables
+	tree.seq = max(recovery.LastSeq, tree.manifest.LastSequence())
+
+	tree.compactionDone = sync.NewCond(&tree.sstableLock)
+	tree.startCompactionScheduler()
 
 	return tree
 }
 
-// Get searches the memTable first then the SSTables
+// Get searches the memTable first then the SSTables, a key that cannot be read is logged and returned as missing, see Lookup
 func (s *LSMTreeStore) Get(key kv.Key) (kv.Value, bool) {
+	value, found, err := s.Lookup(key)
+	if err != nil {
+		log.Printf("lsmtree: get %q: %v", key, err)
+	}
+
+	return value, found
+}
+
+/*
+Lookup searches the memTables, then the SSTables newest first, for the newest version of the key.
+It fails when an SSTable that may hold the key cannot be read, see sstable.CorruptionError: the lookup stops there
+rather than going on to older SSTables, which could return a stale value or a deleted key.
+*/
+func (s *LSMTreeStore) Lookup(key kv.Key) (kv.Value, bool, error) {
 	s.storeLock.RLock()
 	defer s.storeLock.RUnlock()
 
@@ -83,77 +169,159 @@ func (s *LSMTreeStore) Get(key kv.Key) (kv.Value, bool) {
 	defer s.memTableLock.RUnlock()
 
 	// Check in-memory tables first
-	for _, table := range []*memtable.MemTable{s.freezedMemTable, s.memTable} {
-		if table != nil {
-			if value, found := table.Get(key); found {
-				if len(value) == 0 { // Check for tombstone
-					return kv.Value(""), false
-				}
-				return value, true
+	for _, table := range s.memTablesNewestFirst() {
+		if value, found := table.Get(key); found {
+			if len(value) == 0 { // Check for tombstone
+				return kv.Value(""), false, nil
 			}
+			return value, true, nil
 		}
 	}
 
 	s.sstableLock.RLock()
 	defer s.sstableLock.RUnlock()
-	// Check SSTables in reverse order
-	for i := len(s.ssTables) - 1; i >= 0; i-- {
-		if !s.ssTables[i].BloomFilter.MightContain(string(key)) {
+	// Check SSTables in lookup order, newest first (see sortSSTables), skipping those whose key range or filter excludes the key
+	for _, table := range s.ssTables {
+		if !table.InKeyRange(key) || !table.MightContain(key) {
 			continue
 		}
-		if value, found := s.ssTables[i].Get(key); found {
+		value, found, err := table.Get(key)
+		if err != nil {
+			return kv.Value(""), false, err
+		}
+		if found {
 			if len(value) == 0 { // empty value means tombstone — key was deleted
-				return kv.Value(""), false
+				return kv.Value(""), false, nil
+			}
+			return value, true, nil
+		}
+		// A block read for nothing, the table is compacted once it used up its budget of wasted reads
+		if s.config.SeekCompactionReads > 0 && table.WastedReads() == s.seekBudget(table) {
+			s.scheduler.schedule()
+		}
+	}
+
+	return kv.Value(""), false, nil
+}
+
+/*
+Scan returns the live records with a key in [start, end) in key order, an empty end has no upper bound.
+The memTables and the SSTables are merged newest first, so the newest version of a key wins and deleted keys are left out.
+SSTables whose key range does not overlap [start, end) are not read.
+It fails when a block of an SSTable cannot be read, see sstable.CorruptionError.
+*/
+func (s *LSMTreeStore) Scan(start, end kv.Key) ([]kv.Record, error) {
+	s.storeLock.RLock()
+	defer s.storeLock.RUnlock()
+
+	s.memTableLock.RLock()
+	defer s.memTableLock.RUnlock()
+
+	s.sstableLock.RLock()
+	defer s.sstableLock.RUnlock()
+
+	seen := make(map[kv.Key]struct{})
+	var records []kv.Record
+	collect := func(recs []kv.Record) {
+		for _, record := range recs {
+			if _, exists := seen[record.Key]; !exists {
+				seen[record.Key] = struct{}{}
+				records = append(records, record)
 			}
-			return value, true
 		}
 	}
 
-	return kv.Value(""), false
+	for _, table := range s.memTablesNewestFirst() {
+		var recs []kv.Record
+		for _, record := range table.GetAll() {
+			if record.Key >= start && (end == "" || record.Key < end) {
+				recs = append(recs, record)
+			}
+		}
+		collect(recs)
+	}
+
+	for _, table := range s.ssTables {
+		if !table.Overlaps(start, end) {
+			continue
+		}
+		recs, err := table.Scan(start, end)
+		if err != nil {
+			return nil, err
+		}
+		collect(recs)
+	}
+
+	live := records[:0]
+	for _, record := range records {
+		if len(record.Value) > 0 {
+			live = append(live, record)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].Key < live[j].Key
+	})
+
+	return live, nil
 }
 
 /*
-Set adds a new key-value pair to the memTable. If the memTable is full, it is flushed to disk as an SSTable.
-The memTable is then reset to an empty state. The WAL is also updated with the new record and a meta log.
+Set adds a new key-value pair to the memTable. If the memTable is full, it is flushed to disk as an SSTable
+and the WAL is rotated, so the records of the flushed memTable live in their own WAL segment.
+The memTable is then reset to an empty state and the new record is written to the new WAL segment.
+The record is queued on the WAL under storeLock to keep the WAL in write order, but the wait for the
+commit happens after the lock is released so concurrent writers share one fsync (group commit).
 */
 func (s *LSMTreeStore) Set(key kv.Key, value kv.Value) {
 	s.storeLock.Lock()
-	defer s.storeLock.Unlock()
 
-	curTimestamp := uint64(time.Now().Unix())
 	record := kv.Record{
 		Key:   key,
 		Value: value,
 	}
 
-	// Write to WAL
-	if s.wal != nil {
-		if _, err := s.wal.WriteCommitLog(&record, &curTimestamp); err != nil {
+	// Check if memTable is full, an empty memTable is never flushed even when the record alone exceeds the threshold
+	if s.memTable.Size() > 0 && s.memTable.Size()+record.Size() >= s.config.MemTableSizeThreshold {
+		if err := s.freezeMemTable(); err != nil {
+			s.storeLock.Unlock()
 			panic(err)
 		}
 	}
 
-	// Check if memTable is full
-	if s.memTable.Size()+record.Size() >= s.config.MemTableSizeThreshold {
-		// Flush a clone of the memTable to disk, clone to prevent reading while writing
+	// Write to WAL
+	s.seq++
+	committed := s.wal.AppendAsync(&record, s.seq)
 
-		s.memTableLock.Lock()
-		freezedMemtable := s.memTable.Clone()
-		s.freezedMemTable = &freezedMemtable // must be set under memTableLock (same lock as the nil-clear in flushMemTable)
-		s.memTableLock.Unlock()
-		s.flushWg.Add(1)
-		go s.flushMemTable(freezedMemtable, &curTimestamp)
-		s.memTable = memtable.NewMemTable()
+	s.memTable.Set(key, value)
+	s.storeLock.Unlock()
 
-		// Write meta log in order to recover the memTable from the last flush
-		if s.wal != nil {
-			if _, err := s.wal.WriteMetaLog(&curTimestamp); err != nil {
-				panic(err)
-			}
-		}
+	if err := <-committed; err != nil {
+		panic(err)
 	}
+}
 
-	s.memTable.Set(key, value)
+// freezeMemTable starts the flush of the memTable in the background and replaces it by an empty one, it must be
+// called with storeLock held
+func (s *LSMTreeStore) freezeMemTable() error {
+	// Seal the WAL segment of the memTable being flushed, it is released once the SSTable is written
+	segmentID, err := s.wal.Rotate()
+	if err != nil {
+		return err
+	}
+	flushedSeq := s.seq
+
+	// Flush a clone of the memTable to disk, clone to prevent reading while writing
+	s.memTableLock.Lock()
+	freezedMemtable := s.memTable.Clone()
+	s.immutableMemTables = append(s.immutableMemTables, &freezedMemtable) // removed by flushMemTable under memTableLock
+	s.memTableLock.Unlock()
+	s.flushWg.Add(1)
+	previous, done := s.lastFlush, make(chan struct{})
+	s.lastFlush = done
+	go s.flushMemTable(&freezedMemtable, segmentID, flushedSeq, previous, done)
+	s.memTable = memtable.NewMemTable()
+
+	return nil
 }
 
 // Delete removes a key-value pair by insert a tombstone record into the memTable
@@ -161,8 +329,16 @@ func (s *LSMTreeStore) Delete(key kv.Key) {
 	s.Set(key, nil)
 }
 
-// Close closes the store and all SSTables
+// Close waits for in-flight flushes and compactions, then closes the WAL and all SSTables
 func (s *LSMTreeStore) Close() error {
+	select {
+	case <-s.closing:
+	default:
+		close(s.closing)
+	}
+	s.flushWg.Wait()
+	s.scheduler.stop()
+
 	s.sstableLock.Lock()
 	defer s.sstableLock.Unlock()
 
@@ -172,7 +348,11 @@ func (s *LSMTreeStore) Close() error {
 		}
 	}
 
-	return nil
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+
+	return s.manifest.Close()
 }
 
 // initDirs adds the root directory to the beginning of all the directories in the DirectoryConfig
@@ -196,162 +376,255 @@ func initDirs(rootDir string, dirConfig *config.DirectoryConfig) {
 }
 
 /*
-loadSSTables loop through the SSTable directory and load all SSTables into memory.
-Add those SSTables to the list of SSTables
+loadSSTables opens the SSTables that the manifest lists as live, in the order recorded there.
+Table directories and sparse index files that are not in the manifest are orphans left by a crash
+during a flush or a compaction and are removed. It fails when a table of the manifest is missing or cannot be opened.
+A data directory written before the manifest existed has its tables adopted into a new manifest.
 */
 func (s *LSMTreeStore) loadSSTables() ([]*sstable.SSTable, error) {
 	ssTables := make([]*sstable.SSTable, 0)
-	dirs, err := os.ReadDir(s.dirConfig.SSTableDir)
-	if err != nil {
+
+	if s.manifest.Created() {
+		if err := s.adoptSSTables(); err != nil {
+			return ssTables, err
+		}
+	}
+
+	for _, meta := range s.manifest.Tables() {
+		ssTable, err := sstable.OpenSSTable(meta.ID, s.config, s.dirConfig)
+		if err != nil {
+			return ssTables, err
+		}
+		ssTable.Level = meta.Level
+		ssTable.Seq = meta.Seq
+
+		ssTables = append(ssTables, ssTable)
+	}
+
+	if err := s.removeOrphans(); err != nil {
 		return ssTables, err
 	}
 
-	ssTableIds := make([]int, 0)
+	return ssTables, nil
+}
 
-	for _, dir := range dirs {
-		if !dir.IsDir() {
+// adoptSSTables records the tables of a data directory without a manifest as level 0 tables, ordered by id
+func (s *LSMTreeStore) adoptSSTables() error {
+	ssTableIds, err := s.listSSTableIds()
+	if err != nil {
+		return err
+	}
+	if len(ssTableIds) == 0 {
+		return nil
+	}
+
+	sort.Slice(ssTableIds, func(i, j int) bool {
+		return ssTableIds[i] < ssTableIds[j]
+	})
+
+	edit := &manifest.VersionEdit{LastSequence: uint64(len(ssTableIds))}
+	for i, ssTableId := range ssTableIds {
+		edit.AddedTables = append(edit.AddedTables, manifest.TableMeta{ID: ssTableId, Level: 0, Seq: uint64(i + 1)})
+	}
+
+	log.Printf("lsmtree: adopting %d SSTables into a new manifest", len(ssTableIds))
+	return s.manifest.Apply(edit)
+}
+
+/*
+removeOrphans deletes the files of every SSTable on disk that the manifest does not list.
+Their ids are never allocated again, in case the files could not all be removed.
+*/
+func (s *LSMTreeStore) removeOrphans() error {
+	ssTableIds, err := s.listSSTableIds()
+	if err != nil {
+		return err
+	}
+
+	for _, ssTableId := range ssTableIds {
+		s.manifest.MarkFileNumberUsed(ssTableId)
+		if s.manifest.Contains(ssTableId) {
 			continue
 		}
 
-		ssTableId, err := strconv.Atoi(dir.Name())
-		if err != nil {
-			continue
+		log.Printf("lsmtree: removing orphan SSTable %d", ssTableId)
+		if err := sstable.DeleteFiles(ssTableId, s.dirConfig); err != nil {
+			return err
 		}
-		ssTableIds = append(ssTableIds, ssTableId)
 	}
 
-	for _, ssTableId := range ssTableIds {
-		ssTable := sstable.NewSSTable(uint64(ssTableId), s.config, s.dirConfig)
+	return nil
+}
 
-		ssTables = append(ssTables, ssTable)
+// listSSTableIds returns the ids of all SSTable files, legacy SSTable directories and sparse index files on disk
+func (s *LSMTreeStore) listSSTableIds() ([]uint64, error) {
+	seen := make(map[uint64]struct{})
+
+	entries, err := os.ReadDir(s.dirConfig.SSTableDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		// A table file, or the block directory of a table written in the legacy format
+		if ssTableId, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), sstable.TableFileExt), 10, 64); err == nil {
+			seen[ssTableId] = struct{}{}
+		}
 	}
 
-	s.sortSSTables()
+	indexes, err := os.ReadDir(s.dirConfig.SparseIndexDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if ssTableId, err := strconv.ParseUint(strings.TrimSuffix(index.Name(), ".index"), 10, 64); err == nil {
+			seen[ssTableId] = struct{}{}
+		}
+	}
 
-	return ssTables, nil
+	ssTableIds := make([]uint64, 0, len(seen))
+	for ssTableId := range seen {
+		ssTableIds = append(ssTableIds, ssTableId)
+	}
+
+	return ssTableIds, nil
 }
 
 /*
 flushMemTable creates a new SSTable from a frozen MemTable snapshot and appends
-it to the SSTable list. After appending it checks whether automatic compaction
-should be triggered based on the configured CompactionThreshold
+it to the SSTable list. The flush is crash-safe:
+ 1. The SSTable is written and fsynced.
+ 2. The SSTable is added to the manifest, together with the sequence number of its newest record.
+ 3. The WAL segment of the snapshot is released.
+
+A crash before step 2 leaves an orphan SSTable that is removed on startup while the WAL still holds its records.
+Flushes are applied in the order their memTables were frozen: the flush waits until the previous one, closing
+previous, is done, and closes done when it is. Otherwise a compaction could move a newer SSTable below an older
+one that is added afterwards, and the older values would shadow the newer ones.
+A flush that fails is retried, with a growing delay, until it succeeds or the store is closed: its WAL segment is not
+released meanwhile and the later flushes wait. Once Close stops the retries the later flushes give up too, so that the
+WAL replayed after a restart does not shadow newer SSTables with older records.
+sstableLock is only held to append the SSTable, then the compaction scheduler looks for a compaction to run.
 */
-func (s *LSMTreeStore) flushMemTable(freezedMemTable memtable.MemTable, timestamp *uint64) {
+func (s *LSMTreeStore) flushMemTable(freezedMemTable *memtable.MemTable, segmentID uint64, seq uint64, previous <-chan struct{}, done chan<- struct{}) {
 	defer s.flushWg.Done()
+	defer close(done)
 
-	s.sstableLock.Lock()
-	defer s.sstableLock.Unlock()
+	if previous != nil {
+		<-previous
+	}
+	if s.flushAborted.Load() {
+		return
+	}
 
-	ssTableID := uint64(time.Now().UnixNano())
-	ssTable := sstable.NewSSTable(ssTableID, s.config, s.dirConfig)
-	ssTable.Flush(freezedMemTable)
-	ssTable.FlushWait()
+	var ssTable *sstable.SSTable
+	for delay := flushRetryDelay; ; delay = min(2*delay, maxFlushRetryDelay) {
+		var err error
+		if ssTable, err = s.writeFlush(freezedMemTable, seq); err == nil {
+			break
+		}
 
-	s.memTableLock.Lock()
-	s.freezedMemTable = nil
-	s.memTableLock.Unlock()
+		// The records stay in the frozen memTable and in the WAL, they are flushed again after a restart
+		log.Printf("lsmtree: flush of the memTable up to seq %d failed, retrying in %s: %v", seq, delay, err)
+		select {
+		case <-s.closing:
+			s.flushAborted.Store(true)
+			return
+		case <-time.After(delay):
+		}
+	}
 
+	// The SSTable is readable before the frozen memTable is dropped, so its records are always found
+	s.sstableLock.Lock()
 	s.ssTables = append(s.ssTables, ssTable)
 	s.sortSSTables()
+	s.sstableLock.Unlock()
+
+	if err := s.wal.Release(segmentID); err != nil {
+		log.Printf("lsmtree: release WAL segment %d: %v", segmentID, err)
+	}
 
-	// Trigger automatic compaction when the threshold is reached.
-	if s.config.CompactionThreshold > 0 && len(s.ssTables) >= s.config.CompactionThreshold {
-		if err := s.compactLocked(); err != nil {
-			log.Printf("lsmtree: auto-compaction error: %v", err)
+	s.memTableLock.Lock()
+	for i, table := range s.immutableMemTables {
+		if table == freezedMemTable {
+			s.immutableMemTables = append(s.immutableMemTables[:i:i], s.immutableMemTables[i+1:]...)
+			break
 		}
 	}
-}
+	s.memTableLock.Unlock()
 
-// WaitForFlush blocks until all in-flight background flush goroutines have finished
-func (s *LSMTreeStore) WaitForFlush() {
-	s.flushWg.Wait()
+	s.scheduler.schedule()
 }
 
-// Compact runs a full compaction of all SSTables: it merges them into a single SSTable, keeping only the newest version of each key and dropping tombstones.
-// It is a no-op when the number of SSTables is below the CompactionThreshold (or when CompactionThreshold is 0, acting as an unconditional manual trigger).
-func (s *LSMTreeStore) Compact() error {
-	s.sstableLock.Lock()
-	defer s.sstableLock.Unlock()
-	return s.compactLocked()
-}
+/*
+writeFlush writes the frozen memTable to a new SSTable of level 0 and commits it. A failed attempt leaves no
+SSTable behind, the next one uses a new id.
+*/
+func (s *LSMTreeStore) writeFlush(freezedMemTable *memtable.MemTable, seq uint64) (*sstable.SSTable, error) {
+	ssTable := sstable.NewSSTable(s.manifest.NewFileNumber(), s.config, s.dirConfig)
+	ssTable.Level = 0
+	ssTable.Seq = seq
+	ssTable.WriteTime = s.now()
+	s.sstableLock.RLock()
+	ssTable.FilterFPRate = s.filterFPRate(ssTable.Level, uint64(freezedMemTable.Size()), nil)
+	s.sstableLock.RUnlock()
 
-// compactLocked performs the compaction. It must be called with sstableLock held.
-//
-// Algorithm:
-//  1. If the SSTable count is below CompactionThreshold (and threshold > 0), return early.
-//  2. Iterate SSTables newest-first (s.ssTables is sorted newest-first).
-//  3. For each record, keep only the first occurrence of each key (= newest version).
-//  4. Drop tombstones (empty Value) — safe because there are no lower levels to mask.
-//  5. Sort the surviving records by key.
-//  6. Close and delete all existing SSTables from disk.
-//  7. Write a single new SSTable with the merged records.
-func (s *LSMTreeStore) compactLocked() error {
-	if s.config.CompactionThreshold > 0 && len(s.ssTables) < s.config.CompactionThreshold {
-		return nil
+	err := ssTable.Flush(*freezedMemTable)
+	ssTable.FlushWait()
+	if err == nil && s.flushHook != nil {
+		err = s.flushHook(ssTable)
 	}
-	if len(s.ssTables) == 0 {
-		return nil
+	if err == nil {
+		err = s.commitFlush(ssTable)
 	}
-
-	log.Printf("lsmtree: compaction starting, merging %d SSTables", len(s.ssTables))
-
-	// s.ssTables is sorted newest-first; first occurrence of a key is the winner.
-	seen := make(map[kv.Key]struct{}, 64)
-	var merged []kv.Record
-
-	for _, table := range s.ssTables {
-		for _, record := range table.GetAll() {
-			if _, exists := seen[record.Key]; !exists {
-				seen[record.Key] = struct{}{}
-				merged = append(merged, record)
+	if err != nil {
+		// The file of another table is never removed, ids are not reused
+		if !errors.Is(err, fs.ErrExist) {
+			if err := ssTable.CloseAndDelete(); err != nil {
+				log.Printf("lsmtree: remove SSTable %d of a failed flush: %v", ssTable.ID(), err)
 			}
 		}
+		return nil, fmt.Errorf("lsmtree: flush SSTable %d: %w", ssTable.ID(), err)
 	}
 
-	// Drop tombstones (len(Value)==0). Since we have a single level, no lower
-	// SSTable can resurface a deleted key, so tombstones can be safely removed.
-	compacted := merged[:0]
-	for _, r := range merged {
-		if len(r.Value) > 0 {
-			compacted = append(compacted, r)
-		}
-	}
-
-	// Sort surviving records by key so the new SSTable is properly ordered.
-	sort.Slice(compacted, func(i, j int) bool {
-		return compacted[i].Key < compacted[j].Key
-	})
+	return ssTable, nil
+}
 
-	// Close and remove all existing SSTables from disk.
-	for _, table := range s.ssTables {
-		if err := table.CloseAndDelete(); err != nil {
-			return fmt.Errorf("lsmtree: compaction cleanup: %w", err)
-		}
+// memTablesNewestFirst returns the active memTable then the frozen ones from newest to oldest, the order in which
+// they shadow each other. It must be called with memTableLock held.
+func (s *LSMTreeStore) memTablesNewestFirst() []*memtable.MemTable {
+	tables := make([]*memtable.MemTable, 0, len(s.immutableMemTables)+1)
+	tables = append(tables, s.memTable)
+	for i := len(s.immutableMemTables) - 1; i >= 0; i-- {
+		tables = append(tables, s.immutableMemTables[i])
 	}
-	s.ssTables = s.ssTables[:0]
-
-	// Write the merged result as a new SSTable, then close and reload it from disk
-	if len(compacted) > 0 {
-		newID := uint64(time.Now().UnixNano())
-		newTable := sstable.NewSSTable(newID, s.config, s.dirConfig)
-		newTable.FlushRecords(compacted)
-		newTable.FlushWait()
 
-		if err := newTable.Close(); err != nil {
-			log.Printf("lsmtree: compaction: error closing new SSTable: %v", err)
-		}
+	return tables
+}
 
-		reloaded := sstable.NewSSTable(newID, s.config, s.dirConfig)
-		s.ssTables = []*sstable.SSTable{reloaded}
+// commitFlush makes a flushed SSTable durable and records it in the manifest
+func (s *LSMTreeStore) commitFlush(ssTable *sstable.SSTable) error {
+	if err := ssTable.Sync(); err != nil {
+		return err
 	}
 
-	log.Printf("lsmtree: compaction done, %d records in 1 SSTable", len(compacted))
-	return nil
+	return s.manifest.Apply(&manifest.VersionEdit{
+		AddedTables:  []manifest.TableMeta{{ID: ssTable.ID(), Level: ssTable.Level, Seq: ssTable.Seq}},
+		LastSequence: ssTable.Seq,
+	})
+}
+
+// WaitForFlush blocks until all in-flight background flush goroutines and the compactions they triggered have finished
+func (s *LSMTreeStore) WaitForFlush() {
+	s.flushWg.Wait()
+	s.scheduler.wait()
 }
 
-// sortSSTables sorts the SSTables by creation time in descending order
+// sortSSTables sorts the SSTables in lookup order: by level, then newest first within a level
 func (s *LSMTreeStore) sortSSTables() {
 	sort.Slice(s.ssTables[:], func(i, j int) bool {
-		return s.ssTables[i].CreatedAt > s.ssTables[j].CreatedAt
+		if s.ssTables[i].Level != s.ssTables[j].Level {
+			return s.ssTables[i].Level < s.ssTables[j].Level
+		}
+		return s.ssTables[i].Seq > s.ssTables[j].Seq
 	})
 }
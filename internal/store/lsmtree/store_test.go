@@ -16,6 +16,8 @@ func TestLSMTreeStore(t *testing.T) {
 		"Check trigger flush to SSTable":   testTriggerFlushToSSTable,
 		"Test Delete key on Store":         testDeleteKeyOnStore,
 		"Read data is flushing to SSTable": testReadDataFlushingToSSTable,
+		"Scan a key range":                 testScanKeyRange,
+		"Read writes of queued flushes":    testReadQueuedFlushes,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "server-test")
@@ -27,7 +29,6 @@ func TestLSMTreeStore(t *testing.T) {
 				Port:                  "6969",
 				MemTableSizeThreshold: 30, // bytes
 				SSTableBlockSize:      20, //bytes
-				SparseWALBufferSize:   2,  // records
 				RootDataDir:           dir,
 			}
 			dirConfig := &config.DirectoryConfig{
@@ -89,6 +90,7 @@ func testTriggerFlushToSSTable(t *testing.T, store *LSMTreeStore) {
 		require.Equal(t, value, v)
 		require.True(t, found)
 	}
+	store.WaitForFlush()
 
 	sstableDir, err = os.ReadDir(store.dirConfig.SSTableDir)
 	require.NoError(t, err)
@@ -121,6 +123,18 @@ func testReadDataFlushingToSSTable(t *testing.T, store *LSMTreeStore) {
 	}
 }
 
+func testReadQueuedFlushes(t *testing.T, store *LSMTreeStore) {
+	// Every few Sets freeze a memTable while the flushes of the previous ones are still queued
+	for i := 0; i < 1000; i++ {
+		store.Set(kv.Key("k"+strconv.Itoa(i)), kv.Value("v"+strconv.Itoa(i)))
+		for j := max(0, i-20); j <= i; j++ {
+			v, found := store.Get(kv.Key("k" + strconv.Itoa(j)))
+			require.True(t, found, "k%d", j)
+			require.Equal(t, kv.Value("v"+strconv.Itoa(j)), v)
+		}
+	}
+}
+
 func testDeleteKeyOnStore(t *testing.T, store *LSMTreeStore) {
 	for i := 0; i < 3; i++ {
 		key := kv.Key("k" + strconv.Itoa(i))
@@ -139,3 +153,46 @@ func testDeleteKeyOnStore(t *testing.T, store *LSMTreeStore) {
 	// TODO: Test delete after recovery from WAL
 	// TODO: Delete after flush to SSTable, SHOULD NOT still get value after flush to sstable but delete in memtable
 }
+
+func testScanKeyRange(t *testing.T, store *LSMTreeStore) {
+	// Two batches of disjoint keys end up in SSTables with disjoint key ranges
+	for i := 0; i < 10; i++ {
+		store.Set(kv.Key("a"+strconv.Itoa(i)), kv.Value("v"+strconv.Itoa(i)))
+	}
+	for i := 0; i < 20; i++ {
+		store.Set(kv.Key("b"+strconv.Itoa(i)), kv.Value("v"+strconv.Itoa(i)))
+	}
+	store.WaitForFlush()
+	store.Set(kv.Key("a3"), kv.Value("new"))
+	store.Delete(kv.Key("a5"))
+
+	records, err := store.Scan(kv.Key("a2"), kv.Key("a7"))
+	require.NoError(t, err)
+	require.Equal(t, []kv.Record{
+		{Key: "a2", Value: kv.Value("v2")},
+		{Key: "a3", Value: kv.Value("new")},
+		{Key: "a4", Value: kv.Value("v4")},
+		{Key: "a6", Value: kv.Value("v6")},
+	}, records)
+
+	records, err = store.Scan(kv.Key("b"), kv.Key(""))
+	require.NoError(t, err)
+	require.Len(t, records, 20)
+	records, err = store.Scan(kv.Key("c"), kv.Key(""))
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	// The tables holding only b keys do not overlap the a range
+	store.sstableLock.RLock()
+	defer store.sstableLock.RUnlock()
+	pruned := 0
+	for _, table := range store.ssTables {
+		smallest, _ := table.KeyRange()
+		if smallest >= "b" {
+			require.False(t, table.Overlaps(kv.Key("a2"), kv.Key("a7")))
+			require.False(t, table.InKeyRange(kv.Key("a3")))
+			pruned++
+		}
+	}
+	require.Greater(t, pruned, 0)
+}
@@ -0,0 +1,211 @@
+package lsmtree
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/manifest"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+)
+
+const defaultTimeWindow = time.Hour
+
+/*
+Time-window compaction, for time-series keys written once and expired by age: SSTables are grouped by the window of
+TimeWindow holding the time of their newest write, and a compaction only merges SSTables of the same window.
+  - the current window is merged once it has CompactionThreshold sorted runs
+  - a past window receives no more writes and is merged into a single sorted run
+  - once every write of a window is older than Retention, its SSTables are deleted without being read
+
+The output of a merge has the write time of its newest input, so it stays in its window. Below level 0 it is split
+at MaxOutputFileSize, the SSTables it is split in are one sorted run and are not merged again.
+A full compaction mixes every window into one SSTable that takes the newest window.
+*/
+
+// pickTimeWindowCompaction returns the compaction of the newest window that needs one, nil when none does.
+// A window with an SSTable used by a running compaction waits for the next pick.
+func (s *LSMTreeStore) pickTimeWindowCompaction() *compaction {
+	windows := s.timeWindows()
+	current := s.now().Truncate(s.timeWindow())
+
+	for _, window := range sortedWindows(windows) {
+		tables := windows[window]
+		runs := windowRuns(tables)
+		if runs < 2 || (!window.Before(current) && runs < s.config.CompactionThreshold) {
+			continue
+		}
+		if s.anyCompacting(tables) {
+			continue
+		}
+
+		c := &compaction{
+			inputs: tables,
+			reason: fmt.Sprintf("time window %s", window.Format(time.RFC3339)),
+		}
+		for _, table := range tables {
+			c.outputLevel = max(c.outputLevel, table.Level)
+		}
+		start, end := keySpan(tables)
+		c.dropTombstones = !s.overlapsOlderTables(tables, c.outputLevel, start, end)
+		return c
+	}
+
+	return nil
+}
+
+// dropExpiredWindows removes the SSTables of the windows whose writes are all older than Retention from the manifest
+// and the live SSTables, but those used by a running compaction, and returns them for deleteExpiredTables.
+// It must be called with sstableLock held.
+func (s *LSMTreeStore) dropExpiredWindows() ([]*sstable.SSTable, error) {
+	if s.config.Retention <= 0 {
+		return nil, nil
+	}
+
+	cutoff := s.now().Add(-s.config.Retention)
+	var expired []*sstable.SSTable
+	var windows []string
+	edit := &manifest.VersionEdit{}
+	for start, tables := range s.timeWindows() {
+		if start.Add(s.timeWindow()).After(cutoff) {
+			continue
+		}
+		dropped := len(expired)
+		for _, table := range tables {
+			if s.compacting[table] {
+				continue
+			}
+			expired = append(expired, table)
+			edit.RemovedTables = append(edit.RemovedTables, table.ID())
+		}
+		if len(expired) > dropped {
+			windows = append(windows, start.Format(time.RFC3339))
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	if err := s.manifest.Apply(edit); err != nil {
+		sort.Strings(windows)
+		return nil, fmt.Errorf("lsmtree: drop expired windows %s: update manifest: %w", strings.Join(windows, ", "), err)
+	}
+	s.replaceSSTables(expired, nil)
+
+	log.Printf("lsmtree: dropped %d SSTables older than %s", len(expired), cutoff.Format(time.RFC3339))
+	return expired, nil
+}
+
+// deleteExpiredTables closes and deletes the SSTables returned by dropExpiredWindows, a file left behind is an
+// orphan removed on the next startup
+func deleteExpiredTables(tables []*sstable.SSTable) {
+	for _, table := range tables {
+		if err := table.CloseAndDelete(); err != nil {
+			log.Printf("lsmtree: drop expired SSTable %d: %v", table.ID(), err)
+		}
+	}
+}
+
+// timeWindows groups the SSTables by the start of the window of their write time, in UTC so that
+// write times loaded from SSTable files and taken from the clock give the same map key
+func (s *LSMTreeStore) timeWindows() map[time.Time][]*sstable.SSTable {
+	windows := make(map[time.Time][]*sstable.SSTable)
+	for _, table := range s.ssTables {
+		start := table.WriteTime.Truncate(s.timeWindow()).UTC()
+		windows[start] = append(windows[start], table)
+	}
+
+	return windows
+}
+
+/*
+windowRuns returns the number of sorted runs of the SSTables of a window, given in lookup order: every SSTable of
+level 0 is a run, and so are the SSTables of a deeper level when their key ranges do not overlap
+*/
+func windowRuns(tables []*sstable.SSTable) int {
+	runs := 0
+	for i := 0; i < len(tables); {
+		j := i + 1
+		for j < len(tables) && tables[i].Level > 0 && tables[j].Level == tables[i].Level {
+			j++
+		}
+
+		if j-i > 1 && !overlapping(tables[i:j]) {
+			runs++
+		} else {
+			runs += j - i
+		}
+		i = j
+	}
+
+	return runs
+}
+
+// overlapping reports whether two of the SSTables may hold the same key
+func overlapping(tables []*sstable.SSTable) bool {
+	sorted := append([]*sstable.SSTable(nil), tables...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, _ := sorted[i].KeyRange()
+		b, _ := sorted[j].KeyRange()
+		return a < b
+	})
+
+	for i := 1; i < len(sorted); i++ {
+		_, largest := sorted[i-1].KeyRange()
+		if smallest, _ := sorted[i].KeyRange(); smallest <= largest {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortedWindows returns the starts of the windows, newest first
+func sortedWindows(windows map[time.Time][]*sstable.SSTable) []time.Time {
+	starts := make([]time.Time, 0, len(windows))
+	for start := range windows {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].After(starts[j])
+	})
+
+	return starts
+}
+
+/*
+overlapsOlderTables reports whether an SSTable read after the inputs of a compaction into the level, one of a deeper
+level or an older one of the same level, may hold keys in [start, end): a tombstone of the inputs may mask it
+*/
+func (s *LSMTreeStore) overlapsOlderTables(inputs []*sstable.SSTable, level int, start, end kv.Key) bool {
+	isInput := make(map[*sstable.SSTable]bool, len(inputs))
+	var oldestSeq uint64
+	for i, table := range inputs {
+		isInput[table] = true
+		if i == 0 || table.Seq < oldestSeq {
+			oldestSeq = table.Seq
+		}
+	}
+
+	for _, table := range s.ssTables {
+		if isInput[table] || !table.Overlaps(start, end) {
+			continue
+		}
+		if table.Level > level || (table.Level == level && table.Seq < oldestSeq) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *LSMTreeStore) timeWindow() time.Duration {
+	if s.config.TimeWindow > 0 {
+		return s.config.TimeWindow
+	}
+
+	return defaultTimeWindow
+}
@@ -0,0 +1,220 @@
+package lsmtree
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeWindowCompaction(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"a past window is merged into one SSTable":    testTimeWindowPastWindowMerged,
+		"the current window waits for the threshold":  testTimeWindowCurrentWindow,
+		"expired windows are deleted without a merge": testTimeWindowRetention,
+		"tombstones masking an older window are kept": testTimeWindowKeepsTombstones,
+		"retention holds without a threshold":         testTimeWindowRetentionManualOnly,
+		"a split window is not merged again":          testTimeWindowSplitOutput,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "time-window-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+// openTimeWindowStoreAt opens a store with time-window compaction of 1 hour windows and a clock set to start
+func openTimeWindowStoreAt(dir string, start time.Time, configure func(cfg *config.Config)) (*LSMTreeStore, *time.Time) {
+	store := openLeveledStoreAt(dir, func(cfg *config.Config) {
+		cfg.CompactionStyle = config.CompactionTimeWindow
+		cfg.CompactionThreshold = 3
+		cfg.TimeWindow = time.Hour
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+
+	clock := start
+	store.now = func() time.Time {
+		return clock
+	}
+
+	return store, &clock
+}
+
+var windowStart = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func testTimeWindowPastWindowMerged(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart.Add(10*time.Minute), nil)
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	*clock = clock.Add(20 * time.Minute)
+	addSSTable(t, store, 0, 2, "b", 10)
+	*clock = windowStart.Add(70 * time.Minute)
+	newest := addSSTable(t, store, 0, 3, "c", 10)
+
+	runCompactions(store)
+	store.sstableLock.RLock()
+	windows := store.timeWindows()
+	store.sstableLock.RUnlock()
+
+	// The first window is closed and merged, the current one has a single SSTable
+	require.Len(t, windows, 2)
+	require.Len(t, windows[windowStart], 1)
+	merged := windows[windowStart][0]
+	require.Equal(t, windowStart.Add(30*time.Minute), merged.WriteTime.UTC())
+	require.Equal(t, uint64(20), merged.NumEntries())
+	require.Equal(t, newest, windows[windowStart.Add(time.Hour)][0])
+	require.NoError(t, store.Close())
+
+	// The write time is recorded in the SSTable file
+	store, _ = openTimeWindowStoreAt(dir, windowStart.Add(70*time.Minute), nil)
+	defer store.Close()
+	store.sstableLock.RLock()
+	windows = store.timeWindows()
+	store.sstableLock.RUnlock()
+	require.Len(t, windows[windowStart], 1)
+	require.Equal(t, merged.ID(), windows[windowStart][0].ID())
+	_, found := store.Get(kv.Key("a0003"))
+	require.True(t, found)
+}
+
+func testTimeWindowCurrentWindow(t *testing.T, dir string) {
+	store, _ := openTimeWindowStoreAt(dir, windowStart.Add(10*time.Minute), nil)
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	addSSTable(t, store, 0, 2, "b", 10)
+
+	store.sstableLock.RLock()
+	c := store.pickTimeWindowCompaction()
+	store.sstableLock.RUnlock()
+	require.Nil(t, c)
+
+	addSSTable(t, store, 0, 3, "c", 10)
+
+	store.sstableLock.RLock()
+	c = store.pickTimeWindowCompaction()
+	store.sstableLock.RUnlock()
+	require.NotNil(t, c)
+	require.Len(t, c.inputs, 3)
+	require.True(t, c.dropTombstones)
+}
+
+func testTimeWindowRetention(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart.Add(10*time.Minute), func(cfg *config.Config) {
+		cfg.Retention = 2 * time.Hour
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	addSSTable(t, store, 0, 2, "b", 10)
+	*clock = windowStart.Add(70 * time.Minute)
+	kept := addSSTable(t, store, 0, 3, "c", 10)
+
+	steps := 0
+	store.compactionHook = func(step compactionStep) error {
+		steps++
+		return nil
+	}
+
+	// Every write of the first window is older than 2 hours from 12:00 on: it is dropped before it is picked for a merge
+	*clock = windowStart.Add(3 * time.Hour)
+	runCompactions(store)
+
+	store.sstableLock.RLock()
+	live := append([]*sstable.SSTable(nil), store.ssTables...)
+	store.sstableLock.RUnlock()
+	require.Equal(t, []*sstable.SSTable{kept}, live)
+	require.Zero(t, steps, "expired SSTables are not merged")
+	requireNoOrphans(t, store)
+	ssTableIds, err := store.listSSTableIds()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{kept.ID()}, ssTableIds)
+
+	_, found := store.Get(kv.Key("a0001"))
+	require.False(t, found)
+	_, found = store.Get(kv.Key("c0001"))
+	require.True(t, found)
+}
+
+func testTimeWindowRetentionManualOnly(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart.Add(10*time.Minute), func(cfg *config.Config) {
+		cfg.CompactionThreshold = 0
+		cfg.Retention = 2 * time.Hour
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	*clock = windowStart.Add(3 * time.Hour)
+	runCompactions(store)
+
+	require.Zero(t, sstableCount(store))
+	requireNoOrphans(t, store)
+}
+
+func testTimeWindowKeepsTombstones(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart, nil)
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "a", 10)
+	*clock = windowStart.Add(time.Hour)
+	writeSSTable(t, store, 0, 2, []kv.Record{{Key: "a0001", Value: kv.Value{}}, {Key: "b", Value: kv.Value("1")}})
+	writeSSTable(t, store, 0, 3, []kv.Record{{Key: "b", Value: kv.Value("2")}})
+
+	// The second window is closed, its tombstone still masks a0001 of the first window
+	*clock = windowStart.Add(2 * time.Hour)
+	runCompactions(store)
+	store.sstableLock.RLock()
+	live := append([]*sstable.SSTable(nil), store.ssTables...)
+	store.sstableLock.RUnlock()
+	require.Len(t, live, 2)
+	require.Equal(t, uint64(1), live[0].NumTombstones())
+
+	_, found := store.Get(kv.Key("a0001"))
+	require.False(t, found)
+	value, found := store.Get(kv.Key("b"))
+	require.True(t, found)
+	require.Equal(t, kv.Value("2"), value)
+}
+
+// testTimeWindowSplitOutput verifies that a window merged into SSTables split at MaxOutputFileSize is one sorted run,
+// so the scheduler does not merge it again and again
+func testTimeWindowSplitOutput(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart.Add(10*time.Minute), func(cfg *config.Config) {
+		cfg.CompactionThreshold = 2
+		cfg.MaxOutputFileSize = 60
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 1, 1, "a", 10)
+	addSSTable(t, store, 0, 2, "b", 10)
+	*clock = windowStart.Add(70 * time.Minute)
+	runCompactions(store)
+
+	store.sstableLock.RLock()
+	merged := append([]*sstable.SSTable(nil), store.timeWindows()[windowStart]...)
+	c := store.pickTimeWindowCompaction()
+	store.sstableLock.RUnlock()
+
+	require.Greater(t, len(merged), 1)
+	require.Equal(t, 1, windowRuns(merged))
+	require.Nil(t, c)
+	for _, table := range merged {
+		require.Equal(t, 1, table.Level)
+	}
+
+	runCompactions(store)
+	store.sstableLock.RLock()
+	after := store.timeWindows()[windowStart]
+	store.sstableLock.RUnlock()
+	require.Equal(t, merged, after)
+	requireLevelsSorted(t, store)
+}
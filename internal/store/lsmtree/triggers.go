@@ -0,0 +1,135 @@
+package lsmtree
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+)
+
+// seekCompactionBytes is the size of an SSTable that one wasted read is worth: as in LevelDB, a seek costs about as
+// much as compacting 16KiB, so a large SSTable is given a larger budget of wasted reads than SeekCompactionReads
+const seekCompactionBytes = 16 << 10
+
+/*
+Besides the SSTable count of the CompactionStyle, two triggers compact a single SSTable that slows reads down:
+  - tombstone density: at least TombstoneRatio of its records are tombstones, as queue-like workloads leave behind,
+    every read and scan of its key range steps over them
+  - seek compaction, as in LevelDB: the point reads that passed its key range and filter and read a data block
+    without finding the key used up its budget, see seekBudget, every such read is a block read wasted before the
+    SSTable that holds the key
+
+As in LevelDB, the SSTable is merged with the SSTables of the next level that overlap it and the output goes to that
+level, so that a lookup in its key range reads one SSTable less. In level 0, whose SSTables overlap each other, the
+older SSTables overlapping it are merged too, otherwise they would be read before the newer output.
+A trigger is skipped when its compaction would neither move the SSTable deeper nor drop anything, which is the case
+of an SSTable of the last level that is left alone or whose tombstones may still mask an older SSTable; rewriting
+it would leave it as it is and trigger again. With time-window compaction only SSTables of one window are merged.
+*/
+
+// pickTriggeredCompaction returns the compaction of the first SSTable in lookup order that crossed the tombstone
+// ratio or the wasted reads budget, nil when none did. It must be called with sstableLock held.
+func (s *LSMTreeStore) pickTriggeredCompaction() *compaction {
+	for _, table := range s.ssTables {
+		reason := s.compactionTrigger(table)
+		if reason == "" || s.compacting[table] {
+			continue
+		}
+
+		if c := s.triggeredCompaction(table, reason); c != nil {
+			// A trivial move keeps the SSTable and with it the count of wasted reads, start it over
+			table.ResetWastedReads()
+			return c
+		}
+	}
+
+	return nil
+}
+
+// triggeredCompaction returns the compaction of the SSTable into the next level, nil when its inputs are used by a
+// running compaction, span several time windows or when it would not change anything
+func (s *LSMTreeStore) triggeredCompaction(table *sstable.SSTable, reason string) *compaction {
+	level := min(table.Level+1, s.maxLevels()-1)
+	inputs := s.olderOverlappingTables(table)
+	start, end := keySpan(inputs)
+	if level > table.Level {
+		inputs = append(inputs, s.overlappingTables(level, start, end)...)
+		start, end = keySpan(inputs)
+	}
+	if s.anyCompacting(inputs) || !s.sameTimeWindow(inputs) {
+		return nil
+	}
+
+	dropTombstones := !s.overlapsOlderTables(inputs, level, start, end)
+	if level == table.Level && len(inputs) == 1 && (!dropTombstones || table.NumTombstones() == 0) {
+		return nil
+	}
+
+	c := s.rangeCompaction(inputs, level, reason)
+	c.dropTombstones = dropTombstones
+
+	return c
+}
+
+/*
+olderOverlappingTables returns the SSTable followed by the older SSTables of its level that overlap the key span of
+the SSTables returned, so that none of them is read before the output of their compaction into a deeper level.
+The SSTables of a level deeper than 0 do not overlap each other, but those of time-window compaction.
+*/
+func (s *LSMTreeStore) olderOverlappingTables(table *sstable.SSTable) []*sstable.SSTable {
+	tables := []*sstable.SSTable{table}
+	for added := true; added; {
+		added = false
+		start, end := keySpan(tables)
+		for _, other := range s.ssTables {
+			if other.Level != table.Level || other.Seq >= table.Seq || slices.Contains(tables, other) {
+				continue
+			}
+			if other.Overlaps(start, end) {
+				tables = append(tables, other)
+				added = true
+			}
+		}
+	}
+
+	return tables
+}
+
+// compactionTrigger returns why the SSTable must be compacted on its own, empty when it need not
+func (s *LSMTreeStore) compactionTrigger(table *sstable.SSTable) string {
+	if s.config.TombstoneRatio > 0 && table.NumEntries() > 0 {
+		ratio := float64(table.NumTombstones()) / float64(table.NumEntries())
+		if ratio >= s.config.TombstoneRatio {
+			return fmt.Sprintf("tombstone density %.0f%% of SSTable %d", ratio*100, table.ID())
+		}
+	}
+	if s.config.SeekCompactionReads > 0 && table.WastedReads() >= s.seekBudget(table) {
+		return fmt.Sprintf("seek, %d wasted reads of SSTable %d", table.WastedReads(), table.ID())
+	}
+
+	return ""
+}
+
+// seekBudget returns the number of wasted reads of the SSTable after which it is compacted: SeekCompactionReads, or
+// one per seekCompactionBytes of the SSTable when that is more
+func (s *LSMTreeStore) seekBudget(table *sstable.SSTable) uint64 {
+	return max(s.config.SeekCompactionReads, table.Size()/seekCompactionBytes)
+}
+
+// sameTimeWindow reports whether the SSTables are in the same window of time-window compaction, always true with
+// the other styles
+func (s *LSMTreeStore) sameTimeWindow(tables []*sstable.SSTable) bool {
+	if s.config.CompactionStyle != config.CompactionTimeWindow || len(tables) == 0 {
+		return true
+	}
+
+	window := tables[0].WriteTime.Truncate(s.timeWindow())
+	for _, table := range tables[1:] {
+		if !table.WriteTime.Truncate(s.timeWindow()).Equal(window) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,223 @@
+package lsmtree
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/sstable"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionTriggers(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"a dense run of tombstones is compacted":    testTombstoneDensity,
+		"a few tombstones are left alone":           testTombstoneDensityBelowRatio,
+		"wasted reads trigger a seek compaction":    testSeekCompaction,
+		"triggers do not merge across time windows": testTriggersKeepTimeWindows,
+		"only the next level is merged":             testTriggerMergesNextLevel,
+		"a rewrite that changes nothing is skipped": testTriggerSkipsNoOp,
+		"the seek budget grows with the SSTable":    testSeekBudget,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "triggers-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+// openTriggerStoreAt opens a store whose SSTable count never triggers a compaction
+func openTriggerStoreAt(dir string, configure func(cfg *config.Config)) *LSMTreeStore {
+	return openLeveledStoreAt(dir, func(cfg *config.Config) {
+		cfg.CompactionStyle = config.CompactionFull
+		cfg.CompactionThreshold = 10
+		configure(cfg)
+	})
+}
+
+// tombstones returns tombstones of the keys prefix0000 to prefix<n-1>
+func tombstones(prefix string, n int) []kv.Record {
+	records := make([]kv.Record, n)
+	for i := range records {
+		records[i] = kv.Record{Key: kv.Key(fmt.Sprintf("%s%04d", prefix, i)), Value: kv.Value{}}
+	}
+
+	return records
+}
+
+func testTombstoneDensity(t *testing.T, dir string) {
+	store := openTriggerStoreAt(dir, func(cfg *config.Config) {
+		cfg.TombstoneRatio = 0.5
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "q", 10)
+	writeSSTable(t, store, 0, 2, tombstones("q", 8))
+	untouched := addSSTable(t, store, 0, 3, "z", 5)
+	runCompactions(store)
+
+	store.sstableLock.RLock()
+	tables := append(store.ssTables[:0:0], store.ssTables...)
+	store.sstableLock.RUnlock()
+	require.Len(t, tables, 2)
+	require.Same(t, untouched, tables[0])
+	require.Equal(t, uint64(2), tables[1].NumEntries())
+	require.Zero(t, tables[1].NumTombstones())
+
+	_, found := store.Get("q0000")
+	require.False(t, found)
+	_, found = store.Get("q0008")
+	require.True(t, found)
+}
+
+func testTombstoneDensityBelowRatio(t *testing.T, dir string) {
+	store := openTriggerStoreAt(dir, func(cfg *config.Config) {
+		cfg.TombstoneRatio = 0.5
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "q", 10)
+	writeSSTable(t, store, 0, 2, append(tombstones("q", 1), kv.Record{Key: "q0001", Value: kv.Value("v")},
+		kv.Record{Key: "q0002", Value: kv.Value("v")}))
+	runCompactions(store)
+
+	require.Equal(t, 2, sstableCount(store))
+}
+
+func testSeekCompaction(t *testing.T, dir string) {
+	store := openLeveledStoreAt(dir, func(cfg *config.Config) {
+		cfg.CompactionThreshold = 10
+		cfg.FilterFPRate = 1 // filters let every key through
+		cfg.LevelBaseSize = 1 << 20
+		cfg.SeekCompactionReads = 3
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 1, 1, "a", 10)
+	newest := addSSTable(t, store, 0, 2, "a", 10)
+
+	// Between two keys of both SSTables, each Get reads a block of both for nothing
+	for i := 0; i < 2; i++ {
+		_, found := store.Get("a0004x")
+		require.False(t, found)
+	}
+	runCompactions(store)
+	require.Equal(t, uint64(2), newest.WastedReads())
+	require.Equal(t, 2, sstableCount(store))
+
+	_, found := store.Get("a0004x")
+	require.False(t, found)
+	runCompactions(store)
+
+	store.sstableLock.RLock()
+	tables := append(store.ssTables[:0:0], store.ssTables...)
+	store.sstableLock.RUnlock()
+	// Merged into L1, split in SSTables of TargetFileSize
+	var entries uint64
+	for _, table := range tables {
+		require.NotSame(t, newest, table)
+		require.Equal(t, 1, table.Level)
+		require.Zero(t, table.WastedReads())
+		entries += table.NumEntries()
+	}
+	require.Equal(t, uint64(10), entries)
+	requireLevelsSorted(t, store)
+}
+
+func testTriggersKeepTimeWindows(t *testing.T, dir string) {
+	store, clock := openTimeWindowStoreAt(dir, windowStart.Add(10*time.Minute), func(cfg *config.Config) {
+		cfg.TombstoneRatio = 0.5
+	})
+	defer store.Close()
+
+	addSSTable(t, store, 0, 1, "q", 10)
+	*clock = windowStart.Add(70 * time.Minute)
+	writeSSTable(t, store, 0, 2, tombstones("q", 8))
+	runCompactions(store)
+
+	require.Equal(t, 2, sstableCount(store))
+}
+
+func testTriggerMergesNextLevel(t *testing.T, dir string) {
+	store := openTriggerStoreAt(dir, func(cfg *config.Config) {
+		cfg.TombstoneRatio = 0.5
+	})
+	defer store.Close()
+
+	deepest := addSSTable(t, store, 2, 1, "q", 10)
+	next := addSSTable(t, store, 1, 2, "q", 10)
+	older := writeSSTable(t, store, 0, 3, []kv.Record{{Key: "q0002", Value: kv.Value("v")}})
+	dense := writeSSTable(t, store, 0, 4, tombstones("q", 8))
+	newer := writeSSTable(t, store, 0, 5, []kv.Record{{Key: "q0001", Value: kv.Value("v")}})
+
+	store.sstableLock.Lock()
+	c := store.pickTriggeredCompaction()
+	store.sstableLock.Unlock()
+
+	// The older SSTable of L0 would be read before the output, the newer one after, L2 is left for a later compaction
+	require.NotNil(t, c)
+	require.ElementsMatch(t, []*sstable.SSTable{dense, older, next}, c.inputs)
+	require.NotContains(t, c.inputs, deepest)
+	require.NotContains(t, c.inputs, newer)
+	require.Equal(t, 1, c.outputLevel)
+	require.False(t, c.dropTombstones)
+
+	// The tombstones go down one level per compaction until nothing older is left for them to mask
+	runCompactions(store)
+	store.sstableLock.RLock()
+	tables := append(store.ssTables[:0:0], store.ssTables...)
+	store.sstableLock.RUnlock()
+	require.Len(t, tables, 2)
+	require.Same(t, newer, tables[0])
+	require.Equal(t, 2, tables[1].Level)
+	require.Equal(t, uint64(2), tables[1].NumEntries())
+	require.Zero(t, tables[1].NumTombstones())
+	value, found := store.Get("q0001")
+	require.True(t, found)
+	require.Equal(t, kv.Value("v"), value)
+	_, found = store.Get("q0002")
+	require.False(t, found)
+	_, found = store.Get("q0008")
+	require.True(t, found)
+}
+
+func testTriggerSkipsNoOp(t *testing.T, dir string) {
+	store := openTriggerStoreAt(dir, func(cfg *config.Config) {
+		cfg.FilterFPRate = 1 // filters let every key through
+		cfg.SeekCompactionReads = 1
+	})
+	defer store.Close()
+
+	// Alone in the last level, a compaction would write the SSTable back as it is
+	last := addSSTable(t, store, store.maxLevels()-1, 1, "a", 10)
+	for i := 0; i < 3; i++ {
+		_, found := store.Get("a0004x")
+		require.False(t, found)
+	}
+	runCompactions(store)
+
+	store.sstableLock.Lock()
+	require.Nil(t, store.pickTriggeredCompaction())
+	require.Equal(t, []*sstable.SSTable{last}, store.ssTables)
+	store.sstableLock.Unlock()
+	require.Equal(t, uint64(3), last.WastedReads())
+}
+
+func testSeekBudget(t *testing.T, dir string) {
+	store := openTriggerStoreAt(dir, func(cfg *config.Config) {
+		cfg.SeekCompactionReads = 3
+	})
+	defer store.Close()
+
+	small := addSSTable(t, store, 1, 1, "a", 10)
+	large := addSSTable(t, store, 1, 2, "b", 4000) // 80000 bytes of keys and values
+
+	require.Equal(t, uint64(3), store.seekBudget(small))
+	require.Equal(t, uint64(4), store.seekBudget(large))
+}
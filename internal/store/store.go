@@ -12,3 +12,15 @@ type Store interface {
 	// Delete deletes the key from the store.
 	Delete(key kv.Key)
 }
+
+// Reader is implemented by the stores whose reads can fail, e.g. on a corrupted file
+type Reader interface {
+	// Lookup is Get that reports a read that failed instead of returning the key as missing.
+	Lookup(key kv.Key) (kv.Value, bool, error)
+}
+
+// Compacter is implemented by the stores that can merge their data on demand
+type Compacter interface {
+	// CompactRange rewrites the data of the keys in [start, end), an empty end has no upper bound.
+	CompactRange(start, end kv.Key) error
+}
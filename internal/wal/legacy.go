@@ -0,0 +1,121 @@
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+)
+
+// Files of the single-file WAL layout used before segments were introduced
+const (
+	legacyCommitLog = "wal.log"
+	legacyMetaLog   = "wal.meta"
+)
+
+/*
+migrateLegacyLog moves the records of a legacy wal.log that were written after the
+last flush (recorded in wal.meta) into a new sealed segment, then removes the legacy files.
+It is a no-op when there is no legacy commit log.
+*/
+func (w *WAL) migrateLegacyLog() error {
+	commitLogPath := filepath.Join(w.dir, legacyCommitLog)
+	metaLogPath := filepath.Join(w.dir, legacyMetaLog)
+
+	if _, err := os.Stat(commitLogPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	lastTimestamp, _ := readLastFlushTimestamp(metaLogPath)
+	records, err := readCommitLogAfterTimestamp(commitLogPath, lastTimestamp)
+	if err != nil {
+		return fmt.Errorf("migrate legacy WAL: %w", err)
+	}
+
+	if len(records) > 0 {
+		segmentID := w.segmentID + 1
+		if err := w.openSegment(segmentID); err != nil {
+			return err
+		}
+		for i := range records {
+			if _, err := w.buf.Write(encodeRecord(&records[i], 0)); err != nil {
+				return err
+			}
+		}
+		if err := w.closeSegment(); err != nil {
+			return err
+		}
+		w.segments = append(w.segments, segmentID)
+	}
+
+	if err := os.Remove(commitLogPath); err != nil {
+		return err
+	}
+	if err := os.Remove(metaLogPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// readLastFlushTimestamp returns the last timestamp written to the legacy meta log
+func readLastFlushTimestamp(metaLogPath string) (int64, error) {
+	data, err := os.ReadFile(metaLogPath)
+	if err != nil {
+		return 0, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) == 0 {
+		return 0, fmt.Errorf("meta log is empty")
+	}
+
+	var lastTimestamp int64
+	if _, err := fmt.Sscanf(lines[len(lines)-1], "%d", &lastTimestamp); err != nil {
+		return 0, err
+	}
+
+	return lastTimestamp, nil
+}
+
+// readCommitLogAfterTimestamp reads the legacy <key>:<value>:<timestamp> lines written at or after timestamp
+func readCommitLogAfterTimestamp(commitLogPath string, timestamp int64) ([]kv.Record, error) {
+	file, err := os.Open(commitLogPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []kv.Record
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid commit log format")
+		}
+
+		var ts int64
+		if _, err := fmt.Sscanf(parts[2], "%d", &ts); err != nil {
+			return nil, err
+		}
+
+		if ts >= timestamp {
+			record := kv.Record{Key: kv.Key(parts[0])}
+			if parts[1] != "" {
+				record.Value = kv.Value(parts[1])
+			}
+			records = append(records, record)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
@@ -0,0 +1,117 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+)
+
+// enc is the binary encoding used for writing and reading WAL records
+var (
+	enc = binary.BigEndian
+)
+
+// headerSize is the size of the record header: <magic><checksum><payloadLen>
+const (
+	headerSize = 12
+
+	// recordMagic starts every record, a scan resumes at the next one after a corrupted record
+	recordMagic uint32 = 0x57414c52
+
+	// minPayloadSize is the size of the payload of a record with an empty key and value
+	minPayloadSize = 8 + 4 + 4
+)
+
+var (
+	// ErrCorruptedRecord is returned when a record is truncated or its checksum does not match
+	ErrCorruptedRecord = errors.New("corrupted WAL record")
+
+	// errTruncatedRecord is a corruption after which the next record boundary is unknown
+	errTruncatedRecord = fmt.Errorf("%w: truncated record", ErrCorruptedRecord)
+
+	magicBytes = enc.AppendUint32(nil, recordMagic)
+)
+
+/*
+encodeRecord encodes a record with format: <magic><checksum><payloadLen><payload>
+  - magic: recordMagic
+  - checksum: CRC32 (IEEE) of payloadLen and the payload, so a corrupted length is detected
+  - payloadLen: the length of the payload
+  - payload: <seq><keyLen><key><valueLen><value>
+
+An empty value marks a tombstone, the same as in the memtable and SSTables.
+*/
+func encodeRecord(record *kv.Record, seq uint64) []byte {
+	payloadLen := 8 + 4 + len(record.Key) + 4 + len(record.Value)
+	data := make([]byte, headerSize+payloadLen)
+
+	payload := data[headerSize:]
+	enc.PutUint64(payload[0:], seq)
+	enc.PutUint32(payload[8:], uint32(len(record.Key)))
+	copy(payload[12:], record.Key)
+	valueOffset := 12 + len(record.Key)
+	enc.PutUint32(payload[valueOffset:], uint32(len(record.Value)))
+	copy(payload[valueOffset+4:], record.Value)
+
+	enc.PutUint32(data[0:], recordMagic)
+	enc.PutUint32(data[8:], uint32(payloadLen))
+	enc.PutUint32(data[4:], crc32.ChecksumIEEE(data[8:]))
+
+	return data
+}
+
+/*
+decodeRecord decodes the record at the start of data and returns the number of bytes it occupies.
+The length is checked against the data left before the checksum is computed. A record with a bad checksum reports
+the size of its length field, which may itself be corrupted, see nextRecord;
+errTruncatedRecord means the header is not a record header or the payload runs past the end of data.
+*/
+func decodeRecord(data []byte) (kv.Record, uint64, int, error) {
+	if len(data) < headerSize || enc.Uint32(data[0:]) != recordMagic {
+		return kv.Record{}, 0, len(data), errTruncatedRecord
+	}
+
+	checksum := enc.Uint32(data[4:])
+	payloadLen := int(enc.Uint32(data[8:]))
+	if payloadLen < minPayloadSize || payloadLen > len(data)-headerSize {
+		return kv.Record{}, 0, len(data), errTruncatedRecord
+	}
+
+	size := headerSize + payloadLen
+	if crc32.ChecksumIEEE(data[8:size]) != checksum {
+		return kv.Record{}, 0, size, fmt.Errorf("%w: checksum mismatch", ErrCorruptedRecord)
+	}
+
+	record, seq, err := parsePayload(data[headerSize:size])
+	return record, seq, size, err
+}
+
+// parsePayload decodes <seq><keyLen><key><valueLen><value>
+func parsePayload(payload []byte) (kv.Record, uint64, error) {
+	if len(payload) < 12 {
+		return kv.Record{}, 0, fmt.Errorf("%w: short payload", ErrCorruptedRecord)
+	}
+
+	seq := enc.Uint64(payload[0:])
+	keyLen := int(enc.Uint32(payload[8:]))
+	if len(payload) < 12+keyLen+4 {
+		return kv.Record{}, 0, fmt.Errorf("%w: short key", ErrCorruptedRecord)
+	}
+	key := kv.Key(payload[12 : 12+keyLen])
+
+	valueOffset := 12 + keyLen
+	valueLen := int(enc.Uint32(payload[valueOffset:]))
+	if len(payload) != valueOffset+4+valueLen {
+		return kv.Record{}, 0, fmt.Errorf("%w: short value", ErrCorruptedRecord)
+	}
+
+	record := kv.Record{Key: key}
+	if valueLen > 0 {
+		record.Value = kv.Value(payload[valueOffset+4:])
+	}
+
+	return record, seq, nil
+}
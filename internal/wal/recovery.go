@@ -0,0 +1,209 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+)
+
+// Recovery is the outcome of replaying the WAL segments
+type Recovery struct {
+	Records   []kv.Record // recovered records in the order they were written
+	LastSeq   uint64      // highest sequence number of the recovered records
+	Recovered int         // number of recovered records
+	Dropped   int         // number of corrupted records plus the valid records the recovery mode discarded
+}
+
+// segmentScan holds the records read from one segment
+type segmentScan struct {
+	records   []kv.Record
+	seqs      []uint64
+	firstBad  int   // number of valid records before the first corrupted one, -1 when the segment is clean
+	corrupted int   // number of corrupted records
+	err       error // the first corruption
+}
+
+/*
+Replay reads every segment that is still on disk in order and returns the records
+in the order they were written, together with the highest sequence number seen.
+Later records of the same key override earlier ones when applied in order.
+
+Corrupted records are handled according to the WALRecoveryMode:
+  - WALRecoveryTolerateCorruptedTail: a corruption with no valid record after it in the newest segment
+    is a torn write and is dropped, any other corruption is an error
+  - WALRecoveryAbsoluteConsistency: any corruption is an error
+  - WALRecoveryPointInTime: the first corruption ends the recovery, everything after it is dropped
+  - WALRecoverySkipCorrupted: corrupted records are dropped, every valid record is kept
+
+Segments that lost records are rewritten with the records that were kept (or removed),
+so the same corruption does not drop newer writes on the next restart.
+*/
+func (w *WAL) Replay() (*Recovery, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	recovery := &Recovery{}
+
+	for i, segmentID := range w.segments {
+		data, err := os.ReadFile(w.segmentPath(segmentID))
+		if err != nil {
+			return nil, err
+		}
+
+		scan := scanSegment(data)
+		keep := len(scan.records)
+
+		if scan.firstBad >= 0 {
+			switch w.recoveryMode {
+			case config.WALRecoveryAbsoluteConsistency:
+				return nil, fmt.Errorf("segment %d: %w", segmentID, scan.err)
+			case config.WALRecoveryTolerateCorruptedTail:
+				isTail := i == len(w.segments)-1 && scan.firstBad == len(scan.records)
+				if !isTail {
+					return nil, fmt.Errorf("segment %d: %w", segmentID, scan.err)
+				}
+			case config.WALRecoveryPointInTime:
+				keep = scan.firstBad
+			}
+		}
+
+		for j := 0; j < keep; j++ {
+			recovery.Records = append(recovery.Records, scan.records[j])
+			recovery.LastSeq = max(recovery.LastSeq, scan.seqs[j])
+		}
+		recovery.Dropped += scan.corrupted + len(scan.records) - keep
+
+		if scan.firstBad < 0 {
+			continue
+		}
+
+		if err := w.rewriteSegment(segmentID, scan.records[:keep], scan.seqs[:keep]); err != nil {
+			return nil, err
+		}
+
+		if w.recoveryMode == config.WALRecoveryPointInTime {
+			dropped, err := w.dropSegmentsAfter(i)
+			if err != nil {
+				return nil, err
+			}
+			recovery.Dropped += dropped
+			break
+		}
+	}
+
+	recovery.Recovered = len(recovery.Records)
+
+	return recovery, nil
+}
+
+/*
+scanSegment decodes every record of a segment. A corrupted record is skipped up to the next valid record, see
+nextRecord; when no valid record follows, the rest of the segment is a torn tail and counts as one corrupted record.
+*/
+func scanSegment(data []byte) *segmentScan {
+	scan := &segmentScan{firstBad: -1}
+
+	for offset := 0; offset < len(data); {
+		record, seq, n, err := decodeRecord(data[offset:])
+		if err != nil {
+			if scan.firstBad < 0 {
+				scan.firstBad = len(scan.records)
+				scan.err = err
+			}
+			scan.corrupted++
+			if offset = nextRecord(data, offset, n); offset < 0 {
+				break
+			}
+			continue
+		}
+
+		scan.records = append(scan.records, record)
+		scan.seqs = append(scan.seqs, seq)
+		offset += n
+	}
+
+	return scan
+}
+
+/*
+nextRecord returns the offset of the first valid record after the corrupted record at offset, whose length field
+gives n bytes, -1 when none follows. The record boundary after offset+n is tried first; as the length field may be
+the corrupted part, the scan then resumes at every later recordMagic, so a bad length never hides the valid records
+after it and only bytes starting with the magic are decoded.
+*/
+func nextRecord(data []byte, offset, n int) int {
+	if next := offset + n; next < len(data) {
+		if _, _, _, err := decodeRecord(data[next:]); err == nil {
+			return next
+		}
+	}
+
+	for next := offset + 1; next < len(data); next++ {
+		i := bytes.Index(data[next:], magicBytes)
+		if i < 0 {
+			break
+		}
+		next += i
+		if _, _, _, err := decodeRecord(data[next:]); err == nil {
+			return next
+		}
+	}
+
+	return -1
+}
+
+// rewriteSegment atomically replaces a segment with the given records, or removes it when there are none
+func (w *WAL) rewriteSegment(segmentID uint64, records []kv.Record, seqs []uint64) error {
+	if len(records) == 0 {
+		return os.Remove(w.segmentPath(segmentID))
+	}
+
+	tmpPath := w.segmentPath(segmentID) + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	for i := range records {
+		if _, err := file.Write(encodeRecord(&records[i], seqs[i])); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, w.segmentPath(segmentID))
+}
+
+// dropSegmentsAfter removes every segment after w.segments[i] and returns the number of records they held
+func (w *WAL) dropSegmentsAfter(i int) (int, error) {
+	dropped := 0
+
+	for _, segmentID := range w.segments[i+1:] {
+		data, err := os.ReadFile(w.segmentPath(segmentID))
+		if err != nil {
+			return 0, err
+		}
+
+		scan := scanSegment(data)
+		dropped += len(scan.records) + scan.corrupted
+
+		if err := os.Remove(w.segmentPath(segmentID)); err != nil {
+			return 0, err
+		}
+	}
+
+	w.segments = w.segments[:i+1]
+
+	return dropped, nil
+}
@@ -0,0 +1,225 @@
+package wal
+
+import (
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryModes(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"torn tail is tolerated by default":           testTolerateCorruptedTail,
+		"torn tail aborts absolute consistency":       testAbsoluteConsistencyTornTail,
+		"corruption in the middle aborts by default":  testTolerateTailMiddleCorruption,
+		"point in time stops at the first corruption": testPointInTime,
+		"skip corrupted keeps every valid record":     testSkipCorrupted,
+		"repaired WAL does not drop new writes":       testRepairedWALKeepsNewWrites,
+		"corrupted length is not a torn tail":         testCorruptedLength,
+		"zeroed tail is a torn tail":                  testZeroedTail,
+		"a record in a value is not replayed":         testRecordInValue,
+		"a checksum of the payload only is refused":   testPayloadOnlyChecksum,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "wal-recovery-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+func testTolerateCorruptedTail(t *testing.T, dir string) {
+	segmentID := writeSegment(t, dir, 3)
+	truncateSegment(t, dir, segmentID, 3)
+
+	recovery := replay(t, dir, config.WALRecoveryTolerateCorruptedTail)
+	require.Equal(t, 2, recovery.Recovered)
+	require.Equal(t, 1, recovery.Dropped)
+	require.Equal(t, uint64(2), recovery.LastSeq)
+}
+
+func testAbsoluteConsistencyTornTail(t *testing.T, dir string) {
+	segmentID := writeSegment(t, dir, 3)
+	truncateSegment(t, dir, segmentID, 3)
+
+	w := openWAL(t, dir, &config.Config{WALRecoveryMode: config.WALRecoveryAbsoluteConsistency})
+	defer w.Close()
+
+	_, err := w.Replay()
+	require.ErrorIs(t, err, ErrCorruptedRecord)
+}
+
+func testTolerateTailMiddleCorruption(t *testing.T, dir string) {
+	segmentID := writeSegment(t, dir, 3)
+	corruptRecord(t, dir, segmentID, 1)
+
+	w := openWAL(t, dir, &config.Config{})
+	defer w.Close()
+
+	_, err := w.Replay()
+	require.ErrorIs(t, err, ErrCorruptedRecord)
+}
+
+func testPointInTime(t *testing.T, dir string) {
+	first := writeSegment(t, dir, 3)
+	writeSegment(t, dir, 2)
+	corruptRecord(t, dir, first, 1)
+
+	// k0 survives, the corrupted k1, the valid k2 and the whole next segment are dropped
+	recovery := replay(t, dir, config.WALRecoveryPointInTime)
+	require.Equal(t, []kv.Record{{Key: "k0", Value: kv.Value("v0")}}, recovery.Records)
+	require.Equal(t, 4, recovery.Dropped)
+}
+
+func testSkipCorrupted(t *testing.T, dir string) {
+	first := writeSegment(t, dir, 3)
+	writeSegment(t, dir, 2)
+	corruptRecord(t, dir, first, 1)
+
+	recovery := replay(t, dir, config.WALRecoverySkipCorrupted)
+	require.Equal(t, 4, recovery.Recovered)
+	require.Equal(t, 1, recovery.Dropped)
+	require.Equal(t, kv.Key("k2"), recovery.Records[1].Key)
+}
+
+func testRepairedWALKeepsNewWrites(t *testing.T, dir string) {
+	segmentID := writeSegment(t, dir, 3)
+	corruptRecord(t, dir, segmentID, 1)
+
+	cfg := &config.Config{WALRecoveryMode: config.WALRecoveryPointInTime}
+	w := openWAL(t, dir, cfg)
+	recovery, err := w.Replay()
+	require.NoError(t, err)
+	require.Equal(t, 1, recovery.Recovered)
+	appendRecords(t, w, 5, 1)
+	require.NoError(t, w.Close())
+
+	// The corruption was cut out, so the write after the recovery survives the next restart
+	recovery = replay(t, dir, config.WALRecoveryPointInTime)
+	require.Zero(t, recovery.Dropped)
+	require.Equal(t, []kv.Key{"k0", "k5"}, []kv.Key{recovery.Records[0].Key, recovery.Records[1].Key})
+}
+
+func testCorruptedLength(t *testing.T, dir string) {
+	segmentID := writeSegment(t, dir, 3)
+	path := filepath.Join(dir, segmentName(segmentID))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	// The length of k0 now runs past the end of the segment
+	data[8] = 0x7f
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	w := openWAL(t, dir, &config.Config{})
+	_, err = w.Replay()
+	require.ErrorIs(t, err, ErrCorruptedRecord)
+	require.NoError(t, w.Close())
+
+	recovery := replay(t, dir, config.WALRecoverySkipCorrupted)
+	require.Equal(t, 2, recovery.Recovered)
+	require.Equal(t, 1, recovery.Dropped)
+	require.Equal(t, kv.Key("k1"), recovery.Records[0].Key)
+}
+
+func testZeroedTail(t *testing.T, dir string) {
+	segmentID := writeSegment(t, dir, 3)
+	file, err := os.OpenFile(filepath.Join(dir, segmentName(segmentID)), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.Write(make([]byte, 64))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	recovery := replay(t, dir, config.WALRecoveryTolerateCorruptedTail)
+	require.Equal(t, 3, recovery.Recovered)
+	require.Equal(t, 1, recovery.Dropped)
+}
+
+func testRecordInValue(t *testing.T, dir string) {
+	// The value of k0 holds a record without its magic, as a record written before the magic existed
+	phantom := encodeRecord(&kv.Record{Key: "phantom", Value: kv.Value("v")}, 9)[4:]
+	w := openWAL(t, dir, &config.Config{})
+	segmentID := w.segmentID
+	require.NoError(t, w.Append(&kv.Record{Key: "k0", Value: kv.Value(phantom)}, 1))
+	appendRecords(t, w, 1, 2)
+	require.NoError(t, w.Close())
+
+	path := filepath.Join(dir, segmentName(segmentID))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[8] = 0x7f
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	recovery := replay(t, dir, config.WALRecoverySkipCorrupted)
+	require.Equal(t, 1, recovery.Dropped)
+	require.Equal(t, []kv.Key{"k1", "k2"}, []kv.Key{recovery.Records[0].Key, recovery.Records[1].Key})
+	require.Equal(t, 2, recovery.Recovered)
+}
+
+func testPayloadOnlyChecksum(t *testing.T, dir string) {
+	data := encodeRecord(&kv.Record{Key: "k", Value: kv.Value("v")}, 1)
+	_, _, _, err := decodeRecord(data)
+	require.NoError(t, err)
+
+	enc.PutUint32(data[4:], crc32.ChecksumIEEE(data[headerSize:]))
+	_, _, n, err := decodeRecord(data)
+	require.ErrorIs(t, err, ErrCorruptedRecord)
+	require.Equal(t, len(data), n)
+}
+
+// writeSegment writes n records kN:vN into a new segment and returns its id
+func writeSegment(t *testing.T, dir string, n int) uint64 {
+	t.Helper()
+
+	w := openWAL(t, dir, &config.Config{})
+	segmentID := w.segmentID
+	appendRecords(t, w, 0, n)
+	require.NoError(t, w.Close())
+
+	return segmentID
+}
+
+// truncateSegment cuts the last n bytes of a segment, as a torn write would
+func truncateSegment(t *testing.T, dir string, segmentID uint64, n int64) {
+	t.Helper()
+
+	path := filepath.Join(dir, segmentName(segmentID))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-n))
+}
+
+// corruptRecord flips the last byte of the i-th record of a segment
+func corruptRecord(t *testing.T, dir string, segmentID uint64, i int) {
+	t.Helper()
+
+	path := filepath.Join(dir, segmentName(segmentID))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	offset := 0
+	for j := 0; j <= i; j++ {
+		_, _, n, err := decodeRecord(data[offset:])
+		require.NoError(t, err)
+		offset += n
+	}
+	data[offset-1] ^= 0xff
+
+	require.NoError(t, os.WriteFile(path, data, 0644))
+}
+
+func replay(t *testing.T, dir string, mode config.WALRecoveryMode) *Recovery {
+	t.Helper()
+
+	w := openWAL(t, dir, &config.Config{WALRecoveryMode: mode})
+	defer w.Close()
+
+	recovery, err := w.Replay()
+	require.NoError(t, err)
+
+	return recovery
+}
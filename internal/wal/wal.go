@@ -3,162 +3,417 @@ package wal
 import (
 	"bufio"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
 	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
 )
 
+// segmentExt is the file extension of a WAL segment
+const segmentExt = ".log"
+
+// maxBatchSize is the maximum number of queued writes committed with one write and one fsync
+const maxBatchSize = 128
+
+/*
+WAL is a write-ahead log split into numbered segment files
+File name pattern: <walDir>/<segmentID>.log
+  - segmentID: a zero-padded, monotonically increasing number
+
+A new segment is started on every memtable switch (Rotate), so each segment
+belongs to exactly one memtable. Once that memtable is durably in an SSTable the
+segment is released (Release) and deleted, or moved to <walDir>/archive when
+WALArchive is enabled.
+
+The active segment is kept open and written by a single committer goroutine.
+Writers queue their records on the requests channel; the committer drains
+everything that is queued, writes it as one batch and fsyncs once according to
+the WALSyncMode (group commit).
+*/
 type WAL struct {
-	commitLogLock sync.RWMutex
-	metaLogLock   sync.RWMutex
-	CommitLogPath string
-	MetaLogPath   string
+	lock         sync.Mutex
+	dir          string
+	archiveDir   string
+	syncMode     config.WALSyncMode
+	recoveryMode config.WALRecoveryMode
+	syncInterval time.Duration
+	file         *os.File
+	buf          *bufio.Writer
+	dirty        bool     // the active segment has writes that are not fsynced yet
+	syncCount    int      // number of fsyncs of the active segments, used by tests
+	segmentID    uint64   // id of the active segment
+	segments     []uint64 // sealed segments still on disk, ascending
+	checkpoints  []uint64 // segment ids returned by Rotate and not yet released, ascending
+	released     map[uint64]struct{}
+	requests     chan *request
+	committerWg  sync.WaitGroup
 }
 
-func NewWAL(walDir string) (*WAL, error) {
-	commitLogPath := filepath.Join(walDir, "wal.log")
-	metaLogPath := filepath.Join(walDir, "wal.meta")
+// request is a write or a rotation queued for the committer goroutine
+type request struct {
+	data    []byte // encoded record, nil for a rotation
+	rotate  bool
+	sealed  uint64 // id of the sealed segment, set by the committer for a rotation
+	errChan chan error
+}
 
+// NewWAL opens the WAL directory, migrates a legacy wal.log if present and starts a new active segment
+func NewWAL(walDir string, cfg *config.Config) (*WAL, error) {
 	if _, err := os.Stat(walDir); os.IsNotExist(err) {
 		if err := os.Mkdir(walDir, 0755); err != nil {
 			return nil, err
 		}
 	}
 
-	return &WAL{
-		CommitLogPath: commitLogPath,
-		MetaLogPath:   metaLogPath,
-	}, nil
-}
+	w := &WAL{
+		dir:          walDir,
+		syncMode:     cfg.WALSyncMode,
+		recoveryMode: cfg.WALRecoveryMode,
+		syncInterval: cfg.WALSyncInterval,
+		released:     make(map[uint64]struct{}),
+		requests:     make(chan *request, maxBatchSize),
+	}
 
-func (w *WAL) WriteCommitLog(record *kv.Record, timestamp *uint64) (int, error) {
-	w.commitLogLock.Lock()
-	defer w.commitLogLock.Unlock()
+	if w.syncMode == config.WALSyncInterval && w.syncInterval <= 0 {
+		w.syncInterval = time.Second
+	}
 
-	data := fmt.Sprintf("%s:%s:%d\n", record.Key, record.Value, *timestamp)
+	if cfg.WALArchive {
+		w.archiveDir = filepath.Join(walDir, "archive")
+		if err := os.MkdirAll(w.archiveDir, 0755); err != nil {
+			return nil, err
+		}
+	}
 
-	commitLog, err := os.OpenFile(w.CommitLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	segments, err := listSegments(walDir)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	for _, segmentID := range segments {
+		w.segmentID = max(w.segmentID, segmentID)
+
+		// A segment left empty by a restart without writes holds nothing to replay
+		if info, err := os.Stat(w.segmentPath(segmentID)); err == nil && info.Size() == 0 {
+			os.Remove(w.segmentPath(segmentID))
+			continue
+		}
+		w.segments = append(w.segments, segmentID)
+	}
+
+	// Never reuse the id of an archived segment
+	if w.archiveDir != "" {
+		archived, err := listSegments(w.archiveDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(archived) > 0 {
+			w.segmentID = max(w.segmentID, archived[len(archived)-1])
+		}
+	}
+
+	if err := w.migrateLegacyLog(); err != nil {
+		return nil, err
+	}
+
+	if err := w.openSegment(w.segmentID + 1); err != nil {
+		return nil, err
 	}
-	defer commitLog.Close()
 
-	return commitLog.Write([]byte(data))
+	w.committerWg.Add(1)
+	go func() {
+		defer w.committerWg.Done()
+		w.runCommitter()
+	}()
+
+	return w, nil
 }
 
-func (w *WAL) WriteMetaLog(timestamp *uint64) (int, error) {
-	w.metaLogLock.Lock()
-	defer w.metaLogLock.Unlock()
+// Append writes a record with its sequence number and blocks until it is committed
+func (w *WAL) Append(record *kv.Record, seq uint64) error {
+	return <-w.AppendAsync(record, seq)
+}
 
-	data := fmt.Sprintf("%d\n", *timestamp)
+/*
+AppendAsync queues a record with its sequence number and returns a channel that receives
+the result once the record is committed: written to the OS with WALSyncOS and WALSyncInterval,
+fsynced with WALSyncAlways.
+Records are committed in the order they are queued.
+*/
+func (w *WAL) AppendAsync(record *kv.Record, seq uint64) <-chan error {
+	req := &request{
+		data:    encodeRecord(record, seq),
+		errChan: make(chan error, 1),
+	}
+	w.requests <- req
 
-	metaLog, err := os.OpenFile(w.MetaLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	return req.errChan
+}
+
+/*
+Rotate seals the active segment and starts a new one.
+Every record queued before the rotation is written and fsynced to the sealed segment.
+The returned id must be passed to Release once the memtable that was switched out
+together with this segment is durably in an SSTable.
+*/
+func (w *WAL) Rotate() (uint64, error) {
+	req := &request{
+		rotate:  true,
+		errChan: make(chan error, 1),
+	}
+	w.requests <- req
+
+	if err := <-req.errChan; err != nil {
 		return 0, err
 	}
-	defer metaLog.Close()
 
-	return metaLog.Write([]byte(data))
+	return req.sealed, nil
 }
 
-func (w *WAL) ReadCommitLog() ([]byte, error) {
-	w.commitLogLock.RLock()
-	defer w.commitLogLock.RUnlock()
+/*
+Release marks the segment returned by Rotate as flushed.
+Segments are only removed in order: a segment is deleted once it and every
+checkpoint before it have been released, so an out-of-order flush never drops
+records of an older memtable that is still being flushed.
+*/
+func (w *WAL) Release(segmentID uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.released[segmentID] = struct{}{}
+
+	for len(w.checkpoints) > 0 {
+		checkpoint := w.checkpoints[0]
+		if _, ok := w.released[checkpoint]; !ok {
+			break
+		}
+
+		for len(w.segments) > 0 && w.segments[0] <= checkpoint {
+			if err := w.removeSegment(w.segments[0]); err != nil {
+				return err
+			}
+			w.segments = w.segments[1:]
+		}
+
+		delete(w.released, checkpoint)
+		w.checkpoints = w.checkpoints[1:]
+	}
 
-	return os.ReadFile(w.CommitLogPath)
+	return nil
 }
 
-func (w *WAL) ReadMetaLog() ([]byte, error) {
-	w.metaLogLock.RLock()
-	defer w.metaLogLock.RUnlock()
+// Close stops the committer, then flushes, fsyncs and closes the active segment.
+// The WAL must not be written after Close.
+func (w *WAL) Close() error {
+	close(w.requests)
+	w.committerWg.Wait()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
-	return os.ReadFile(w.MetaLogPath)
+	return w.closeSegment()
 }
 
-func (w *WAL) ReadLastItemFromMetaLog() (int64, error) {
-	w.metaLogLock.RLock()
-	defer w.metaLogLock.RUnlock()
+// runCommitter commits queued requests in batches until the requests channel is closed
+func (w *WAL) runCommitter() {
+	var tick <-chan time.Time
+	if w.syncMode == config.WALSyncInterval {
+		ticker := time.NewTicker(w.syncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-	data, err := os.ReadFile(w.MetaLogPath)
-	if err != nil {
-		return 0, err
+	for {
+		select {
+		case req, ok := <-w.requests:
+			if !ok {
+				return
+			}
+			w.commitBatch(w.collectBatch(req))
+		case <-tick:
+			w.lock.Lock()
+			if err := w.sync(); err != nil {
+				log.Println("Error syncing WAL segment: ", err)
+			}
+			w.lock.Unlock()
+		}
 	}
+}
+
+// collectBatch drains the requests that are already queued behind first, a rotation ends the batch
+func (w *WAL) collectBatch(first *request) []*request {
+	batch := []*request{first}
 
-	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
-	if len(lines) == 0 {
-		return 0, fmt.Errorf("meta log is empty")
+	for !batch[len(batch)-1].rotate && len(batch) < maxBatchSize {
+		select {
+		case req, ok := <-w.requests:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, req)
+		default:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// commitBatch writes all records of the batch with a single flush and at most one fsync, then acknowledges them
+func (w *WAL) commitBatch(batch []*request) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var err error
+	for _, req := range batch {
+		if req.rotate {
+			break
+		}
+		if _, err = w.buf.Write(req.data); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.buf.Flush()
+	}
+	if err == nil {
+		w.dirty = true
+		if w.syncMode == config.WALSyncAlways {
+			err = w.sync()
+		}
+	}
+
+	for _, req := range batch {
+		if req.rotate {
+			if err == nil {
+				req.sealed, err = w.rotateSegment()
+			}
+		}
+		req.errChan <- err
+	}
+}
+
+// rotateSegment seals the active segment and opens the next one
+func (w *WAL) rotateSegment() (uint64, error) {
+	sealed := w.segmentID
+	if err := w.closeSegment(); err != nil {
+		return 0, err
 	}
+	w.segments = append(w.segments, sealed)
+	w.checkpoints = append(w.checkpoints, sealed)
 
-	var lastTimestamp int64
-	if _, err := fmt.Sscanf(lines[len(lines)-1], "%d", &lastTimestamp); err != nil {
+	if err := w.openSegment(sealed + 1); err != nil {
 		return 0, err
 	}
 
-	return lastTimestamp, nil
+	return sealed, nil
 }
 
-func (w *WAL) ReadCommitLogAfterTimestamp(timestamp int64) ([]kv.Record, error) {
-	w.commitLogLock.RLock()
-	defer w.commitLogLock.RUnlock()
+// sync fsyncs the active segment if it has unsynced writes
+func (w *WAL) sync() error {
+	if w.file == nil || !w.dirty {
+		return nil
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	w.syncCount++
 
-	file, err := os.Open(w.CommitLogPath)
+	return nil
+}
+
+// openSegment creates the segment file with the given id and makes it the active segment
+func (w *WAL) openSegment(segmentID uint64) error {
+	file, err := os.OpenFile(w.segmentPath(segmentID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer file.Close()
 
-	var records []kv.Record
-	scanner := bufio.NewScanner(file)
+	w.file = file
+	w.buf = bufio.NewWriter(file)
+	w.segmentID = segmentID
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if len(parts) != 3 {
-			return nil, fmt.Errorf("invalid commit log format")
-		}
+	return nil
+}
 
-		var ts int64
-		if _, err := fmt.Sscanf(parts[2], "%d", &ts); err != nil {
-			return nil, err
-		}
+// closeSegment flushes, fsyncs and closes the active segment file
+func (w *WAL) closeSegment() error {
+	if w.file == nil {
+		return nil
+	}
 
-		if ts >= timestamp {
-			if parts[1] == "" {
-				// delete key if value is empty
-				record := kv.Record{
-					Key:   kv.Key(parts[0]),
-					Value: nil,
-				}
-				records = append(records, record)
-			} else {
-				records = append(records, kv.Record{
-					Key:   kv.Key(parts[0]),
-					Value: kv.Value(parts[1]),
-				})
-			}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	w.dirty = true
+	if err := w.sync(); err != nil {
+		return err
+	}
 
-		}
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+// removeSegment deletes a sealed segment, or moves it to the archive directory
+func (w *WAL) removeSegment(segmentID uint64) error {
+	var err error
+	if w.archiveDir != "" {
+		err = os.Rename(w.segmentPath(segmentID), filepath.Join(w.archiveDir, segmentName(segmentID)))
+	} else {
+		err = os.Remove(w.segmentPath(segmentID))
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	// A segment emptied by the recovery is already gone
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
-	valueMap := make(map[kv.Key]kv.Value)
-	for _, record := range records {
-		valueMap[record.Key] = record.Value
+	return nil
+}
+
+// listSegments returns the ids of all segment files in the directory, ascending
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
 
-	var filteredRecords []kv.Record
-	for key, value := range valueMap {
-		filteredRecords = append(filteredRecords, kv.Record{
-			Key:   key,
-			Value: value,
-		})
+	segments := make([]uint64, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != segmentExt {
+			continue
+		}
+
+		segmentID, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segmentID)
 	}
 
-	return filteredRecords, nil
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	return segments, nil
+}
+
+func (w *WAL) segmentPath(segmentID uint64) string {
+	return filepath.Join(w.dir, segmentName(segmentID))
+}
+
+func segmentName(segmentID uint64) string {
+	return fmt.Sprintf("%06d%s", segmentID, segmentExt)
 }
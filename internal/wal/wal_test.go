@@ -0,0 +1,273 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/richardktran/lsm-tree-go-my-way/internal/config"
+	"github.com/richardktran/lsm-tree-go-my-way/internal/kv"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"replay records after reopen":               testReplayAfterReopen,
+		"rotate starts a new segment":               testRotateStartsNewSegment,
+		"release deletes flushed segments":          testReleaseDeletesSegments,
+		"release waits for older checkpoints":       testReleaseOutOfOrder,
+		"archive released segments":                 testArchiveReleasedSegments,
+		"migrate legacy wal.log":                    testMigrateLegacyLog,
+		"recovered segments are released by rotate": testReleaseRecoveredSegments,
+		"sync always fsyncs every commit":           testSyncAlways,
+		"group commit shares one fsync":             testGroupCommit,
+		"sync interval fsyncs in the background":    testSyncInterval,
+		"rotate commits queued records first":       testRotateAfterQueuedRecords,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "wal-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+func testReplayAfterReopen(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{})
+	appendRecords(t, w, 0, 3)
+	require.NoError(t, w.Append(&kv.Record{Key: kv.Key("k1")}, 4))
+	require.NoError(t, w.Close())
+
+	w = openWAL(t, dir, &config.Config{})
+	defer w.Close()
+
+	recovery, err := w.Replay()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), recovery.LastSeq)
+	require.Equal(t, 4, recovery.Recovered)
+	require.Zero(t, recovery.Dropped)
+	records := recovery.Records
+	require.Equal(t, kv.Record{Key: "k0", Value: kv.Value("v0")}, records[0])
+	require.Equal(t, kv.Key("k1"), records[3].Key)
+	require.Nil(t, records[3].Value)
+}
+
+func testRotateStartsNewSegment(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{})
+	defer w.Close()
+
+	appendRecords(t, w, 0, 2)
+	sealed, err := w.Rotate()
+	require.NoError(t, err)
+	appendRecords(t, w, 2, 2)
+
+	require.Equal(t, []string{segmentName(sealed), segmentName(sealed + 1)}, segmentFiles(t, dir))
+}
+
+func testReleaseDeletesSegments(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{})
+	appendRecords(t, w, 0, 2)
+	sealed, err := w.Rotate()
+	require.NoError(t, err)
+	appendRecords(t, w, 2, 2)
+
+	require.NoError(t, w.Release(sealed))
+	require.Equal(t, []string{segmentName(sealed + 1)}, segmentFiles(t, dir))
+	require.NoError(t, w.Close())
+
+	// Only the records of the unflushed segment are replayed
+	w = openWAL(t, dir, &config.Config{})
+	defer w.Close()
+	recovery, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, recovery.Records, 2)
+	require.Equal(t, kv.Key("k2"), recovery.Records[0].Key)
+}
+
+func testReleaseOutOfOrder(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{})
+	defer w.Close()
+
+	appendRecords(t, w, 0, 1)
+	first, err := w.Rotate()
+	require.NoError(t, err)
+	appendRecords(t, w, 1, 1)
+	second, err := w.Rotate()
+	require.NoError(t, err)
+
+	// The newer memtable finished flushing first, the older segment must survive
+	require.NoError(t, w.Release(second))
+	require.Equal(t, []string{segmentName(first), segmentName(second), segmentName(second + 1)}, segmentFiles(t, dir))
+
+	require.NoError(t, w.Release(first))
+	require.Equal(t, []string{segmentName(second + 1)}, segmentFiles(t, dir))
+}
+
+func testArchiveReleasedSegments(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{WALArchive: true})
+	defer w.Close()
+
+	appendRecords(t, w, 0, 1)
+	sealed, err := w.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, w.Release(sealed))
+
+	_, err = os.Stat(filepath.Join(dir, "archive", segmentName(sealed)))
+	require.NoError(t, err)
+	require.Equal(t, []string{segmentName(sealed + 1)}, segmentFiles(t, dir))
+}
+
+func testMigrateLegacyLog(t *testing.T, dir string) {
+	commitLog := "k0:v0:100\nk1:v1:200\nk2::300\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, legacyCommitLog), []byte(commitLog), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, legacyMetaLog), []byte("200\n"), 0644))
+
+	w := openWAL(t, dir, &config.Config{})
+	defer w.Close()
+
+	recovery, err := w.Replay()
+	require.NoError(t, err)
+	require.Equal(t, []kv.Record{
+		{Key: "k1", Value: kv.Value("v1")},
+		{Key: "k2"},
+	}, recovery.Records)
+
+	_, err = os.Stat(filepath.Join(dir, legacyCommitLog))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, legacyMetaLog))
+	require.True(t, os.IsNotExist(err))
+}
+
+func testReleaseRecoveredSegments(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{})
+	appendRecords(t, w, 0, 2)
+	require.NoError(t, w.Close())
+
+	// The recovered segment belongs to the memtable that is switched out on the next rotation
+	w = openWAL(t, dir, &config.Config{})
+	defer w.Close()
+	appendRecords(t, w, 2, 1)
+	sealed, err := w.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, w.Release(sealed))
+
+	require.Equal(t, []string{segmentName(sealed + 1)}, segmentFiles(t, dir))
+}
+
+func testSyncAlways(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{WALSyncMode: config.WALSyncAlways})
+	defer w.Close()
+
+	appendRecords(t, w, 0, 3)
+	require.Equal(t, 3, syncCount(w))
+}
+
+func testGroupCommit(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{WALSyncMode: config.WALSyncAlways})
+
+	// Hold the WAL lock so the committer blocks on the first record while the others queue up
+	w.lock.Lock()
+	results := make([]<-chan error, 0, 50)
+	for i := 0; i < 50; i++ {
+		record := kv.Record{Key: kv.Key("k" + strconv.Itoa(i)), Value: kv.Value("v")}
+		results = append(results, w.AppendAsync(&record, uint64(i+1)))
+	}
+	w.lock.Unlock()
+
+	for _, result := range results {
+		require.NoError(t, <-result)
+	}
+	require.LessOrEqual(t, syncCount(w), 2)
+	require.NoError(t, w.Close())
+
+	w = openWAL(t, dir, &config.Config{})
+	defer w.Close()
+	recovery, err := w.Replay()
+	require.NoError(t, err)
+	require.Len(t, recovery.Records, 50)
+	require.Equal(t, uint64(50), recovery.LastSeq)
+}
+
+func testSyncInterval(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{
+		WALSyncMode:     config.WALSyncInterval,
+		WALSyncInterval: 10 * time.Millisecond,
+	})
+	defer w.Close()
+
+	appendRecords(t, w, 0, 1)
+	require.Eventually(t, func() bool {
+		return syncCount(w) >= 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func testRotateAfterQueuedRecords(t *testing.T, dir string) {
+	w := openWAL(t, dir, &config.Config{})
+
+	results := make([]<-chan error, 0, 3)
+	for i := 0; i < 3; i++ {
+		record := kv.Record{Key: kv.Key("k" + strconv.Itoa(i)), Value: kv.Value("v")}
+		results = append(results, w.AppendAsync(&record, uint64(i+1)))
+	}
+	sealed, err := w.Rotate()
+	require.NoError(t, err)
+	for _, result := range results {
+		require.NoError(t, <-result)
+	}
+	require.NoError(t, w.Close())
+
+	info, err := os.Stat(filepath.Join(dir, segmentName(sealed)))
+	require.NoError(t, err)
+	require.NotZero(t, info.Size())
+
+	info, err = os.Stat(filepath.Join(dir, segmentName(sealed+1)))
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+}
+
+func syncCount(w *WAL) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.syncCount
+}
+
+func openWAL(t *testing.T, dir string, cfg *config.Config) *WAL {
+	t.Helper()
+
+	w, err := NewWAL(dir, cfg)
+	require.NoError(t, err)
+
+	return w
+}
+
+// appendRecords appends records kN:vN for N in [from, from+n) with sequence numbers N+1
+func appendRecords(t *testing.T, w *WAL, from, n int) {
+	t.Helper()
+
+	for i := from; i < from+n; i++ {
+		record := kv.Record{
+			Key:   kv.Key("k" + strconv.Itoa(i)),
+			Value: kv.Value("v" + strconv.Itoa(i)),
+		}
+		require.NoError(t, w.Append(&record, uint64(i+1)))
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	segments, err := listSegments(dir)
+	require.NoError(t, err)
+
+	names := make([]string, 0, len(segments))
+	for _, segmentID := range segments {
+		names = append(names, segmentName(segmentID))
+	}
+
+	return names
+}
@@ -1,43 +1,198 @@
 package bloomfilter
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
 	"github.com/spaolacci/murmur3"
 )
 
-// BloomFilter represents a Bloom filter structure
+const (
+	// blockBits is the number of bits of a block of a blocked filter, one 64-byte cache line
+	blockBits = 512
+
+	// headerSize is the size of the encoded filter before the bits: <blocked><numOfHashes><seed><size>
+	headerSize = 17
+)
+
+/*
+BloomFilter represents a Bloom filter structure
+The bits are packed in 64-bit words. The k probes of a key are derived from a single 128-bit hash
+with double hashing: probe i is h1 + i*h2.
+
+A blocked filter keeps all probes of a key inside one 512-bit block, so a lookup touches a single
+cache line, at the price of a slightly higher false-positive rate for the same number of bits.
+*/
 type BloomFilter struct {
-	Bitset      []bool
-	size        uint64
+	bits        []uint64
+	size        uint64 // number of bits
 	numOfHashes int
+	seed        uint32
+	blocked     bool
 }
 
 // NewBloomFilter creates a new Bloom filter with the given size and number of hash functions
 func NewBloomFilter(size uint64, numHashes int) *BloomFilter {
+	return NewBloomFilterWithSeed(size, numHashes, 0)
+}
+
+// NewBloomFilterWithSeed creates a new Bloom filter whose hash functions are derived from seed,
+// filters with different seeds give false positives on different keys
+func NewBloomFilterWithSeed(size uint64, numHashes int, seed uint32) *BloomFilter {
 	return &BloomFilter{
-		Bitset:      make([]bool, size),
+		bits:        make([]uint64, (size+63)/64),
 		size:        size,
 		numOfHashes: numHashes,
+		seed:        seed,
 	}
 }
 
+// NewBloomFilterForKeys creates a Bloom filter sized to hold expectedKeys keys with the given false-positive rate
+func NewBloomFilterForKeys(expectedKeys uint64, fpRate float64, seed uint32) *BloomFilter {
+	size, numHashes := OptimalParams(expectedKeys, fpRate)
+	return NewBloomFilterWithSeed(size, numHashes, seed)
+}
+
+// NewBlockedBloomFilter creates a cache-line-blocked Bloom filter sized to hold expectedKeys keys with the given false-positive rate
+func NewBlockedBloomFilter(expectedKeys uint64, fpRate float64, seed uint32) *BloomFilter {
+	size, numHashes := OptimalParams(expectedKeys, fpRate)
+	size = (size + blockBits - 1) / blockBits * blockBits
+
+	bf := NewBloomFilterWithSeed(size, numHashes, seed)
+	bf.blocked = true
+
+	return bf
+}
+
+/*
+OptimalParams returns the number of bits and hash functions of a Bloom filter holding n keys
+with the false-positive rate p:
+  - bits: m = -n * ln(p) / ln(2)^2
+  - hash functions: k = m / n * ln(2)
+*/
+func OptimalParams(n uint64, p float64) (uint64, int) {
+	n = max(n, 1)
+	p = min(max(p, 1e-9), 0.5)
+
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+
+	return uint64(m), max(k, 1)
+}
+
 // Add inserts an key into the Bloom filter
 func (bf *BloomFilter) Add(key string) {
+	bf.AddHash(murmur3.Sum128WithSeed([]byte(key), bf.seed))
+}
+
+// AddHash inserts the key whose 128-bit murmur3 hash with the seed of the filter is h1, h2
+func (bf *BloomFilter) AddHash(h1, h2 uint64) {
+	if bf.size == 0 {
+		return
+	}
+
 	for i := range bf.numOfHashes {
-		hash := murmur3.Sum64WithSeed([]byte(key), uint32(i))
-		index := hash % uint64(bf.size)
-		bf.Bitset[index] = true
+		index := bf.index(h1, h2, uint64(i))
+		bf.bits[index/64] |= 1 << (index % 64)
 	}
 }
 
 // Contains checks if an key is possibly in the Bloom filter
 func (bf *BloomFilter) MightContain(key string) bool {
-	for i := range bf.numOfHashes {
-		hash := murmur3.Sum64WithSeed([]byte(key), uint32(i))
+	if bf.size == 0 {
+		return true
+	}
 
-		index := hash % uint64(bf.size)
-		if !bf.Bitset[index] {
+	h1, h2 := murmur3.Sum128WithSeed([]byte(key), bf.seed)
+	for i := range bf.numOfHashes {
+		index := bf.index(h1, h2, uint64(i))
+		if bf.bits[index/64]&(1<<(index%64)) == 0 {
 			return false
 		}
 	}
 	return true
 }
+
+// index returns the bit of the i-th probe of a key
+func (bf *BloomFilter) index(h1, h2, i uint64) uint64 {
+	if !bf.blocked {
+		return (h1 + i*h2) % bf.size
+	}
+
+	// The block comes from h1, the probes inside the block from the two halves of h2
+	block := h1 % (bf.size / blockBits)
+	return block*blockBits + (h2&math.MaxUint32+i*(h2>>32|1))%blockBits
+}
+
+// Size returns the number of bits of the filter
+func (bf *BloomFilter) Size() uint64 {
+	return bf.size
+}
+
+// HashCount returns the number of hash functions of the filter
+func (bf *BloomFilter) HashCount() int {
+	return bf.numOfHashes
+}
+
+/*
+MarshalBinary encodes the filter as <blocked><numOfHashes><seed><size><bits>
+  - blocked: 1 byte, 1 for a cache-line-blocked filter
+  - numOfHashes: uint32, the number of hash functions
+  - seed: uint32, the seed of the hash functions
+  - size: uint64, the number of bits
+  - bits: the bitset as 64-bit words
+*/
+func (bf *BloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, headerSize, headerSize+8*len(bf.bits))
+	if bf.blocked {
+		data[0] = 1
+	}
+	binary.BigEndian.PutUint32(data[1:], uint32(bf.numOfHashes))
+	binary.BigEndian.PutUint32(data[5:], bf.seed)
+	binary.BigEndian.PutUint64(data[9:], bf.size)
+
+	for _, word := range bf.bits {
+		data = binary.BigEndian.AppendUint64(data, word)
+	}
+
+	return data, nil
+}
+
+// UnmarshalBinary decodes a filter written by MarshalBinary
+func (bf *BloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize {
+		return errors.New("bloomfilter: short header")
+	}
+
+	blocked := data[0] == 1
+	numOfHashes := int(binary.BigEndian.Uint32(data[1:]))
+	seed := binary.BigEndian.Uint32(data[5:])
+	size := binary.BigEndian.Uint64(data[9:])
+	words := data[headerSize:]
+
+	if data[0] > 1 {
+		return fmt.Errorf("bloomfilter: unknown layout %d", data[0])
+	}
+	if numOfHashes > 0 && size == 0 {
+		return errors.New("bloomfilter: hash functions without bits")
+	}
+	if blocked && size%blockBits != 0 {
+		return fmt.Errorf("bloomfilter: blocked filter of %d bits", size)
+	}
+	if uint64(len(words)) != (size+63)/64*8 {
+		return fmt.Errorf("bloomfilter: %d bytes of bits for %d bits", len(words), size)
+	}
+
+	bf.bits = make([]uint64, (size+63)/64)
+	for i := range bf.bits {
+		bf.bits[i] = binary.BigEndian.Uint64(words[8*i:])
+	}
+	bf.size = size
+	bf.numOfHashes = numOfHashes
+	bf.seed = seed
+	bf.blocked = blocked
+
+	return nil
+}
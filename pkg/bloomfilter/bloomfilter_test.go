@@ -1,6 +1,7 @@
 package bloomfilter
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -43,3 +44,83 @@ func TestEmptyFilter(t *testing.T) {
 	key := "some-key"
 	require.False(t, bf.MightContain(key), "Expected key '%s' to not be in the empty Bloom filter, but it was", key)
 }
+
+func TestMarshalBinary(t *testing.T) {
+	bf := NewBloomFilterWithSeed(1001, 3, 42)
+	for _, key := range []string{"key1", "key2", "key3"} {
+		bf.Add(key)
+	}
+
+	data, err := bf.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := &BloomFilter{}
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	require.Equal(t, bf, decoded)
+
+	require.Error(t, decoded.UnmarshalBinary(data[:len(data)-1]))
+
+	blocked := NewBlockedBloomFilter(100, 0.01, 42)
+	blocked.Add("key1")
+	data, err = blocked.MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	require.Equal(t, blocked, decoded)
+}
+
+func TestOptimalParams(t *testing.T) {
+	// About 9.6 bits per key and 7 hash functions for a 1% false-positive rate
+	size, numHashes := OptimalParams(1000, 0.01)
+	require.InDelta(t, 9586, size, 1)
+	require.Equal(t, 7, numHashes)
+
+	size, numHashes = OptimalParams(0, 0)
+	require.Positive(t, size)
+	require.Positive(t, numHashes)
+}
+
+func TestMeasuredFalsePositiveRate(t *testing.T) {
+	const keys, probes = 10000, 100000
+
+	for name, tc := range map[string]struct {
+		newFilter func(fpRate float64) *BloomFilter
+		slack     float64 // tolerated ratio between the measured and the target rate
+	}{
+		"standard": {func(fpRate float64) *BloomFilter { return NewBloomFilterForKeys(keys, fpRate, 1) }, 1.5},
+		"blocked":  {func(fpRate float64) *BloomFilter { return NewBlockedBloomFilter(keys, fpRate, 1) }, 3.5},
+	} {
+		for _, fpRate := range []float64{0.1, 0.01, 0.001} {
+			t.Run(fmt.Sprintf("%s %g", name, fpRate), func(t *testing.T) {
+				bf := tc.newFilter(fpRate)
+				for i := 0; i < keys; i++ {
+					bf.Add(fmt.Sprintf("key-%d", i))
+				}
+				for i := 0; i < keys; i++ {
+					require.True(t, bf.MightContain(fmt.Sprintf("key-%d", i)))
+				}
+
+				falsePositives := 0
+				for i := 0; i < probes; i++ {
+					if bf.MightContain(fmt.Sprintf("absent-%d", i)) {
+						falsePositives++
+					}
+				}
+
+				measured := float64(falsePositives) / probes
+				t.Logf("target %g, measured %g with %.1f bits per key", fpRate, measured, float64(bf.Size())/keys)
+				require.Less(t, measured, fpRate*tc.slack)
+			})
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	bf := NewBloomFilterWithSeed(64, 2, 7)
+	other := NewBloomFilterWithSeed(64, 2, 8)
+	bf.Add("key")
+	other.Add("key")
+
+	require.True(t, bf.MightContain("key"))
+	require.True(t, other.MightContain("key"))
+	require.NotEqual(t, bf.bits, other.bits)
+}
@@ -0,0 +1,60 @@
+package filter
+
+import (
+	"github.com/richardktran/lsm-tree-go-my-way/pkg/bloomfilter"
+	"github.com/spaolacci/murmur3"
+)
+
+/*
+BloomPolicy builds Bloom filters
+With a false-positive rate the filter is sized from the number of keys, a rate of 1 gives an empty filter
+that lets every key through, otherwise it has Size bits and HashCount hash functions.
+*/
+type BloomPolicy struct {
+	Size      uint64 // bits of the filter when no false-positive rate is given
+	HashCount int    // hash functions of the filter when no false-positive rate is given
+	Blocked   bool   // keep the probes of a key in one cache line, faster for a slightly higher false-positive rate
+}
+
+func (BloomPolicy) Name() string {
+	return "bloom"
+}
+
+func (p BloomPolicy) NewFilter(keys []string, fpRate float64, seed uint32) (Filter, error) {
+	return p.NewFilterFromHashes(hashKeys(p, keys, seed), fpRate, seed)
+}
+
+// HashKey returns the 128-bit murmur3 hash of the key, from which every probe of the key is derived
+func (BloomPolicy) HashKey(key string, seed uint32) KeyHash {
+	h1, h2 := murmur3.Sum128WithSeed([]byte(key), seed)
+	return KeyHash{h1, h2}
+}
+
+func (p BloomPolicy) NewFilterFromHashes(hashes []KeyHash, fpRate float64, seed uint32) (Filter, error) {
+	var bf *bloomfilter.BloomFilter
+	switch {
+	case fpRate >= 1:
+		bf = bloomfilter.NewBloomFilterWithSeed(0, 0, seed)
+	case fpRate > 0 && p.Blocked:
+		bf = bloomfilter.NewBlockedBloomFilter(uint64(len(hashes)), fpRate, seed)
+	case fpRate > 0:
+		bf = bloomfilter.NewBloomFilterForKeys(uint64(len(hashes)), fpRate, seed)
+	default:
+		bf = bloomfilter.NewBloomFilterWithSeed(p.Size, p.HashCount, seed)
+	}
+
+	for _, h := range hashes {
+		bf.AddHash(h[0], h[1])
+	}
+
+	return bf, nil
+}
+
+func (BloomPolicy) Decode(data []byte) (Filter, error) {
+	bf := &bloomfilter.BloomFilter{}
+	if err := bf.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
@@ -0,0 +1,362 @@
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/spaolacci/murmur3"
+)
+
+const (
+	// bucketSize is the number of fingerprints per bucket
+	bucketSize = 4
+
+	// cuckooLoadFactor is the share of slots a cuckoo filter is sized to fill
+	cuckooLoadFactor = 0.9
+
+	// maxKicks is the number of relocations tried before an insert gives up
+	maxKicks = 500
+
+	// cuckooHeaderSize is the size of the encoded filter before the slots
+	cuckooHeaderSize = 1 + 4 + 8 + 8 + 1 + 8 + 2
+)
+
+// CuckooPolicy builds cuckoo filters, which unlike Bloom filters support deleting keys
+type CuckooPolicy struct{}
+
+func (CuckooPolicy) Name() string {
+	return "cuckoo"
+}
+
+// NewFilter builds a cuckoo filter, doubling its size until every key fits
+func (p CuckooPolicy) NewFilter(keys []string, fpRate float64, seed uint32) (Filter, error) {
+	return p.NewFilterFromHashes(hashKeys(p, keys, seed), fpRate, seed)
+}
+
+// HashKey returns the 64-bit murmur3 hash of the key, from which its fingerprint and first bucket are taken
+func (CuckooPolicy) HashKey(key string, seed uint32) KeyHash {
+	return KeyHash{murmur3.Sum64WithSeed([]byte(key), seed)}
+}
+
+func (CuckooPolicy) NewFilterFromHashes(hashes []KeyHash, fpRate float64, seed uint32) (Filter, error) {
+	for capacity := uint64(len(hashes)); ; capacity *= 2 {
+		f := NewCuckooFilter(capacity, fpRate, seed)
+		if f.insertAll(hashes) {
+			return f, nil
+		}
+		if capacity > math.MaxUint64/4 {
+			return nil, errors.New("filter: cuckoo filter cannot hold the keys")
+		}
+	}
+}
+
+func (CuckooPolicy) Decode(data []byte) (Filter, error) {
+	f := &CuckooFilter{}
+	if err := f.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+/*
+CuckooFilter stores a fingerprint of every key in one of two candidate buckets (partial-key cuckoo hashing):
+the second bucket is derived from the first and the fingerprint, so entries can be relocated and deleted
+without knowing the key. The false-positive rate is about 2*bucketSize*load / 2^fpBits, load being the share of
+used slots, and fingerprints are stored packed at fpBits bits, in memory and on disk.
+An entry that could not be placed after maxKicks relocations is kept as the victim, the filter is then full.
+*/
+type CuckooFilter struct {
+	slots       []byte // numBuckets*bucketSize fingerprints of fpBits bits packed most significant bit first, 0 is an empty slot
+	numBuckets  uint64 // a power of two
+	fpBits      uint8
+	seed        uint32
+	count       uint64
+	hasVictim   bool
+	victimIndex uint64
+	victim      uint16
+}
+
+// NewCuckooFilter creates a cuckoo filter sized to hold capacity keys with the given false-positive rate
+func NewCuckooFilter(capacity uint64, fpRate float64, seed uint32) *CuckooFilter {
+	if fpRate <= 0 {
+		fpRate = DefaultFPRate
+	}
+
+	numBuckets := uint64(math.Ceil(float64(max(capacity, 1)) / (bucketSize * cuckooLoadFactor)))
+	numBuckets = 1 << bits.Len64(numBuckets-1)
+
+	// Rounding to a power of two leaves slots empty, and the false-positive rate falls with the share of used slots
+	load := float64(max(capacity, 1)) / float64(numBuckets*bucketSize)
+	fpBits := math.Ceil(math.Log2(2 * bucketSize * load / fpRate))
+	fpBits = min(max(fpBits, 4), 16)
+
+	return &CuckooFilter{
+		slots:      make([]byte, packedSize(numBuckets*bucketSize, uint8(fpBits))),
+		numBuckets: numBuckets,
+		fpBits:     uint8(fpBits),
+		seed:       seed,
+	}
+}
+
+// Insert adds the key, it returns false when the filter is full
+func (f *CuckooFilter) Insert(key string) bool {
+	return f.insertHash(murmur3.Sum64WithSeed([]byte(key), f.seed))
+}
+
+// insertHash adds the key whose hash is h, see CuckooPolicy.HashKey
+func (f *CuckooFilter) insertHash(h uint64) bool {
+	if f.hasVictim {
+		return false
+	}
+
+	fp, i1 := f.split(h)
+	if f.insertAt(i1, fp) || f.insertAt(f.altIndex(i1, fp), fp) {
+		f.count++
+		return true
+	}
+
+	// Both buckets are full: evict fingerprints to their other bucket until one finds room
+	i := f.altIndex(i1, fp)
+	rnd := uint64(f.seed) | 1
+	for kick := 0; kick < maxKicks; kick++ {
+		rnd ^= rnd << 13
+		rnd ^= rnd >> 7
+		rnd ^= rnd << 17
+
+		slot := i*bucketSize + rnd%bucketSize
+		evicted := f.get(slot)
+		f.set(slot, fp)
+		fp = evicted
+		i = f.altIndex(i, fp)
+		if f.insertAt(i, fp) {
+			f.count++
+			return true
+		}
+	}
+
+	f.count++
+	f.hasVictim = true
+	f.victimIndex = i
+	f.victim = fp
+
+	return true
+}
+
+// Delete removes one occurrence of the key, it must only be called for keys that were inserted
+func (f *CuckooFilter) Delete(key string) bool {
+	fp, i1 := f.hash(key)
+	i2 := f.altIndex(i1, fp)
+
+	if f.hasVictim && f.victim == fp && (f.victimIndex == i1 || f.victimIndex == i2) {
+		f.hasVictim = false
+		f.count--
+		return true
+	}
+
+	if !f.deleteAt(i1, fp) && !f.deleteAt(i2, fp) {
+		return false
+	}
+	f.count--
+
+	// A slot was freed, give the victim another chance
+	if f.hasVictim {
+		victimIndex, victim := f.victimIndex, f.victim
+		f.hasVictim = false
+		f.count--
+		f.insertFingerprint(victimIndex, victim)
+	}
+
+	return true
+}
+
+func (f *CuckooFilter) MightContain(key string) bool {
+	fp, i1 := f.hash(key)
+	i2 := f.altIndex(i1, fp)
+
+	if f.hasVictim && f.victim == fp && (f.victimIndex == i1 || f.victimIndex == i2) {
+		return true
+	}
+
+	return f.bucketHas(i1, fp) || f.bucketHas(i2, fp)
+}
+
+// Count returns the number of keys in the filter
+func (f *CuckooFilter) Count() uint64 {
+	return f.count
+}
+
+// insertAll inserts every key by its hash, it returns false when the filter is too small to hold them
+func (f *CuckooFilter) insertAll(hashes []KeyHash) bool {
+	for _, h := range hashes {
+		if !f.insertHash(h[0]) || f.hasVictim {
+			return false
+		}
+	}
+
+	return true
+}
+
+// insertFingerprint places a fingerprint whose bucket is known, relocating entries as Insert does
+func (f *CuckooFilter) insertFingerprint(i uint64, fp uint16) {
+	if f.insertAt(i, fp) || f.insertAt(f.altIndex(i, fp), fp) {
+		f.count++
+		return
+	}
+
+	f.count++
+	f.hasVictim = true
+	f.victimIndex = i
+	f.victim = fp
+}
+
+func (f *CuckooFilter) hash(key string) (uint16, uint64) {
+	return f.split(murmur3.Sum64WithSeed([]byte(key), f.seed))
+}
+
+// split returns the fingerprint and the first bucket of the key whose hash is h
+func (f *CuckooFilter) split(h uint64) (uint16, uint64) {
+	fp := uint16((h >> 32) & (1<<f.fpBits - 1))
+	if fp == 0 {
+		fp = 1 // 0 marks an empty slot
+	}
+
+	return fp, h & (f.numBuckets - 1)
+}
+
+// altIndex returns the other bucket of a fingerprint stored in bucket i, altIndex(altIndex(i, fp), fp) == i
+func (f *CuckooFilter) altIndex(i uint64, fp uint16) uint64 {
+	return (i ^ (uint64(fp) * 0x5bd1e995)) & (f.numBuckets - 1)
+}
+
+func (f *CuckooFilter) insertAt(i uint64, fp uint16) bool {
+	for slot := i * bucketSize; slot < (i+1)*bucketSize; slot++ {
+		if f.get(slot) == 0 {
+			f.set(slot, fp)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *CuckooFilter) deleteAt(i uint64, fp uint16) bool {
+	for slot := i * bucketSize; slot < (i+1)*bucketSize; slot++ {
+		if f.get(slot) == fp {
+			f.set(slot, 0)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *CuckooFilter) bucketHas(i uint64, fp uint16) bool {
+	for slot := i * bucketSize; slot < (i+1)*bucketSize; slot++ {
+		if f.get(slot) == fp {
+			return true
+		}
+	}
+
+	return false
+}
+
+// get returns the fingerprint of a slot, read from the (at most) 3 bytes holding its fpBits bits
+func (f *CuckooFilter) get(slot uint64) uint16 {
+	bit := slot * uint64(f.fpBits)
+	var window uint32
+	for j := uint64(0); j < 3; j++ {
+		window <<= 8
+		if bit/8+j < uint64(len(f.slots)) {
+			window |= uint32(f.slots[bit/8+j])
+		}
+	}
+	shift := 24 - bit%8 - uint64(f.fpBits)
+
+	return uint16(window>>shift) & (1<<f.fpBits - 1)
+}
+
+// set writes the fingerprint of a slot, leaving the bits of its neighbours untouched
+func (f *CuckooFilter) set(slot uint64, fp uint16) {
+	bit := slot * uint64(f.fpBits)
+	shift := 24 - bit%8 - uint64(f.fpBits)
+	mask := uint32(1<<f.fpBits-1) << shift
+	value := uint32(fp) << shift
+	for j := uint64(0); j < 3 && bit/8+j < uint64(len(f.slots)); j++ {
+		byteShift := 16 - 8*j
+		b := &f.slots[bit/8+j]
+		*b = *b&^byte(mask>>byteShift) | byte(value>>byteShift)
+	}
+}
+
+// packedSize returns the bytes of n fingerprints of fpBits bits
+func packedSize(n uint64, fpBits uint8) uint64 {
+	return (n*uint64(fpBits) + 7) / 8
+}
+
+/*
+MarshalBinary encodes the filter as <fpBits><seed><numBuckets><count><hasVictim><victimIndex><victim><slots>
+  - fpBits: 1 byte, seed: uint32, numBuckets: uint64, count: uint64
+  - hasVictim: 1 byte, victimIndex: uint64, victim: uint16
+  - slots: numBuckets*bucketSize fingerprints of fpBits bits, packed most significant bit first
+*/
+func (f *CuckooFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, cuckooHeaderSize+len(f.slots))
+	data = append(data, f.fpBits)
+	data = binary.BigEndian.AppendUint32(data, f.seed)
+	data = binary.BigEndian.AppendUint64(data, f.numBuckets)
+	data = binary.BigEndian.AppendUint64(data, f.count)
+	if f.hasVictim {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = binary.BigEndian.AppendUint64(data, f.victimIndex)
+	data = binary.BigEndian.AppendUint16(data, f.victim)
+
+	return append(data, f.slots...), nil
+}
+
+/*
+UnmarshalBinary decodes a filter written by MarshalBinary. Filters written before the slots were packed hold a
+uint16 per slot, the same layout as packed 16-bit fingerprints, and are repacked.
+*/
+func (f *CuckooFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < cuckooHeaderSize {
+		return errors.New("filter: short cuckoo filter header")
+	}
+
+	fpBits := data[0]
+	numBuckets := binary.BigEndian.Uint64(data[5:])
+	if fpBits == 0 || fpBits > 16 || numBuckets == 0 || numBuckets&(numBuckets-1) != 0 {
+		return fmt.Errorf("filter: invalid cuckoo filter with %d buckets of %d-bit fingerprints", numBuckets, fpBits)
+	}
+	slotsSize := uint64(len(data) - cuckooHeaderSize)
+	packed := packedSize(bucketSize*numBuckets, fpBits)
+	if numBuckets > uint64(len(data)) || (slotsSize != packed && slotsSize != 2*bucketSize*numBuckets) {
+		return fmt.Errorf("filter: %d bytes of slots for %d buckets", slotsSize, numBuckets)
+	}
+
+	f.fpBits = fpBits
+	f.seed = binary.BigEndian.Uint32(data[1:])
+	f.numBuckets = numBuckets
+	f.count = binary.BigEndian.Uint64(data[13:])
+	f.hasVictim = data[21] == 1
+	f.victimIndex = binary.BigEndian.Uint64(data[22:]) & (numBuckets - 1)
+	f.victim = binary.BigEndian.Uint16(data[30:])
+
+	if slotsSize == packed {
+		f.slots = append([]byte(nil), data[cuckooHeaderSize:]...)
+		return nil
+	}
+
+	f.slots = make([]byte, packed)
+	for i := uint64(0); i < bucketSize*numBuckets; i++ {
+		f.set(i, binary.BigEndian.Uint16(data[cuckooHeaderSize+2*i:])&(1<<fpBits-1))
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+// Package filter defines the policies that build and decode the per-SSTable key filters
+package filter
+
+import (
+	"fmt"
+)
+
+// Filter answers whether a key may be in the set of keys it was built from
+type Filter interface {
+	// MightContain returns false only when the key is not in the set
+	MightContain(key string) bool
+
+	// MarshalBinary encodes the filter so that the policy that built it can decode it
+	MarshalBinary() ([]byte, error)
+}
+
+/*
+FilterPolicy builds and decodes filters of one kind.
+The name of the policy is stored next to every encoded filter, so a filter is always decoded
+by the policy that built it, whatever policy is configured today.
+*/
+type FilterPolicy interface {
+	// Name identifies the encoding of the filters of the policy
+	Name() string
+
+	// NewFilter builds a filter holding the keys with the target false-positive rate,
+	// seed makes the false positives of filters built from different sets independent
+	NewFilter(keys []string, fpRate float64, seed uint32) (Filter, error)
+
+	// Decode decodes a filter encoded by MarshalBinary
+	Decode(data []byte) (Filter, error)
+}
+
+// KeyHash is the 128-bit hash of a key that the filters of a HashPolicy are built from
+type KeyHash [2]uint64
+
+/*
+HashPolicy is implemented by the policies that build a filter from a fixed-size hash of every key,
+so that a table writer keeps a KeyHash per key rather than the keys until the filter is built.
+*/
+type HashPolicy interface {
+	FilterPolicy
+
+	// HashKey returns the hash of the key in the filters built with the seed
+	HashKey(key string, seed uint32) KeyHash
+
+	// NewFilterFromHashes is NewFilter from the hashes of the keys returned by HashKey
+	NewFilterFromHashes(hashes []KeyHash, fpRate float64, seed uint32) (Filter, error)
+}
+
+// hashKeys returns the hashes of the keys returned by the HashKey method of the policy
+func hashKeys(policy HashPolicy, keys []string, seed uint32) []KeyHash {
+	hashes := make([]KeyHash, len(keys))
+	for i, key := range keys {
+		hashes[i] = policy.HashKey(key, seed)
+	}
+
+	return hashes
+}
+
+// DefaultFPRate is the false-positive rate used by the policies when none is given
+const DefaultFPRate = 0.01
+
+// The built-in policies build their filters from key hashes
+var (
+	_ HashPolicy = BloomPolicy{}
+	_ HashPolicy = CuckooPolicy{}
+	_ HashPolicy = XorPolicy{}
+)
+
+// policies holds the built-in policies by name, used to decode stored filters
+var policies = map[string]FilterPolicy{
+	BloomPolicy{}.Name():  BloomPolicy{},
+	CuckooPolicy{}.Name(): CuckooPolicy{},
+	XorPolicy{}.Name():    XorPolicy{},
+}
+
+// PolicyByName returns the built-in policy with the given name
+func PolicyByName(name string) (FilterPolicy, bool) {
+	policy, ok := policies[name]
+	return policy, ok
+}
+
+// Decode decodes a filter built by the policy with the given name
+func Decode(name string, data []byte) (Filter, error) {
+	policy, ok := PolicyByName(name)
+	if !ok {
+		return nil, fmt.Errorf("filter: unknown policy %q", name)
+	}
+
+	return policy.Decode(data)
+}
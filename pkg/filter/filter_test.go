@@ -0,0 +1,185 @@
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicies(t *testing.T) {
+	const keys, probes = 10000, 100000
+
+	for _, policy := range []FilterPolicy{BloomPolicy{}, BloomPolicy{Blocked: true}, CuckooPolicy{}, XorPolicy{}} {
+		for _, fpRate := range []float64{0.01, 0.001} {
+			t.Run(fmt.Sprintf("%s %+v %g", policy.Name(), policy, fpRate), func(t *testing.T) {
+				set := make([]string, keys)
+				for i := range set {
+					set[i] = fmt.Sprintf("key-%d", i)
+				}
+
+				f, err := policy.NewFilter(set, fpRate, 1)
+				require.NoError(t, err)
+
+				data, err := f.MarshalBinary()
+				require.NoError(t, err)
+				decoded, err := Decode(policy.Name(), data)
+				require.NoError(t, err)
+
+				for _, key := range set {
+					require.True(t, f.MightContain(key))
+					require.True(t, decoded.MightContain(key))
+				}
+
+				falsePositives := 0
+				for i := 0; i < probes; i++ {
+					if decoded.MightContain(fmt.Sprintf("absent-%d", i)) {
+						falsePositives++
+					}
+				}
+
+				measured := float64(falsePositives) / probes
+				t.Logf("target %g, measured %g with %.1f bits per key", fpRate, measured, float64(8*len(data))/keys)
+				require.Less(t, measured, fpRate*4)
+			})
+		}
+	}
+}
+
+func TestNewFilterFromHashes(t *testing.T) {
+	for _, policy := range []HashPolicy{BloomPolicy{}, BloomPolicy{Blocked: true}, CuckooPolicy{}, XorPolicy{}} {
+		t.Run(fmt.Sprintf("%s %+v", policy.Name(), policy), func(t *testing.T) {
+			keys := make([]string, 1000)
+			hashes := make([]KeyHash, len(keys))
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key-%d", i)
+				hashes[i] = policy.HashKey(keys[i], 3)
+			}
+
+			fromKeys, err := policy.NewFilter(keys, 0.01, 3)
+			require.NoError(t, err)
+			fromHashes, err := policy.NewFilterFromHashes(hashes, 0.01, 3)
+			require.NoError(t, err)
+
+			// Both filters are the same, so a writer only has to keep the hashes
+			want, err := fromKeys.MarshalBinary()
+			require.NoError(t, err)
+			got, err := fromHashes.MarshalBinary()
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func TestCuckooFilterDelete(t *testing.T) {
+	f := NewCuckooFilter(100, 0.01, 7)
+	for i := 0; i < 100; i++ {
+		require.True(t, f.Insert(fmt.Sprintf("key-%d", i)))
+	}
+	require.Equal(t, uint64(100), f.Count())
+
+	for i := 0; i < 50; i++ {
+		require.True(t, f.Delete(fmt.Sprintf("key-%d", i)))
+	}
+	require.Equal(t, uint64(50), f.Count())
+
+	for i := 50; i < 100; i++ {
+		require.True(t, f.MightContain(fmt.Sprintf("key-%d", i)))
+	}
+	deleted := 0
+	for i := 0; i < 50; i++ {
+		if !f.MightContain(fmt.Sprintf("key-%d", i)) {
+			deleted++
+		}
+	}
+	require.Greater(t, deleted, 45)
+	require.False(t, f.Delete("never-inserted"))
+}
+
+func TestCuckooFilterFull(t *testing.T) {
+	f := NewCuckooFilter(8, 0.01, 7)
+
+	inserted := 0
+	for i := 0; i < 1000 && f.Insert(fmt.Sprintf("key-%d", i)); i++ {
+		inserted++
+	}
+
+	require.Less(t, inserted, 1000)
+	for i := 0; i < inserted; i++ {
+		require.True(t, f.MightContain(fmt.Sprintf("key-%d", i)))
+	}
+}
+
+func TestCuckooFilterPacked(t *testing.T) {
+	const keys = 10000
+	set := make([]string, keys)
+	for i := range set {
+		set[i] = fmt.Sprintf("key-%d", i)
+	}
+	f, err := CuckooPolicy{}.NewFilter(set, 0.01, 1)
+	require.NoError(t, err)
+	cuckoo := f.(*CuckooFilter)
+
+	// Fingerprints take fpBits bits each, not 16
+	data, err := f.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, uint8(9), cuckoo.fpBits)
+	require.Equal(t, int(packedSize(cuckoo.numBuckets*bucketSize, 9)), len(data)-cuckooHeaderSize)
+
+	// A filter written with a uint16 per slot is still read
+	legacy := append([]byte(nil), data[:cuckooHeaderSize]...)
+	for i := uint64(0); i < cuckoo.numBuckets*bucketSize; i++ {
+		legacy = binary.BigEndian.AppendUint16(legacy, cuckoo.get(i))
+	}
+	decoded, err := Decode(CuckooPolicy{}.Name(), legacy)
+	require.NoError(t, err)
+	for _, key := range set {
+		require.True(t, decoded.MightContain(key))
+	}
+	repacked, err := decoded.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, data, repacked)
+}
+
+func TestDecodeUnknownPolicy(t *testing.T) {
+	_, err := Decode("unknown", nil)
+	require.Error(t, err)
+
+	_, err = Decode(XorPolicy{}.Name(), []byte{8, 0, 0})
+	require.Error(t, err)
+	_, err = Decode(CuckooPolicy{}.Name(), []byte{8, 0, 0})
+	require.Error(t, err)
+}
+
+func TestAllocateFPRates(t *testing.T) {
+	keys := []uint64{1000, 10000, 100000}
+	budget := BloomBits(111000, 0.01) // the memory of a uniform 1% rate
+
+	rates := AllocateFPRates(keys, budget)
+
+	// The whole budget is used and the rates are proportional to the level sizes
+	var used uint64
+	for i, n := range keys {
+		used += BloomBits(n, rates[i])
+	}
+	require.InDelta(t, float64(budget), float64(used), float64(len(keys)))
+	require.InDelta(t, rates[1]/rates[0], 10, 1e-6)
+	require.InDelta(t, rates[2]/rates[1], 10, 1e-6)
+
+	// For the same memory the expected false positives per lookup are lower than with a uniform rate
+	require.Less(t, rates[0]+rates[1]+rates[2], 3*0.01)
+}
+
+func TestAllocateFPRatesSmallBudget(t *testing.T) {
+	keys := []uint64{100, 0, 1000000}
+
+	rates := AllocateFPRates(keys, 1000)
+
+	require.Equal(t, float64(1), rates[2]) // the largest level is not worth filtering
+	require.Zero(t, rates[1])
+	require.Less(t, rates[0], 0.01)
+	require.InDelta(t, 1000, float64(BloomBits(100, rates[0])), 1)
+
+	require.Equal(t, []float64{1, 1}, AllocateFPRates([]uint64{10, 10}, 0))
+}
@@ -0,0 +1,76 @@
+package filter
+
+import (
+	"math"
+)
+
+/*
+AllocateFPRates splits a filter memory budget of budgetBits bits between the levels (or sorted runs) of a tree
+holding keys[i] keys each and returns the false-positive rate of the filters of every level (Monkey, Dayan et al.).
+
+A lookup of an absent key reads every level whose filter gives a false positive, so the expected cost is the sum
+of the false-positive rates of the levels. With bits(p) = -ln(p) / ln(2)^2 bits per key, minimising
+that sum for a fixed total of bits gives every level a rate proportional to its number of keys:
+large levels get fewer bits per key, small levels get more.
+
+The rates are only right for Bloom filters: cuckoo and xor filters spend their bits per key differently.
+
+A level whose rate would reach 1 gets no filter memory at all (rate 1) and the budget is shared by the others.
+Levels without keys get rate 0.
+*/
+func AllocateFPRates(keys []uint64, budgetBits uint64) []float64 {
+	rates := make([]float64, len(keys))
+
+	active := make([]bool, len(keys))
+	for i, n := range keys {
+		active[i] = n > 0 && budgetBits > 0
+		if n > 0 && budgetBits == 0 {
+			rates[i] = 1
+		}
+	}
+
+	for {
+		// p_i = lambda * n_i, with lambda chosen so that the levels use the whole budget:
+		// sum(-n_i * ln(lambda * n_i)) = budget * ln(2)^2
+		var total, weighted float64
+		for i, n := range keys {
+			if active[i] {
+				total += float64(n)
+				weighted += float64(n) * math.Log(float64(n))
+			}
+		}
+		if total == 0 {
+			break
+		}
+		logLambda := -(float64(budgetBits)*math.Ln2*math.Ln2 + weighted) / total
+
+		largest := -1
+		for i, n := range keys {
+			if !active[i] {
+				continue
+			}
+			rates[i] = math.Exp(logLambda) * float64(n)
+			if rates[i] >= 1 && (largest < 0 || n > keys[largest]) {
+				largest = i
+			}
+		}
+		if largest < 0 {
+			break
+		}
+
+		// The largest level is not worth filtering, give its memory to the others
+		active[largest] = false
+		rates[largest] = 1
+	}
+
+	return rates
+}
+
+// BloomBits returns the number of bits of Bloom filters holding keys keys with the false-positive rate fpRate
+func BloomBits(keys uint64, fpRate float64) uint64 {
+	if fpRate >= 1 || keys == 0 {
+		return 0
+	}
+
+	return uint64(math.Ceil(-float64(keys) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+}
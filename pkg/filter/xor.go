@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/spaolacci/murmur3"
+)
+
+const (
+	// maxXorAttempts is the number of hash seeds tried before building an xor filter gives up
+	maxXorAttempts = 100
+
+	// xorHeaderSize is the size of the encoded filter before the fingerprints
+	xorHeaderSize = 1 + 8 + 4
+)
+
+// XorPolicy builds xor filters: static filters that use less memory than a Bloom filter for the same false-positive rate
+type XorPolicy struct{}
+
+func (XorPolicy) Name() string {
+	return "xor"
+}
+
+// NewFilter builds an xor filter with 8-bit fingerprints, or 16-bit ones when the target rate is below 1/256
+func (p XorPolicy) NewFilter(keys []string, fpRate float64, seed uint32) (Filter, error) {
+	return p.NewFilterFromHashes(hashKeys(p, keys, seed), fpRate, seed)
+}
+
+// HashKey returns the 64-bit murmur3 hash of the key, mixed with the seed of the filter when it is looked up
+func (XorPolicy) HashKey(key string, seed uint32) KeyHash {
+	return KeyHash{murmur3.Sum64([]byte(key))}
+}
+
+func (XorPolicy) NewFilterFromHashes(hashes []KeyHash, fpRate float64, seed uint32) (Filter, error) {
+	if fpRate <= 0 {
+		fpRate = DefaultFPRate
+	}
+
+	fpBits := uint8(8)
+	if fpRate < 1.0/256 {
+		fpBits = 16
+	}
+
+	keyHashes := make([]uint64, len(hashes))
+	for i, h := range hashes {
+		keyHashes[i] = h[0]
+	}
+
+	return newXorFilter(keyHashes, fpBits, seed)
+}
+
+func (XorPolicy) Decode(data []byte) (Filter, error) {
+	f := &XorFilter{}
+	if err := f.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+/*
+XorFilter is the filter of Graf and Lemire: a key hashes to one slot in each of three segments
+and the xor of the three slots is the fingerprint of the key.
+It uses about 1.23 * fpBits bits per key for a false-positive rate of 1/2^fpBits, keys cannot be added once it is built.
+*/
+type XorFilter struct {
+	fingerprints []byte // 3 segments of blockLength slots of fpBits/8 bytes
+	blockLength  uint32
+	fpBits       uint8
+	seed         uint64
+}
+
+// NewXorFilter builds an xor filter from distinct keys with fingerprints of fpBits (8 or 16) bits
+func NewXorFilter(keys []string, fpBits uint8, seed uint32) (*XorFilter, error) {
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = murmur3.Sum64([]byte(key))
+	}
+
+	return newXorFilter(hashes, fpBits, seed)
+}
+
+// newXorFilter builds an xor filter from the murmur3 hashes of distinct keys
+func newXorFilter(hashes []uint64, fpBits uint8, seed uint32) (*XorFilter, error) {
+	capacity := 32 + uint32(1.23*float64(len(hashes)))
+	f := &XorFilter{
+		blockLength: capacity / 3,
+		fpBits:      fpBits,
+		seed:        uint64(seed),
+	}
+
+	for attempt := 0; attempt < maxXorAttempts; attempt++ {
+		if f.build(hashes) {
+			return f, nil
+		}
+		f.seed = mix(f.seed + 0x9e3779b97f4a7c15)
+	}
+
+	return nil, errors.New("filter: cannot build xor filter, are the keys distinct?")
+}
+
+// build assigns the fingerprints by peeling the keys off the slots they alone hash to
+func (f *XorFilter) build(hashes []uint64) bool {
+	size := 3 * f.blockLength
+	xorMask := make([]uint64, size)
+	count := make([]uint32, size)
+
+	for _, h := range hashes {
+		h = mix(h ^ f.seed)
+		for _, slot := range f.slots(h) {
+			xorMask[slot] ^= h
+			count[slot]++
+		}
+	}
+
+	queue := make([]uint32, 0, size)
+	for slot := range count {
+		if count[slot] == 1 {
+			queue = append(queue, uint32(slot))
+		}
+	}
+
+	// stack holds the peeled keys with the slot each one alone hashed to
+	type peeled struct {
+		slot uint32
+		hash uint64
+	}
+	stack := make([]peeled, 0, len(hashes))
+
+	for len(queue) > 0 {
+		slot := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if count[slot] != 1 {
+			continue
+		}
+
+		h := xorMask[slot]
+		stack = append(stack, peeled{slot: slot, hash: h})
+		for _, other := range f.slots(h) {
+			xorMask[other] ^= h
+			count[other]--
+			if count[other] == 1 {
+				queue = append(queue, other)
+			}
+		}
+	}
+
+	if len(stack) != len(hashes) {
+		return false
+	}
+
+	f.fingerprints = make([]byte, size*uint32(f.fpBits/8))
+	for i := len(stack) - 1; i >= 0; i-- {
+		slots := f.slots(stack[i].hash)
+		f.set(stack[i].slot, f.fingerprint(stack[i].hash)^f.get(slots[0])^f.get(slots[1])^f.get(slots[2]))
+	}
+
+	return true
+}
+
+func (f *XorFilter) MightContain(key string) bool {
+	if len(f.fingerprints) == 0 {
+		return false
+	}
+
+	h := mix(murmur3.Sum64([]byte(key)) ^ f.seed)
+	slots := f.slots(h)
+
+	return f.fingerprint(h) == f.get(slots[0])^f.get(slots[1])^f.get(slots[2])
+}
+
+func (f *XorFilter) get(slot uint32) uint16 {
+	if f.fpBits == 8 {
+		return uint16(f.fingerprints[slot])
+	}
+	return binary.BigEndian.Uint16(f.fingerprints[2*slot:])
+}
+
+func (f *XorFilter) set(slot uint32, fp uint16) {
+	if f.fpBits == 8 {
+		f.fingerprints[slot] = byte(fp)
+		return
+	}
+	binary.BigEndian.PutUint16(f.fingerprints[2*slot:], fp)
+}
+
+// slots returns the slot of a hash in each of the three segments
+func (f *XorFilter) slots(h uint64) [3]uint32 {
+	return [3]uint32{
+		reduce(uint32(h), f.blockLength),
+		reduce(uint32(bits.RotateLeft64(h, 21)), f.blockLength) + f.blockLength,
+		reduce(uint32(bits.RotateLeft64(h, 42)), f.blockLength) + 2*f.blockLength,
+	}
+}
+
+func (f *XorFilter) fingerprint(h uint64) uint16 {
+	return uint16(h^(h>>32)) & (1<<f.fpBits - 1)
+}
+
+/*
+MarshalBinary encodes the filter as <fpBits><seed><blockLength><fingerprints>
+  - fpBits: 1 byte, 8 or 16
+  - seed: uint64, the seed the filter was built with
+  - blockLength: uint32, the number of slots of a segment
+  - fingerprints: 3*blockLength big-endian fingerprints of fpBits bits
+*/
+func (f *XorFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, xorHeaderSize+len(f.fingerprints))
+	data = append(data, f.fpBits)
+	data = binary.BigEndian.AppendUint64(data, f.seed)
+	data = binary.BigEndian.AppendUint32(data, f.blockLength)
+
+	return append(data, f.fingerprints...), nil
+}
+
+// UnmarshalBinary decodes a filter written by MarshalBinary
+func (f *XorFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < xorHeaderSize {
+		return errors.New("filter: short xor filter header")
+	}
+
+	fpBits := data[0]
+	if fpBits != 8 && fpBits != 16 {
+		return fmt.Errorf("filter: xor filter with %d-bit fingerprints", fpBits)
+	}
+	blockLength := binary.BigEndian.Uint32(data[9:])
+	width := uint64(fpBits / 8)
+	if uint64(len(data)-xorHeaderSize) != 3*uint64(blockLength)*width {
+		return fmt.Errorf("filter: %d bytes of fingerprints for %d slots", len(data)-xorHeaderSize, 3*blockLength)
+	}
+
+	f.fpBits = fpBits
+	f.seed = binary.BigEndian.Uint64(data[1:])
+	f.blockLength = blockLength
+	f.fingerprints = append([]byte(nil), data[xorHeaderSize:]...)
+
+	return nil
+}
+
+// mix is the murmur3 64-bit finalizer
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// reduce maps x uniformly to [0, n) without a division
+func reduce(x, n uint32) uint32 {
+	return uint32(uint64(x) * uint64(n) >> 32)
+}
@@ -0,0 +1,119 @@
+/*
+Package lz is a small LZ77 compressor in the spirit of Snappy: no entropy coding, so it is much faster
+than DEFLATE for a lower ratio. It is meant for SSTable blocks of a few KB to a few MB.
+
+Compressed format: <decodedLen><op>...<op>
+  - decodedLen: uvarint, the length of the decoded data
+  - literal op: tag byte 0lllllll followed by l+1 bytes copied as is
+  - match op: tag byte 1lllllll followed by a uvarint offset, copies l+minMatch bytes starting offset bytes back
+*/
+package lz
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	minMatch   = 4
+	maxMatch   = 127 + minMatch
+	maxLiteral = 128
+
+	hashBits = 14
+)
+
+var ErrCorrupt = errors.New("lz: corrupt input")
+
+// Encode appends the compressed form of src to dst and returns the result
+func Encode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+
+	// table holds the last position+1 of every hashed 4-byte sequence, 0 is no position
+	var table [1 << hashBits]int32
+	literalStart := 0
+
+	for i := 0; i+minMatch <= len(src); {
+		h := hash(src[i:])
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if candidate < 0 || src[candidate] != src[i] || src[candidate+1] != src[i+1] ||
+			src[candidate+2] != src[i+2] || src[candidate+3] != src[i+3] {
+			i++
+			continue
+		}
+
+		length := minMatch
+		for i+length < len(src) && length < maxMatch && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		dst = appendLiterals(dst, src[literalStart:i])
+		dst = append(dst, 0x80|byte(length-minMatch))
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+
+		i += length
+		literalStart = i
+	}
+
+	return appendLiterals(dst, src[literalStart:])
+}
+
+// Decode decodes src, which must have been produced by Encode
+func Decode(src []byte) ([]byte, error) {
+	decodedLen, n := binary.Uvarint(src)
+	if n <= 0 || decodedLen > uint64(len(src))*maxMatch {
+		return nil, ErrCorrupt
+	}
+	src = src[n:]
+
+	dst := make([]byte, 0, decodedLen)
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+
+		if tag&0x80 == 0 {
+			length := int(tag) + 1
+			if length > len(src) || uint64(len(dst)+length) > decodedLen {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		}
+
+		length := int(tag&0x7f) + minMatch
+		offset, n := binary.Uvarint(src)
+		if n <= 0 || offset == 0 || offset > uint64(len(dst)) || uint64(len(dst)+length) > decodedLen {
+			return nil, ErrCorrupt
+		}
+		src = src[n:]
+
+		// Byte by byte: a match may overlap the bytes it produces
+		start := len(dst) - int(offset)
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+
+	if uint64(len(dst)) != decodedLen {
+		return nil, ErrCorrupt
+	}
+
+	return dst, nil
+}
+
+func appendLiterals(dst, literals []byte) []byte {
+	for len(literals) > 0 {
+		n := min(len(literals), maxLiteral)
+		dst = append(dst, byte(n-1))
+		dst = append(dst, literals[:n]...)
+		literals = literals[n:]
+	}
+
+	return dst
+}
+
+func hash(b []byte) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 0x1e35a7bd) >> (32 - hashBits)
+}
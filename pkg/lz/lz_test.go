@@ -0,0 +1,61 @@
+package lz
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 10000)
+	rnd.Read(random)
+
+	var json bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&json, `{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":true}`, i, i, i)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":      {},
+		"short":      []byte("abc"),
+		"repeated":   bytes.Repeat([]byte("a"), 1000),
+		"random":     random,
+		"json":       json.Bytes(),
+		"long match": bytes.Repeat([]byte("0123456789"), 100),
+	} {
+		t.Run(name, func(t *testing.T) {
+			encoded := Encode(nil, data)
+			decoded, err := Decode(encoded)
+			require.NoError(t, err)
+			require.Equal(t, len(data), len(decoded))
+			require.True(t, bytes.Equal(data, decoded))
+			t.Logf("%d -> %d bytes", len(data), len(encoded))
+		})
+	}
+
+	require.Less(t, len(Encode(nil, json.Bytes())), json.Len()/3)
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	encoded := Encode(nil, bytes.Repeat([]byte("abcdefgh"), 50))
+
+	for name, data := range map[string][]byte{
+		"empty":           {},
+		"truncated":       encoded[:len(encoded)-1],
+		"wrong length":    append([]byte{0x7f}, encoded[1:]...),
+		"offset too far":  {8, 0x80 | 4, 10},
+		"short literal":   {4, 3, 'a'},
+		"zero offset":     {4, 0, 'a', 0x80, 0},
+		"bad offset":      {4, 0, 'a', 0x80, 0xff},
+		"huge output len": {0xff, 0xff, 0xff, 0xff, 0x0f},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Decode(data)
+			require.ErrorIs(t, err, ErrCorrupt)
+		})
+	}
+}